@@ -34,10 +34,7 @@ func (b *Book) UpdateInc(ev Event) Event {
 	outEv := NewEvent()
 	for _, node := range ev {
 		if bookNode, found := b.m[node.Name]; found {
-			if bookNode.Status != node.Status ||
-				bookNode.Host != node.Host ||
-				bookNode.Port != node.Port {
-
+			if !bookNode.Equal(node) {
 				// Add/update if up, delete if down
 				if node.Status == NodeUp {
 					b.m[bookNode.Name] = node
@@ -73,10 +70,7 @@ func (b *Book) UpdateFull(ev Event) Event {
 			continue // EventNodeDown could not be used on full update
 		}
 		if bookNode, found := b.m[node.Name]; found {
-			if bookNode.Status != node.Status ||
-				bookNode.Host != node.Host ||
-				bookNode.Port != node.Port {
-
+			if !bookNode.Equal(node) {
 				b.m[bookNode.Name] = node
 				marked[bookNode.Name] = struct{}{}
 				outEv.AddNode(node)
@@ -91,7 +85,8 @@ func (b *Book) UpdateFull(ev Event) Event {
 	}
 	for name, node := range b.m {
 		if _, found := marked[name]; !found {
-			outEv.AddNode(NewNodeInfo(node.Name, NodeDown, node.Host, node.Port))
+			node.Status = NodeDown
+			outEv.AddNode(node)
 			delete(b.m, name)
 		}
 	}
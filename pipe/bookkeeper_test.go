@@ -234,6 +234,42 @@ func TestBookUpdateFull(t *testing.T) {
 	}
 }
 
+func TestBookUpdateMeta(t *testing.T) {
+	b := NewBook()
+
+	node := NewNodeInfo("Node1", NodeUp, "127.0.0.1", 80)
+	node.Meta = map[string]string{"zone": "a"}
+	ev := NewEvent()
+	ev.AddNode(node)
+	if ev := b.UpdateFull(ev); ev == nil {
+		t.Fatal("No event received")
+	}
+
+	// Same metadata
+	node.Meta = map[string]string{"zone": "a"}
+	ev = NewEvent()
+	ev.AddNode(node)
+	if ev := b.UpdateInc(ev); ev != nil {
+		t.Fatalf("Did not expect update event, got %s", ev)
+	}
+
+	// Changed metadata
+	node.Meta = map[string]string{"zone": "b"}
+	ev = NewEvent()
+	ev.AddNode(node)
+	if ev := b.UpdateFull(ev); ev == nil {
+		t.Fatal("Expected update event, metadata changed")
+	} else if ev["Node1"].Meta["zone"] != "b" {
+		t.Fatalf("Expected updated metadata, got %s", ev)
+	}
+
+	// Missing node keeps metadata when marked down
+	ev = b.UpdateFull(NewEvent())
+	if node, found := ev["Node1"]; !found || node.Status != NodeDown || node.Meta["zone"] != "b" {
+		t.Fatalf("Expected Node1 down with metadata, got %s", ev)
+	}
+}
+
 func TestBookkeeperReceiver(t *testing.T) {
 	eventCh := make(chan Event)
 
@@ -28,6 +28,7 @@ type NodeInfo struct {
 	Status NodeStatus
 	Host   string
 	Port   uint16
+	Meta   map[string]string // Optional metadata like tags, zone or weight
 }
 
 func NewNodeInfo(name string, status NodeStatus, host string, port uint16) NodeInfo {
@@ -39,7 +40,26 @@ func NewNodeInfo(name string, status NodeStatus, host string, port uint16) NodeI
 	}
 }
 
+// Equal reports whether both nodes are identical including their metadata.
+func (n NodeInfo) Equal(o NodeInfo) bool {
+	if n.Name != o.Name || n.Status != o.Status || n.Host != o.Host || n.Port != o.Port {
+		return false
+	}
+	if len(n.Meta) != len(o.Meta) {
+		return false
+	}
+	for key, val := range n.Meta {
+		if oval, found := o.Meta[key]; !found || oval != val {
+			return false
+		}
+	}
+	return true
+}
+
 func (n NodeInfo) String() string {
+	if len(n.Meta) > 0 {
+		return fmt.Sprintf("Name: %s, Status: %s, Host: %s, Port: %d, Meta: %v", n.Name, n.Status, n.Host, n.Port, n.Meta)
+	}
 	return fmt.Sprintf("Name: %s, Status: %s, Host: %s, Port: %d", n.Name, n.Status, n.Host, n.Port)
 }
 
@@ -0,0 +1,107 @@
+// Package plugintest provides helpers for tests of watcher and reactor plugins.
+package plugintest
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/blang/receptor/pipe"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// Timeout is the time helpers wait for events, content and endpoints to stop.
+const Timeout = 5 * time.Second
+
+// Handle runs the endpoint on the event channel.
+func Handle(handle pipe.Endpoint, eventCh chan pipe.Event) *pipe.ManagedEndpoint {
+	manHandle := pipe.NewManagedEndpoint(handle)
+	go manHandle.Handle(eventCh)
+	return manHandle
+}
+
+// StartReactor accepts the service config and runs the endpoint on a new event channel.
+func StartReactor(t *testing.T, react pipe.Reactor, cfg string) (*pipe.ManagedEndpoint, chan pipe.Event) {
+	t.Helper()
+	handle, err := react.Accept(json.RawMessage(cfg))
+	if err != nil {
+		t.Fatalf("Does not accept config: %s", err)
+	}
+	eventCh := make(chan pipe.Event)
+	return Handle(handle, eventCh), eventCh
+}
+
+// StartWatcher accepts the service config and runs the endpoint on a new event channel.
+func StartWatcher(t *testing.T, watcher pipe.Watcher, cfg string) (*pipe.ManagedEndpoint, chan pipe.Event) {
+	t.Helper()
+	handle, err := watcher.Accept(json.RawMessage(cfg))
+	if err != nil {
+		t.Fatalf("Watcher accept failed: %s", err)
+	}
+	eventCh := make(chan pipe.Event)
+	return Handle(handle, eventCh), eventCh
+}
+
+// Stop stops the endpoint and waits until it returned.
+func Stop(t *testing.T, manHandle *pipe.ManagedEndpoint) {
+	t.Helper()
+	manHandle.Stop()
+	if err := manHandle.WaitTimeout(Timeout); err != nil {
+		t.Errorf("Stop handle timeout: %s", err)
+	}
+}
+
+// ReceiveEvent waits for the next event, the test fails if the channel is closed or on timeout.
+func ReceiveEvent(t *testing.T, eventCh chan pipe.Event) pipe.Event {
+	t.Helper()
+	ev, err := WaitEvent(eventCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ev
+}
+
+// WaitEvent is ReceiveEvent returning errors, safe to use in goroutines.
+func WaitEvent(eventCh chan pipe.Event) (pipe.Event, error) {
+	select {
+	case ev, ok := <-eventCh:
+		if !ok {
+			return nil, errors.New("Channel closed")
+		}
+		return ev, nil
+	case <-time.After(Timeout):
+		return nil, errors.New("Timeout: No event received")
+	}
+}
+
+// WaitFor polls cond until it returns true, the test fails with msg on timeout.
+func WaitFor(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+	if !poll(cond) {
+		t.Fatal(msg)
+	}
+}
+
+// WaitContent polls the file until it has the expected content.
+func WaitContent(t *testing.T, filename string, expected string) {
+	t.Helper()
+	var data []byte
+	if !poll(func() bool {
+		data, _ = ioutil.ReadFile(filename)
+		return string(data) == expected
+	}) {
+		t.Fatalf("Expected content of %s:\n%s\ngot:\n%s", filename, expected, data)
+	}
+}
+
+// poll calls cond every 10ms until it returns true, returns false on timeout.
+func poll(cond func() bool) bool {
+	deadline := time.Now().Add(Timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
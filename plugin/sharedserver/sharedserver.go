@@ -0,0 +1,163 @@
+// Package sharedserver manages servers shared by all endpoints of a plugin.
+package sharedserver
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ShutdownTimeout is the time requests in progress have to complete after the last endpoint released an http server.
+const ShutdownTimeout = 5 * time.Second
+
+// StartFunc starts a server and returns its address and a function stopping it.
+// The stop function must not return before the server released its address.
+type StartFunc func() (addr net.Addr, stop func(), err error)
+
+// Server is started by the first endpoint acquiring it and stopped after the last one released it.
+// Starting and stopping are serialized, a server is never started while the previous one is still stopping.
+// The zero value is ready to use.
+type Server struct {
+	mutex sync.Mutex
+	users int
+	addr  net.Addr
+	stop  func()
+}
+
+// Acquire starts the server using start if it is not running.
+func (s *Server) Acquire(start StartFunc) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.users == 0 {
+		addr, stop, err := start()
+		if err != nil {
+			return err
+		}
+		s.addr, s.stop = addr, stop
+	}
+	s.users++
+	return nil
+}
+
+// Release stops the server if it was the last user.
+func (s *Server) Release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.users == 0 {
+		return
+	}
+	s.users--
+	if s.users == 0 {
+		s.stop()
+		s.addr, s.stop = nil, nil
+	}
+}
+
+// Addr returns the address the server listens on or nil if not running.
+func (s *Server) Addr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.addr
+}
+
+// HTTP serves the handler on the address, using TLS if tlsConfig is set.
+// The server is shut down gracefully, requests in progress have ShutdownTimeout to complete.
+func HTTP(listen string, tlsConfig *tls.Config, handler http.Handler) StartFunc {
+	return func() (net.Addr, func(), error) {
+		listener, err := net.Listen("tcp", listen)
+		if err != nil {
+			return nil, nil, err
+		}
+		addr := listener.Addr()
+		if tlsConfig != nil {
+			listener = tls.NewListener(listener, tlsConfig)
+		}
+		server := &http.Server{Handler: handler}
+		doneCh := make(chan struct{})
+		go func() {
+			defer close(doneCh)
+			err := server.Serve(listener)
+			if err != nil && err != http.ErrServerClosed {
+				log.Printf("Server failed: %s", err)
+			}
+		}()
+		stop := func() {
+			ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+			defer cancel()
+			err := server.Shutdown(ctx)
+			if err != nil {
+				log.Printf("Server shutdown failed: %s", err)
+				server.Close()
+			}
+			<-doneCh
+		}
+		return addr, stop, nil
+	}
+}
+
+// TCP accepts connections on the address, using TLS if tlsConfig is set.
+// See ServeConns for the handling of connections.
+func TCP(listen string, tlsConfig *tls.Config, handle func(net.Conn)) StartFunc {
+	return func() (net.Addr, func(), error) {
+		ln, err := net.Listen("tcp", listen)
+		if err != nil {
+			return nil, nil, err
+		}
+		addr := ln.Addr()
+		if tlsConfig != nil {
+			ln = tls.NewListener(ln, tlsConfig)
+		}
+		return addr, ServeConns(ln, handle), nil
+	}
+}
+
+// ServeConns accepts connections until stopped and handles each one in its own goroutine,
+// connections are closed after handle returned.
+// The returned function closes the listener and all open connections and waits for the handlers to return.
+func ServeConns(ln net.Listener, handle func(net.Conn)) (stop func()) {
+	var mutex sync.Mutex
+	conns := make(map[net.Conn]struct{})
+	closed := false
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return // Closed
+			}
+			mutex.Lock()
+			if closed {
+				mutex.Unlock()
+				conn.Close()
+				return
+			}
+			conns[conn] = struct{}{}
+			wg.Add(1)
+			mutex.Unlock()
+			go func() {
+				defer wg.Done()
+				handle(conn)
+				conn.Close()
+				mutex.Lock()
+				delete(conns, conn)
+				mutex.Unlock()
+			}()
+		}
+	}()
+	return func() {
+		ln.Close()
+		mutex.Lock()
+		closed = true
+		for conn := range conns {
+			conn.Close()
+		}
+		mutex.Unlock()
+		wg.Wait()
+	}
+}
@@ -0,0 +1,117 @@
+package sharedserver
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLifecycle(t *testing.T) {
+	var s Server
+	starts := 0
+	start := func() (net.Addr, func(), error) {
+		starts++
+		return &net.TCPAddr{Port: starts}, func() {}, nil
+	}
+	if err := s.Acquire(start); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Acquire(start); err != nil {
+		t.Fatal(err)
+	}
+	if starts != 1 || s.Addr() == nil {
+		t.Fatalf("Expected server to be started once, started %d times", starts)
+	}
+	s.Release()
+	if s.Addr() == nil {
+		t.Error("Expected server to keep running while in use")
+	}
+	s.Release()
+	if s.Addr() != nil {
+		t.Error("Expected server to be stopped")
+	}
+	s.Release() // Not running
+}
+
+func TestRestart(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := ln.Addr().String()
+	ln.Close()
+
+	// A server stopping slowly must release its address before the next one starts
+	slowStart := func() (net.Addr, func(), error) {
+		addr, stop, err := HTTP(listen, nil, http.NotFoundHandler())()
+		if err != nil {
+			return nil, nil, err
+		}
+		return addr, func() {
+			time.Sleep(10 * time.Millisecond)
+			stop()
+		}, nil
+	}
+	var s Server
+	if err := s.Acquire(slowStart); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Release()
+		}()
+		if err := s.Acquire(slowStart); err != nil {
+			t.Fatalf("Restart failed: %s", err)
+		}
+		wg.Wait()
+	}
+	resp, err := http.Get("http://" + listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	s.Release()
+	if _, err := net.Dial("tcp", listen); err == nil {
+		t.Error("Expected server to be stopped")
+	}
+}
+
+func TestTCP(t *testing.T) {
+	echo := func(conn net.Conn) {
+		buf := make([]byte, 1)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+			conn.Write(buf)
+		}
+	}
+	var s Server
+	if err := s.Acquire(TCP("127.0.0.1:0", nil, echo)); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := []byte("x")
+	if _, err := conn.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(buf); err != nil || string(buf) != "x" {
+		t.Fatalf("Expected echo, got %q: %v", buf, err)
+	}
+
+	// Open connections are closed on stop
+	s.Release()
+	if _, err := conn.Read(buf); err == nil {
+		t.Error("Expected connection to be closed")
+	}
+}
@@ -0,0 +1,468 @@
+package broadcast
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/sharedserver"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message types
+const (
+	MessageFull = "full" // All nodes up, sent on connect
+	MessageInc  = "inc"  // Nodes changed
+)
+
+// BroadcastReactor streams the nodes of services to clients subscribed by server-sent events or websocket.
+// The server is started with the first running endpoint and stopped after the last one closed.
+type BroadcastReactor struct {
+	mutex        sync.Mutex
+	listen       string
+	bufferSize   int
+	writeTimeout time.Duration
+	heartbeat    time.Duration
+	origins      map[string]struct{} // Allowed origins, all if nil
+	services     map[string]*service // Running services
+	accepted     map[string]struct{} // Service names in use
+	server       sharedserver.Server
+}
+
+type Config struct {
+	Listen       string   `json:"listen"`
+	BufferSize   int      `json:"bufferSize"`   // Messages queued per client, clients falling further behind are disconnected
+	WriteTimeout string   `json:"writeTimeout"` // Clients not accepting a message in time are disconnected
+	Heartbeat    string   `json:"heartbeat"`    // Interval of keep-alives, 0 to disable
+	Origins      []string `json:"origins"`      // Origins of browsers allowed to subscribe, all if empty
+}
+
+type ServiceConfig struct {
+	Service string `json:"service"` // Name of the service used in urls
+}
+
+// Message is sent to subscribed clients.
+type Message struct {
+	Type    string `json:"type"` // "full" or "inc"
+	Service string `json:"service"`
+	Seq     uint64 `json:"seq"` // Incremented on every change
+	Nodes   []Node `json:"nodes"`
+}
+
+// Node is the description of a single node.
+type Node struct {
+	Name   string            `json:"name"`
+	Status string            `json:"status"` // "up" or "down"
+	Host   string            `json:"host"`
+	Port   uint16            `json:"port"`
+	Meta   map[string]string `json:"meta,omitempty"`
+}
+
+// update is an encoded message queued for clients.
+type update struct {
+	msgType string
+	seq     uint64
+	data    []byte
+}
+
+// client is a single subscription.
+type client struct {
+	addr   string
+	msgCh  chan *update
+	doneCh chan struct{} // Closed if the client is disconnected by the server
+	code   uint16        // Close code and reason, set before doneCh is closed
+	reason string
+}
+
+// service holds the nodes of a service and its subscribed clients.
+type service struct {
+	mutex   sync.Mutex
+	name    string
+	seq     uint64
+	nodes   []Node // Nodes up sorted by name
+	clients map[*client]struct{}
+	closed  bool
+}
+
+func (r *BroadcastReactor) Setup(cfgData json.RawMessage) error {
+	conf := Config{
+		Listen:       "127.0.0.1:8003",
+		BufferSize:   64,
+		WriteTimeout: "10s",
+		Heartbeat:    "30s",
+	}
+	err := json.Unmarshal(cfgData, &conf)
+	if err != nil {
+		return err
+	}
+	if conf.BufferSize < 1 {
+		return errors.New("Invalid buffer size")
+	}
+	writeTimeout, err := time.ParseDuration(conf.WriteTimeout)
+	if err != nil {
+		return fmt.Errorf("Invalid write timeout: %s", err)
+	}
+	heartbeat, err := time.ParseDuration(conf.Heartbeat)
+	if err != nil {
+		return fmt.Errorf("Invalid heartbeat: %s", err)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.init()
+	r.listen = conf.Listen
+	r.bufferSize = conf.BufferSize
+	r.writeTimeout = writeTimeout
+	r.heartbeat = heartbeat
+	r.origins = nil
+	if len(conf.Origins) > 0 {
+		r.origins = make(map[string]struct{})
+		for _, origin := range conf.Origins {
+			r.origins[origin] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// init sets defaults, the reactor may be used without global config. Needs to hold the mutex.
+func (r *BroadcastReactor) init() {
+	if r.services != nil {
+		return
+	}
+	r.listen = "127.0.0.1:8003"
+	r.bufferSize = 64
+	r.writeTimeout = 10 * time.Second
+	r.heartbeat = 30 * time.Second
+	r.services = make(map[string]*service)
+	r.accepted = make(map[string]struct{})
+}
+
+func (r *BroadcastReactor) Accept(cfgData json.RawMessage) (pipe.Endpoint, error) {
+	var cfg ServiceConfig
+	err := json.Unmarshal(cfgData, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Service == "" || strings.Contains(cfg.Service, "/") {
+		return nil, fmt.Errorf("Invalid service %q", cfg.Service)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.init()
+	if _, found := r.accepted[cfg.Service]; found {
+		return nil, fmt.Errorf("Service %q already in use", cfg.Service)
+	}
+	r.accepted[cfg.Service] = struct{}{}
+
+	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
+		svc := &service{
+			name:    cfg.Service,
+			nodes:   []Node{},
+			clients: make(map[*client]struct{}),
+		}
+		err := r.register(svc)
+		if err != nil {
+			log.Printf("Could not start broadcast server: %s", err)
+			return
+		}
+		defer r.unregister(svc)
+
+		book := pipe.NewBook()
+		for {
+			select {
+			case ev, ok := <-eventCh:
+				if !ok {
+					return
+				}
+				changed := book.UpdateInc(ev)
+				if changed == nil {
+					continue
+				}
+				svc.update(toNodes(book.Full()), toNodes(changed))
+			case <-closeCh:
+				return
+			}
+		}
+	}), nil
+}
+
+// toNodes converts the event to a list of nodes sorted by name.
+func toNodes(ev pipe.Event) []Node {
+	nodes := []Node{}
+	for _, node := range ev {
+		status := "up"
+		if node.Status == pipe.NodeDown {
+			status = "down"
+		}
+		nodes = append(nodes, Node{
+			Name:   node.Name,
+			Status: status,
+			Host:   node.Host,
+			Port:   node.Port,
+			Meta:   node.Meta,
+		})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	return nodes
+}
+
+// Addr returns the address the server listens on or nil if not running.
+func (r *BroadcastReactor) Addr() net.Addr {
+	return r.server.Addr()
+}
+
+// register adds the service and starts the server if needed.
+func (r *BroadcastReactor) register(svc *service) error {
+	r.mutex.Lock()
+	r.services[svc.name] = svc
+	listen := r.listen
+	r.mutex.Unlock()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/service/", r.subscribe)
+	err := r.server.Acquire(sharedserver.HTTP(listen, nil, mux))
+	if err != nil {
+		r.remove(svc)
+	}
+	return err
+}
+
+// unregister removes the service, disconnects its clients and stops the server if it was the last one.
+func (r *BroadcastReactor) unregister(svc *service) {
+	r.remove(svc)
+	r.server.Release()
+}
+
+// remove disconnects the clients of the service and releases its name.
+func (r *BroadcastReactor) remove(svc *service) {
+	svc.close()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.services[svc.name] == svc {
+		delete(r.services, svc.name)
+	}
+	delete(r.accepted, svc.name)
+}
+
+// subscribe streams the service of the url by websocket if requested, otherwise by server-sent events.
+func (r *BroadcastReactor) subscribe(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/service/")
+	r.mutex.Lock()
+	svc, found := r.services[name]
+	bufferSize, writeTimeout, heartbeat := r.bufferSize, r.writeTimeout, r.heartbeat
+	originAllowed := r.originAllowed(req.Header.Get("Origin"))
+	r.mutex.Unlock()
+	if !found {
+		http.Error(w, fmt.Sprintf("Unknown service %q", name), http.StatusNotFound)
+		return
+	}
+	if !originAllowed {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	var heartbeatCh <-chan time.Time
+	if heartbeat > 0 {
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		heartbeatCh = ticker.C
+	}
+	if isWebSocket(req) {
+		r.serveWebSocket(w, req, svc, bufferSize, writeTimeout, heartbeatCh)
+	} else {
+		r.serveEvents(w, req, svc, bufferSize, writeTimeout, heartbeatCh)
+	}
+}
+
+// originAllowed checks the origin of browser requests. Needs to hold the mutex.
+func (r *BroadcastReactor) originAllowed(origin string) bool {
+	if r.origins == nil || origin == "" {
+		return true
+	}
+	_, found := r.origins[origin]
+	return found
+}
+
+// serveEvents streams updates as server-sent events.
+func (r *BroadcastReactor) serveEvents(w http.ResponseWriter, req *http.Request, svc *service, bufferSize int, writeTimeout time.Duration, heartbeatCh <-chan time.Time) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c, err := svc.subscribe(req.RemoteAddr, bufferSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer svc.unsubscribe(c)
+
+	rc := http.NewResponseController(w)
+	if origin := req.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Vary", "Origin")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	write := func(data string) error {
+		rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+		_, err := w.Write([]byte(data))
+		if err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	for {
+		select {
+		case u := <-c.msgCh:
+			err = write("id: " + strconv.FormatUint(u.seq, 10) + "\nevent: " + u.msgType + "\ndata: " + string(u.data) + "\n\n")
+		case <-heartbeatCh:
+			err = write(": ping\n\n")
+		case <-c.doneCh:
+			log.Printf("Disconnected %s from service %s: %s", c.addr, svc.name, c.reason)
+			return
+		case <-req.Context().Done():
+			return
+		}
+		if err != nil {
+			log.Printf("Disconnected %s from service %s: %s", c.addr, svc.name, err)
+			return
+		}
+	}
+}
+
+// serveWebSocket streams updates as text messages over websocket.
+func (r *BroadcastReactor) serveWebSocket(w http.ResponseWriter, req *http.Request, svc *service, bufferSize int, writeTimeout time.Duration, heartbeatCh <-chan time.Time) {
+	conn, reader, err := upgrade(w, req)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	ws := &wsConn{
+		conn:         conn,
+		reader:       reader,
+		writeTimeout: writeTimeout,
+	}
+	c, err := svc.subscribe(req.RemoteAddr, bufferSize)
+	if err != nil {
+		ws.close(CloseGoingAway, err.Error())
+		return
+	}
+	defer svc.unsubscribe(c)
+
+	readErrCh := make(chan error, 1)
+	go func() {
+		readErrCh <- ws.readLoop()
+	}()
+	for {
+		select {
+		case u := <-c.msgCh:
+			err = ws.write(opText, u.data)
+		case <-heartbeatCh:
+			err = ws.write(opPing, nil)
+		case <-c.doneCh:
+			log.Printf("Disconnected %s from service %s: %s", c.addr, svc.name, c.reason)
+			ws.close(c.code, c.reason)
+			return
+		case <-readErrCh:
+			return
+		}
+		if err != nil {
+			log.Printf("Disconnected %s from service %s: %s", c.addr, svc.name, err)
+			return
+		}
+	}
+}
+
+// subscribe adds a client, the current nodes are queued as first message.
+func (s *service) subscribe(addr string, bufferSize int) (*client, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, errors.New("Service stopped")
+	}
+	u, err := newUpdate(s.name, MessageFull, s.seq, s.nodes)
+	if err != nil {
+		return nil, err
+	}
+	c := &client{
+		addr:   addr,
+		msgCh:  make(chan *update, bufferSize),
+		doneCh: make(chan struct{}),
+	}
+	c.msgCh <- u
+	s.clients[c] = struct{}{}
+	return c, nil
+}
+
+// unsubscribe removes a client.
+func (s *service) unsubscribe(c *client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.clients, c)
+}
+
+// disconnect removes a client and signals it to stop. Needs to hold the mutex.
+func (s *service) disconnect(c *client, code uint16, reason string) {
+	if _, found := s.clients[c]; !found {
+		return
+	}
+	delete(s.clients, c)
+	c.code = code
+	c.reason = reason
+	close(c.doneCh)
+}
+
+// update sets the nodes and queues the changes for all clients.
+// Clients with a full queue are disconnected.
+func (s *service) update(nodes []Node, changed []Node) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.seq++
+	s.nodes = nodes
+	u, err := newUpdate(s.name, MessageInc, s.seq, changed)
+	if err != nil {
+		log.Printf("Could not encode update of service %s: %s", s.name, err)
+		return
+	}
+	for c := range s.clients {
+		select {
+		case c.msgCh <- u:
+		default:
+			s.disconnect(c, ClosePolicyViolation, "Client too slow")
+		}
+	}
+}
+
+// close disconnects all clients, new clients are rejected afterwards.
+func (s *service) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	for c := range s.clients {
+		s.disconnect(c, CloseGoingAway, "Service stopped")
+	}
+}
+
+func newUpdate(service string, msgType string, seq uint64, nodes []Node) (*update, error) {
+	data, err := json.Marshal(Message{
+		Type:    msgType,
+		Service: service,
+		Seq:     seq,
+		Nodes:   nodes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &update{
+		msgType: msgType,
+		seq:     seq,
+		data:    data,
+	}, nil
+}
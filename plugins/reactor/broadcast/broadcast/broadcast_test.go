@@ -0,0 +1,268 @@
+package broadcast
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitServer waits until the server is running and returns its address.
+func waitServer(t *testing.T, react *BroadcastReactor) string {
+	for i := 0; i < 500; i++ {
+		if addr := react.Addr(); addr != nil {
+			return addr.String()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Server not started")
+	return ""
+}
+
+// readEvent reads the next server-sent event, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) (string, Message) {
+	var event string
+	var msg Message
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Could not read event: %s", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return event, msg
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &msg); err != nil {
+				t.Fatalf("Invalid data %q: %s", line, err)
+			}
+		}
+	}
+}
+
+// dialWebSocket connects to the websocket of the service.
+func dialWebSocket(t *testing.T, addr string, path string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	_, err = conn.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: " + addr + "\r\n" +
+		"Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		t.Fatalf("Handshake failed: %s %v", resp.Status, resp.Header)
+	}
+	return conn, reader
+}
+
+// readWebSocket reads the next frame, skipping pings.
+func readWebSocket(t *testing.T, r *bufio.Reader) *frame {
+	for {
+		f, err := readFrame(r, 1<<20)
+		if err != nil {
+			t.Fatalf("Could not read frame: %s", err)
+		}
+		if f.masked {
+			t.Fatal("Server frames must not be masked")
+		}
+		if f.opcode != opPing {
+			return f
+		}
+	}
+}
+
+func readWebSocketMessage(t *testing.T, r *bufio.Reader) Message {
+	f := readWebSocket(t, r)
+	if f.opcode != opText {
+		t.Fatalf("Expected text frame, got opcode %d", f.opcode)
+	}
+	var msg Message
+	if err := json.Unmarshal(f.payload, &msg); err != nil {
+		t.Fatalf("Invalid message %q: %s", f.payload, err)
+	}
+	return msg
+}
+
+func TestFunc(t *testing.T) {
+	react := &BroadcastReactor{}
+	err := react.Setup(json.RawMessage(`{"listen":"127.0.0.1:0","heartbeat":"20ms","origins":["http://dashboard"]}`))
+	if err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	web, webCh := plugintest.StartReactor(t, react, `{"service":"web"}`)
+	if _, err := react.Accept(json.RawMessage(`{"service":"web"}`)); err == nil {
+		t.Error("Expected service to be used only once")
+	}
+	addr := waitServer(t, react)
+	webCh <- pipe.NewEventWithNode("web1", pipe.NodeUp, "10.0.0.1", 80)
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get("http://" + addr + "/service/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected unknown service to respond 404, got %d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest("GET", "http://"+addr+"/service/web", nil)
+	req.Header.Set("Origin", "http://evil")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected unknown origin to respond 403, got %d", resp.StatusCode)
+	}
+
+	// Server-sent events
+	var msg Message
+	for i := 0; i < 500 && len(msg.Nodes) == 0; i++ {
+		req, _ = http.NewRequest("GET", "http://"+addr+"/service/web", nil)
+		req.Header.Set("Origin", "http://dashboard")
+		resp, err = client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Header.Get("Content-Type") != "text/event-stream" || resp.Header.Get("Access-Control-Allow-Origin") != "http://dashboard" {
+			t.Fatalf("Unexpected headers: %v", resp.Header)
+		}
+		var event string
+		event, msg = readEvent(t, bufio.NewReader(resp.Body))
+		if event != MessageFull || msg.Type != MessageFull || msg.Service != "web" {
+			t.Fatalf("Expected full message, got %s %v", event, msg)
+		}
+		if len(msg.Nodes) == 0 {
+			resp.Body.Close()
+			time.Sleep(10 * time.Millisecond) // Event not yet processed
+		}
+	}
+	defer resp.Body.Close()
+	sseReader := bufio.NewReader(resp.Body)
+	if !reflect.DeepEqual(msg.Nodes, []Node{{Name: "web1", Status: "up", Host: "10.0.0.1", Port: 80}}) {
+		t.Fatalf("Unexpected nodes: %v", msg.Nodes)
+	}
+	fullSeq := msg.Seq
+
+	// Websocket
+	conn, wsReader := dialWebSocket(t, addr, "/service/web")
+	defer conn.Close()
+	msg = readWebSocketMessage(t, wsReader)
+	if msg.Type != MessageFull || msg.Seq != fullSeq || len(msg.Nodes) != 1 {
+		t.Fatalf("Expected full message, got %v", msg)
+	}
+	// Pings are answered
+	if err := writeFrame(conn, &frame{fin: true, opcode: opPing, masked: true, payload: []byte("hi")}); err != nil {
+		t.Fatal(err)
+	}
+	if f := readWebSocket(t, wsReader); f.opcode != opPong || string(f.payload) != "hi" {
+		t.Fatalf("Expected pong, got opcode %d %q", f.opcode, f.payload)
+	}
+
+	webCh <- pipe.NewEventWithNode("web1", pipe.NodeDown, "10.0.0.1", 80)
+	expected := []Node{{Name: "web1", Status: "down", Host: "10.0.0.1", Port: 80}}
+	event, msg := readEvent(t, sseReader)
+	if event != MessageInc || msg.Seq != fullSeq+1 || !reflect.DeepEqual(msg.Nodes, expected) {
+		t.Fatalf("Expected inc message, got %s %v", event, msg)
+	}
+	msg = readWebSocketMessage(t, wsReader)
+	if msg.Type != MessageInc || msg.Seq != fullSeq+1 || !reflect.DeepEqual(msg.Nodes, expected) {
+		t.Fatalf("Expected inc message, got %v", msg)
+	}
+
+	plugintest.Stop(t, web)
+	f := readWebSocket(t, wsReader)
+	if f.opcode != opClose || len(f.payload) < 2 || binary.BigEndian.Uint16(f.payload) != CloseGoingAway {
+		t.Errorf("Expected close frame going away, got opcode %d %q", f.opcode, f.payload)
+	}
+	if react.Addr() != nil {
+		t.Error("Expected server to be stopped")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	svc := &service{
+		name:    "web",
+		nodes:   []Node{},
+		clients: make(map[*client]struct{}),
+	}
+	slow, err := svc.subscribe("slow", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast, err := svc.subscribe("fast", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-fast.msgCh
+	svc.update([]Node{}, []Node{{Name: "web1", Status: "down"}})
+	<-fast.msgCh
+	svc.update([]Node{}, []Node{{Name: "web2", Status: "down"}})
+
+	select {
+	case <-slow.doneCh:
+		if slow.code != ClosePolicyViolation {
+			t.Errorf("Expected policy violation, got %d", slow.code)
+		}
+	default:
+		t.Fatal("Expected slow client to be disconnected")
+	}
+	select {
+	case <-fast.doneCh:
+		t.Fatal("Expected fast client to stay connected")
+	default:
+	}
+
+	svc.close()
+	select {
+	case <-fast.doneCh:
+	default:
+		t.Error("Expected client to be disconnected on close")
+	}
+	if _, err := svc.subscribe("late", 2); err == nil {
+		t.Error("Expected subscribe to fail after close")
+	}
+}
+
+func TestFrame(t *testing.T) {
+	if key := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); key != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Unexpected accept key %s", key) // Example of RFC6455
+	}
+	for _, size := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		for _, masked := range []bool{false, true} {
+			var buf strings.Builder
+			payload := []byte(strings.Repeat("x", size))
+			if err := writeFrame(&buf, &frame{fin: true, opcode: opText, masked: masked, payload: payload}); err != nil {
+				t.Fatal(err)
+			}
+			f, err := readFrame(strings.NewReader(buf.String()), 1<<20)
+			if err != nil {
+				t.Fatalf("Size %d: %s", size, err)
+			}
+			if !f.fin || f.opcode != opText || f.masked != masked || string(f.payload) != string(payload) {
+				t.Errorf("Size %d masked %t: Frame changed", size, masked)
+			}
+		}
+	}
+}
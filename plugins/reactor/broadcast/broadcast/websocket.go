@@ -0,0 +1,268 @@
+package broadcast
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal server side implementation of the WebSocket protocol (RFC6455).
+// Clients only receive messages, messages sent by clients are discarded.
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// MaxFrameSize is the maximum payload size of frames sent by clients.
+const MaxFrameSize = 64 * 1024
+
+// Opcodes
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Status codes of close frames
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001 // Service stopped
+	CloseProtocolError   = 1002
+	ClosePolicyViolation = 1008 // Client too slow
+	CloseTooBig          = 1009
+)
+
+var errFrameTooLarge = errors.New("Frame too large")
+
+// frame is a single websocket frame.
+type frame struct {
+	fin     bool
+	opcode  byte
+	masked  bool
+	payload []byte
+}
+
+// acceptKey computes the Sec-WebSocket-Accept header of the handshake.
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContains checks if the comma separated header contains the token.
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isWebSocket checks if the request asks to upgrade to websocket.
+func isWebSocket(req *http.Request) bool {
+	return headerContains(req.Header, "Connection", "upgrade") && headerContains(req.Header, "Upgrade", "websocket")
+}
+
+// upgrade completes the handshake and takes over the connection.
+// If the handshake fails an error response is sent.
+func upgrade(w http.ResponseWriter, req *http.Request) (net.Conn, *bufio.Reader, error) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, nil, errors.New("Method not allowed")
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, nil, errors.New("Unsupported websocket version")
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if b, err := base64.StdEncoding.DecodeString(key); err != nil || len(b) != 16 {
+		http.Error(w, "Invalid websocket key", http.StatusBadRequest)
+		return nil, nil, errors.New("Invalid websocket key")
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "Websocket not supported", http.StatusInternalServerError)
+		return nil, nil, err
+	}
+	_, err = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"))
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, brw.Reader, nil
+}
+
+// readFrame reads a frame, masked payloads are unmasked.
+func readFrame(r io.Reader, maxSize uint64) (*frame, error) {
+	var header [2]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+	f := &frame{
+		fin:    header[0]&0x80 != 0,
+		opcode: header[0] & 0x0F,
+		masked: header[1]&0x80 != 0,
+	}
+	size := uint64(header[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if size > maxSize {
+		return nil, errFrameTooLarge
+	}
+	var mask [4]byte
+	if f.masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return nil, err
+		}
+	}
+	f.payload = make([]byte, size)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+	if f.masked {
+		for i := range f.payload {
+			f.payload[i] ^= mask[i%4]
+		}
+	}
+	return f, nil
+}
+
+// writeFrame writes a final frame, the payload is masked if the frame is masked.
+func writeFrame(w io.Writer, f *frame) error {
+	buf := make([]byte, 0, 14+len(f.payload))
+	first := f.opcode
+	if f.fin {
+		first |= 0x80
+	}
+	buf = append(buf, first)
+	var maskBit byte
+	if f.masked {
+		maskBit = 0x80
+	}
+	size := len(f.payload)
+	switch {
+	case size < 126:
+		buf = append(buf, maskBit|byte(size))
+	case size <= 0xFFFF:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(size))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(size))
+	}
+	if f.masked {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		buf = append(buf, mask[:]...)
+		for i, b := range f.payload {
+			buf = append(buf, b^mask[i%4])
+		}
+	} else {
+		buf = append(buf, f.payload...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// closePayload creates the payload of a close frame.
+func closePayload(code uint16, reason string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, code)
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	return append(b, reason...)
+}
+
+// wsConn is the server side of a websocket connection.
+type wsConn struct {
+	conn         net.Conn
+	reader       *bufio.Reader
+	writeTimeout time.Duration
+	mutex        sync.Mutex // Serializes writes
+}
+
+// write sends a single frame, failing if it can't be sent within the write timeout.
+func (c *wsConn) write(opcode byte, payload []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	return writeFrame(c.conn, &frame{fin: true, opcode: opcode, payload: payload})
+}
+
+// close sends a close frame, the connection needs to be closed afterwards.
+func (c *wsConn) close(code uint16, reason string) error {
+	return c.write(opClose, closePayload(code, reason))
+}
+
+// readLoop answers pings and discards messages until the connection is closed or fails.
+func (c *wsConn) readLoop() error {
+	for {
+		f, err := readFrame(c.reader, MaxFrameSize)
+		if err == errFrameTooLarge {
+			c.close(CloseTooBig, "Frame too large")
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if !f.masked {
+			c.close(CloseProtocolError, "Frame not masked")
+			return errors.New("Frame not masked")
+		}
+		if f.opcode >= opClose && (!f.fin || len(f.payload) > 125) {
+			c.close(CloseProtocolError, "Invalid control frame")
+			return errors.New("Invalid control frame")
+		}
+		switch f.opcode {
+		case opPing:
+			err = c.write(opPong, f.payload)
+			if err != nil {
+				return err
+			}
+		case opClose:
+			// Echo the status code
+			if len(f.payload) >= 2 {
+				c.write(opClose, f.payload[:2])
+			} else {
+				c.write(opClose, nil)
+			}
+			return io.EOF
+		case opPong, opContinuation, opText, opBinary:
+		default:
+			c.close(CloseProtocolError, "Unknown opcode")
+			return errors.New("Unknown opcode")
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package dnsserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Record types and classes
+const (
+	TypeA    uint16 = 1
+	TypeNS   uint16 = 2
+	TypeSOA  uint16 = 6
+	TypeAAAA uint16 = 28
+	TypeSRV  uint16 = 33
+	TypeOPT  uint16 = 41
+	TypeANY  uint16 = 255
+
+	ClassINET uint16 = 1
+	ClassANY  uint16 = 255
+)
+
+// Response codes
+const (
+	RcodeSuccess        = 0
+	RcodeFormatError    = 1
+	RcodeServerFailure  = 2
+	RcodeNameError      = 3
+	RcodeNotImplemented = 4
+	RcodeRefused        = 5
+)
+
+// Header flags
+const (
+	flagResponse      uint16 = 1 << 15
+	flagAuthoritative uint16 = 1 << 10
+	flagTruncated     uint16 = 1 << 9
+	flagRecursion     uint16 = 1 << 8 // Recursion desired
+	opcodeMask        uint16 = 0xf << 11
+)
+
+var (
+	errShortMessage = errors.New("Message too short")
+	errInvalidName  = errors.New("Invalid name")
+)
+
+// Header is the header of a DNS message.
+type Header struct {
+	ID      uint16
+	Flags   uint16
+	QDCount uint16
+	ANCount uint16
+	NSCount uint16
+	ARCount uint16
+}
+
+// Question is a single question of a query.
+type Question struct {
+	Name  string // Fully qualified with trailing dot, case as sent for 0x20 randomization
+	Lower string // Lowercase name used for lookups
+	Type  uint16
+	Class uint16
+}
+
+// RR is a resource record, Data is the encoded rdata.
+type RR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// Query is a parsed query message.
+type Query struct {
+	Header   Header
+	Question Question
+	EDNS     bool   // Query contains an OPT record
+	UDPSize  uint16 // Maximum udp payload size advertised by EDNS
+}
+
+// ParseQuery parses a query with exactly one question.
+func ParseQuery(b []byte) (*Query, error) {
+	if len(b) < 12 {
+		return nil, errShortMessage
+	}
+	q := &Query{
+		Header: Header{
+			ID:      binary.BigEndian.Uint16(b[0:]),
+			Flags:   binary.BigEndian.Uint16(b[2:]),
+			QDCount: binary.BigEndian.Uint16(b[4:]),
+			ANCount: binary.BigEndian.Uint16(b[6:]),
+			NSCount: binary.BigEndian.Uint16(b[8:]),
+			ARCount: binary.BigEndian.Uint16(b[10:]),
+		},
+	}
+	if q.Header.QDCount != 1 {
+		return q, errors.New("Expected exactly one question")
+	}
+	name, off, err := readName(b, 12)
+	if err != nil {
+		return q, err
+	}
+	if off+4 > len(b) {
+		return q, errShortMessage
+	}
+	q.Question = Question{
+		Name:  name,
+		Lower: strings.ToLower(name),
+		Type:  binary.BigEndian.Uint16(b[off:]),
+		Class: binary.BigEndian.Uint16(b[off+2:]),
+	}
+	off += 4
+
+	// Skip answer and authority records, look for OPT in additional records
+	for i := 0; i < int(q.Header.ANCount)+int(q.Header.NSCount)+int(q.Header.ARCount); i++ {
+		_, off, err = readName(b, off)
+		if err != nil {
+			return q, err
+		}
+		if off+10 > len(b) {
+			return q, errShortMessage
+		}
+		rrType := binary.BigEndian.Uint16(b[off:])
+		class := binary.BigEndian.Uint16(b[off+2:])
+		length := int(binary.BigEndian.Uint16(b[off+8:]))
+		off += 10 + length
+		if off > len(b) {
+			return q, errShortMessage
+		}
+		if rrType == TypeOPT {
+			q.EDNS = true
+			q.UDPSize = class
+		}
+	}
+	return q, nil
+}
+
+// readName reads a possibly compressed name at off, returns the name and the offset after it.
+func readName(b []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(b) {
+			return "", 0, errShortMessage
+		}
+		length := int(b[off])
+		switch {
+		case length == 0:
+			off++
+			if end < 0 {
+				end = off
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case length&0xc0 == 0xc0: // Compression pointer
+			if off+1 >= len(b) {
+				return "", 0, errShortMessage
+			}
+			if jumps++; jumps > 10 {
+				return "", 0, errInvalidName
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+		case length&0xc0 != 0:
+			return "", 0, errInvalidName
+		default:
+			if off+1+length > len(b) {
+				return "", 0, errShortMessage
+			}
+			labels = append(labels, string(b[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
+
+// appendName appends the uncompressed wire format of a fully qualified name.
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendRR(b []byte, rr RR) []byte {
+	b = appendName(b, rr.Name)
+	b = appendUint16(b, rr.Type)
+	b = appendUint16(b, rr.Class)
+	b = appendUint32(b, rr.TTL)
+	b = appendUint16(b, uint16(len(rr.Data)))
+	return append(b, rr.Data...)
+}
+
+// Response is a response message to a query.
+type Response struct {
+	Rcode      int
+	Answer     []RR
+	Authority  []RR
+	Additional []RR
+}
+
+// Pack encodes the response to the query.
+// If the message exceeds maxSize, records are dropped and the truncated flag is set.
+func (r *Response) Pack(q *Query, maxSize int) []byte {
+	flags := flagResponse | flagAuthoritative | q.Header.Flags&(opcodeMask|flagRecursion) | uint16(r.Rcode&0xf)
+	sections := [][]RR{r.Answer, r.Authority, r.Additional}
+	if q.EDNS {
+		sections[2] = append(append([]RR{}, r.Additional...), RR{Name: ".", Type: TypeOPT, Class: 4096})
+	}
+	for {
+		b := make([]byte, 12, 512)
+		binary.BigEndian.PutUint16(b[0:], q.Header.ID)
+		binary.BigEndian.PutUint16(b[2:], flags)
+		if q.Question.Name != "" {
+			binary.BigEndian.PutUint16(b[4:], 1)
+		}
+		binary.BigEndian.PutUint16(b[6:], uint16(len(sections[0])))
+		binary.BigEndian.PutUint16(b[8:], uint16(len(sections[1])))
+		binary.BigEndian.PutUint16(b[10:], uint16(len(sections[2])))
+		if q.Question.Name != "" {
+			b = appendName(b, q.Question.Name)
+			b = appendUint16(b, q.Question.Type)
+			b = appendUint16(b, q.Question.Class)
+		}
+		for _, section := range sections {
+			for _, rr := range section {
+				b = appendRR(b, rr)
+			}
+		}
+		if len(b) <= maxSize || len(sections[0])+len(sections[1])+len(sections[2]) == 0 {
+			return b
+		}
+		// Drop additional records first, then truncate
+		if len(sections[2]) > 0 {
+			sections[2] = nil
+			continue
+		}
+		flags |= flagTruncated
+		sections = [][]RR{nil, nil, nil}
+	}
+}
+
+// A creates an A or AAAA record, ok is false if ip is no ip address.
+func A(name string, ttl uint32, ip string) (RR, bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return RR{}, false
+	}
+	if ip4 := parsed.To4(); ip4 != nil {
+		return RR{Name: name, Type: TypeA, Class: ClassINET, TTL: ttl, Data: []byte(ip4)}, true
+	}
+	return RR{Name: name, Type: TypeAAAA, Class: ClassINET, TTL: ttl, Data: []byte(parsed.To16())}, true
+}
+
+// SRV creates a SRV record.
+func SRV(name string, ttl uint32, priority uint16, weight uint16, port uint16, target string) RR {
+	data := appendUint16(nil, priority)
+	data = appendUint16(data, weight)
+	data = appendUint16(data, port)
+	data = appendName(data, target)
+	return RR{Name: name, Type: TypeSRV, Class: ClassINET, TTL: ttl, Data: data}
+}
+
+// SOA creates a SOA record.
+func SOA(zone string, ttl uint32, mname string, rname string, serial uint32, minimum uint32) RR {
+	data := appendName(nil, mname)
+	data = appendName(data, rname)
+	data = appendUint32(data, serial)
+	data = appendUint32(data, 3600)  // Refresh
+	data = appendUint32(data, 600)   // Retry
+	data = appendUint32(data, 86400) // Expire
+	data = appendUint32(data, minimum)
+	return RR{Name: zone, Type: TypeSOA, Class: ClassINET, TTL: ttl, Data: data}
+}
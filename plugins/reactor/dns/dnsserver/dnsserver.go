@@ -0,0 +1,407 @@
+package dnsserver
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/sharedserver"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSReactor serves the nodes of all services on a shared authoritative dns server.
+// The server is started with the first running endpoint and stopped after the last one closed.
+type DNSReactor struct {
+	mutex    sync.Mutex
+	listen   string
+	zone     string
+	ttl      uint32
+	services map[string]*service // Running services by label
+	accepted map[string]struct{} // Service labels in use
+	serial   uint32              // Incremented on every change
+	server   sharedserver.Server
+}
+
+type Config struct {
+	Listen string `json:"listen"`
+	Zone   string `json:"zone"`
+	TTL    string `json:"ttl"`
+}
+
+type ServiceConfig struct {
+	Service     string `json:"service"`     // Name of the service in the zone
+	TTL         string `json:"ttl"`         // Overrides global ttl
+	WeightKey   string `json:"weightKey"`   // Metadata key of the srv weight
+	PriorityKey string `json:"priorityKey"` // Metadata key of the srv priority
+}
+
+// service holds the nodes of a single service.
+type service struct {
+	label       string
+	ttl         uint32
+	weightKey   string
+	priorityKey string
+	nodes       []pipe.NodeInfo // Nodes up sorted by name
+	next        uint32          // Start of the next round robin answer
+}
+
+func (r *DNSReactor) Setup(cfgData json.RawMessage) error {
+	conf := Config{
+		Listen: "127.0.0.1:5353",
+		Zone:   "receptor.local.",
+		TTL:    "5s",
+	}
+	err := json.Unmarshal(cfgData, &conf)
+	if err != nil {
+		return err
+	}
+	ttl, err := time.ParseDuration(conf.TTL)
+	if err != nil {
+		return fmt.Errorf("Invalid ttl: %s", err)
+	}
+	if conf.Zone == "" {
+		return errors.New("No zone configured")
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.init()
+	r.listen = conf.Listen
+	r.zone = fqdn(conf.Zone)
+	r.ttl = uint32(ttl / time.Second)
+	return nil
+}
+
+// init sets defaults, the reactor may be used without global config. Needs to hold the mutex.
+func (r *DNSReactor) init() {
+	if r.services != nil {
+		return
+	}
+	r.listen = "127.0.0.1:5353"
+	r.zone = "receptor.local."
+	r.ttl = 5
+	r.services = make(map[string]*service)
+	r.accepted = make(map[string]struct{})
+}
+
+func (r *DNSReactor) Accept(cfgData json.RawMessage) (pipe.Endpoint, error) {
+	cfg := ServiceConfig{
+		WeightKey:   "weight",
+		PriorityKey: "priority",
+	}
+	err := json.Unmarshal(cfgData, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	label := Label(cfg.Service)
+	if label == "" || strings.HasPrefix(label, "_") {
+		return nil, fmt.Errorf("Invalid service name %q", cfg.Service)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.init()
+	ttl := r.ttl
+	if cfg.TTL != "" {
+		d, err := time.ParseDuration(cfg.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ttl: %s", err)
+		}
+		ttl = uint32(d / time.Second)
+	}
+	if _, found := r.accepted[label]; found {
+		return nil, fmt.Errorf("Service %q already in use", label)
+	}
+	r.accepted[label] = struct{}{}
+
+	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
+		svc := &service{
+			label:       label,
+			ttl:         ttl,
+			weightKey:   cfg.WeightKey,
+			priorityKey: cfg.PriorityKey,
+		}
+		err := r.register(svc)
+		if err != nil {
+			log.Printf("Could not start dns server: %s", err)
+			return
+		}
+		defer r.unregister(label)
+
+		book := pipe.NewBook()
+		for {
+			select {
+			case ev, ok := <-eventCh:
+				if !ok {
+					return
+				}
+				if book.UpdateInc(ev) == nil {
+					continue
+				}
+				var nodes []pipe.NodeInfo
+				for _, node := range book.Full() {
+					nodes = append(nodes, node)
+				}
+				sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+				r.mutex.Lock()
+				svc.nodes = nodes
+				r.serial++
+				r.mutex.Unlock()
+			case <-closeCh:
+				return
+			}
+		}
+	}), nil
+}
+
+// Addr returns the address the server listens on or nil if not running.
+func (r *DNSReactor) Addr() net.Addr {
+	return r.server.Addr()
+}
+
+// register adds the service and starts the servers if needed.
+func (r *DNSReactor) register(svc *service) error {
+	r.mutex.Lock()
+	r.services[svc.label] = svc
+	r.serial++
+	listen := r.listen
+	r.mutex.Unlock()
+	err := r.server.Acquire(func() (net.Addr, func(), error) {
+		udpConn, err := net.ListenPacket("udp", listen)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Use the same port for tcp if a random port was requested
+		tcpLn, err := net.Listen("tcp", udpConn.LocalAddr().String())
+		if err != nil {
+			udpConn.Close()
+			return nil, nil, err
+		}
+		udpDoneCh := make(chan struct{})
+		go func() {
+			defer close(udpDoneCh)
+			r.serveUDP(udpConn)
+		}()
+		stopTCP := sharedserver.ServeConns(tcpLn, r.handleTCP)
+		return udpConn.LocalAddr(), func() {
+			udpConn.Close()
+			<-udpDoneCh
+			stopTCP()
+		}, nil
+	})
+	if err != nil {
+		r.remove(svc.label)
+	}
+	return err
+}
+
+// unregister removes the service and stops the servers if it was the last one.
+func (r *DNSReactor) unregister(label string) {
+	r.remove(label)
+	r.server.Release()
+}
+
+// remove removes the service and releases its label.
+func (r *DNSReactor) remove(label string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.services, label)
+	delete(r.accepted, label)
+	r.serial++
+}
+
+func (r *DNSReactor) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return // Closed
+		}
+		q, err := ParseQuery(buf[:n])
+		if err != nil && q == nil {
+			continue // Not even a header
+		}
+		maxSize := 512
+		if q.EDNS && q.UDPSize > 512 {
+			maxSize = int(q.UDPSize)
+		}
+		conn.WriteTo(r.answer(q, err).Pack(q, maxSize), addr)
+	}
+}
+
+// handleTCP answers length-prefixed queries until the client closes the connection or is idle.
+func (r *DNSReactor) handleTCP(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		var length uint16
+		err := binary.Read(conn, binary.BigEndian, &length)
+		if err != nil {
+			return
+		}
+		buf := make([]byte, length)
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			return
+		}
+		q, err := ParseQuery(buf)
+		if err != nil && q == nil {
+			return
+		}
+		resp := r.answer(q, err).Pack(q, 65535)
+		_, err = conn.Write(append(appendUint16(nil, uint16(len(resp))), resp...))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// answer creates the response to a query, parseErr is the error of parsing the query.
+func (r *DNSReactor) answer(q *Query, parseErr error) *Response {
+	if parseErr != nil {
+		return &Response{Rcode: RcodeFormatError}
+	}
+	if q.Header.Flags&opcodeMask != 0 {
+		return &Response{Rcode: RcodeNotImplemented}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	name := q.Question.Lower
+	if q.Question.Class != ClassINET && q.Question.Class != ClassANY {
+		return &Response{Rcode: RcodeRefused}
+	}
+	if name != r.zone && !strings.HasSuffix(name, "."+r.zone) {
+		return &Response{Rcode: RcodeRefused} // Not authoritative
+	}
+	soa := SOA(r.zone, r.ttl, "ns."+r.zone, "hostmaster."+r.zone, r.serial, r.ttl)
+	nxdomain := &Response{Rcode: RcodeNameError, Authority: []RR{soa}}
+
+	var labels []string
+	if name != r.zone {
+		labels = strings.Split(strings.TrimSuffix(name, "."+r.zone), ".")
+	}
+	resp := &Response{}
+	switch len(labels) {
+	case 0: // Zone apex
+		if q.Question.Type == TypeSOA || q.Question.Type == TypeANY {
+			resp.Answer = []RR{soa}
+		}
+	case 1: // <service>
+		svc, found := r.services[labels[0]]
+		if !found {
+			return nxdomain
+		}
+		resp.Answer, resp.Additional = svc.records(name, r.zone, q.Question.Type)
+	case 2:
+		if labels[1] == "_tcp" || labels[1] == "_udp" { // _<service>._tcp
+			svc, found := r.services[strings.TrimPrefix(labels[0], "_")]
+			if !found || !strings.HasPrefix(labels[0], "_") {
+				return nxdomain
+			}
+			if q.Question.Type == TypeSRV || q.Question.Type == TypeANY {
+				resp.Answer, resp.Additional = svc.records(name, r.zone, TypeSRV)
+			}
+			break
+		}
+		svc, found := r.services[labels[1]] // <node>.<service>
+		if !found {
+			return nxdomain
+		}
+		node, found := svc.node(labels[0])
+		if !found {
+			return nxdomain
+		}
+		if rr, ok := A(name, svc.ttl, node.Host); ok && (q.Question.Type == rr.Type || q.Question.Type == TypeANY) {
+			resp.Answer = []RR{rr}
+		}
+	default:
+		return nxdomain
+	}
+	if len(resp.Answer) == 0 {
+		resp.Authority = []RR{soa} // No data of this type
+	}
+	return resp
+}
+
+// records returns the address or srv records of all nodes in round robin order
+// and the addresses of srv targets as additional records. Needs to hold the mutex of the reactor.
+func (s *service) records(name string, zone string, qtype uint16) ([]RR, []RR) {
+	nodes := s.rotate()
+	var answer, additional []RR
+	for _, node := range nodes {
+		addr, isAddr := A(name, s.ttl, node.Host)
+		target := Label(node.Name) + "." + s.label + "." + zone
+		if !isAddr {
+			// No address records of the node, point to the host itself
+			target = strings.TrimSuffix(node.Host, ".") + "."
+		}
+		if isAddr && (qtype == addr.Type || qtype == TypeANY) {
+			answer = append(answer, addr)
+		}
+		if qtype == TypeSRV || qtype == TypeANY {
+			answer = append(answer, SRV(name, s.ttl, metaUint16(node, s.priorityKey, 0), metaUint16(node, s.weightKey, 1), node.Port, target))
+			if isAddr {
+				addr.Name = target
+				additional = append(additional, addr)
+			}
+		}
+	}
+	return answer, additional
+}
+
+// rotate returns the nodes starting at the next position.
+func (s *service) rotate() []pipe.NodeInfo {
+	if len(s.nodes) == 0 {
+		return nil
+	}
+	start := int(s.next % uint32(len(s.nodes)))
+	s.next++
+	return append(append([]pipe.NodeInfo{}, s.nodes[start:]...), s.nodes[:start]...)
+}
+
+// node returns the node with the label.
+func (s *service) node(label string) (pipe.NodeInfo, bool) {
+	for _, node := range s.nodes {
+		if Label(node.Name) == label {
+			return node, true
+		}
+	}
+	return pipe.NodeInfo{}, false
+}
+
+func metaUint16(node pipe.NodeInfo, key string, def uint16) uint16 {
+	if v, err := strconv.ParseUint(node.Meta[key], 10, 16); err == nil {
+		return uint16(v)
+	}
+	return def
+}
+
+// Label converts a name to a lowercase dns label, invalid characters are replaced by '-'.
+func Label(name string) string {
+	b := []byte(strings.ToLower(name))
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			b[i] = '-'
+		}
+	}
+	if len(b) > 63 {
+		b = b[:63]
+	}
+	return string(b)
+}
+
+func fqdn(name string) string {
+	name = strings.ToLower(strings.Trim(name, "."))
+	if name == "" {
+		return "."
+	}
+	return name + "."
+}
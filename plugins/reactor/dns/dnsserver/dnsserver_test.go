@@ -0,0 +1,291 @@
+package dnsserver
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// query creates a query message.
+func query(id uint16, name string, qtype uint16) []byte {
+	b := appendUint16(nil, id)
+	b = appendUint16(b, uint16(flagRecursion))
+	b = append(b, 0, 1, 0, 0, 0, 0, 0, 0)
+	b = appendName(b, name)
+	b = appendUint16(b, qtype)
+	return appendUint16(b, ClassINET)
+}
+
+type response struct {
+	question   string
+	id         uint16
+	flags      uint16
+	rcode      int
+	answer     []RR
+	authority  []RR
+	additional []RR
+}
+
+// parseResponse decodes a response message.
+func parseResponse(t *testing.T, b []byte) *response {
+	if len(b) < 12 {
+		t.Fatalf("Response too short: %v", b)
+	}
+	r := &response{
+		id:    binary.BigEndian.Uint16(b[0:]),
+		flags: binary.BigEndian.Uint16(b[2:]),
+	}
+	r.rcode = int(r.flags & 0xf)
+	counts := []int{int(binary.BigEndian.Uint16(b[6:])), int(binary.BigEndian.Uint16(b[8:])), int(binary.BigEndian.Uint16(b[10:]))}
+	off := 12
+	if binary.BigEndian.Uint16(b[4:]) == 1 {
+		name, end, err := readName(b, off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.question = name
+		off = end + 4
+	}
+	sections := []*[]RR{&r.answer, &r.authority, &r.additional}
+	for i, count := range counts {
+		for j := 0; j < count; j++ {
+			name, end, err := readName(b, off)
+			if err != nil {
+				t.Fatal(err)
+			}
+			length := int(binary.BigEndian.Uint16(b[end+8:]))
+			*sections[i] = append(*sections[i], RR{
+				Name:  name,
+				Type:  binary.BigEndian.Uint16(b[end:]),
+				Class: binary.BigEndian.Uint16(b[end+2:]),
+				TTL:   binary.BigEndian.Uint32(b[end+4:]),
+				Data:  b[end+10 : end+10+length],
+			})
+			off = end + 10 + length
+		}
+	}
+	return r
+}
+
+func exchangeUDP(t *testing.T, addr string, q []byte) *response {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(q); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parseResponse(t, buf[:n])
+}
+
+func exchangeTCP(t *testing.T, addr string, q []byte) *response {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(append(appendUint16(nil, uint16(len(q))), q...)); err != nil {
+		t.Fatal(err)
+	}
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	return parseResponse(t, buf)
+}
+
+func TestFunc(t *testing.T) {
+	react := &DNSReactor{}
+	if err := react.Setup(json.RawMessage(`{"listen":"127.0.0.1:0","zone":"Example.Test","ttl":"30s"}`)); err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	handle, err := react.Accept(json.RawMessage(`{"service":"web"}`))
+	if err != nil {
+		t.Fatalf("Does not accept config: %s", err)
+	}
+	if _, err := react.Accept(json.RawMessage(`{"service":"Web"}`)); err == nil {
+		t.Error("Expected error, service name already in use")
+	}
+	eventCh := make(chan pipe.Event)
+	manHandle := plugintest.Handle(handle, eventCh)
+
+	node := pipe.NewNodeInfo("Node_2", pipe.NodeUp, "10.0.0.2", 8080)
+	node.Meta = map[string]string{"weight": "10"}
+	ev := pipe.NewEventWithNode("Node1", pipe.NodeUp, "10.0.0.1", 8080)
+	ev.AddNode(node)
+	ev.AddNewNode("Node3", pipe.NodeUp, "fd00::3", 8080)
+	eventCh <- ev
+	eventCh <- pipe.NewEventWithNode("Node4", pipe.NodeDown, "10.0.0.4", 8080) // Sync with endpoint
+
+	var addr string
+	for i := 0; i < 500 && addr == ""; i++ {
+		if a := react.Addr(); a != nil {
+			addr = a.String()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Round robin A records
+	resp := exchangeUDP(t, addr, query(1, "WEB.example.test.", TypeA))
+	if resp.id != 1 || resp.rcode != RcodeSuccess || resp.flags&flagAuthoritative == 0 || resp.flags&flagResponse == 0 {
+		t.Fatalf("Invalid response header: %+v", resp)
+	}
+	if resp.question != "WEB.example.test." {
+		t.Errorf("Expected case of the question to be kept, got %q", resp.question)
+	}
+	if len(resp.answer) != 2 || resp.answer[0].TTL != 30 || net.IP(resp.answer[0].Data).String() != "10.0.0.1" {
+		t.Fatalf("Expected 2 A records starting with 10.0.0.1, got %+v", resp.answer)
+	}
+	resp = exchangeUDP(t, addr, query(2, "web.example.test.", TypeA))
+	if len(resp.answer) != 2 || net.IP(resp.answer[0].Data).String() != "10.0.0.2" {
+		t.Errorf("Expected rotated A records, got %+v", resp.answer)
+	}
+
+	resp = exchangeTCP(t, addr, query(3, "web.example.test.", TypeAAAA))
+	if len(resp.answer) != 1 || net.IP(resp.answer[0].Data).String() != "fd00::3" {
+		t.Errorf("Expected AAAA record, got %+v", resp.answer)
+	}
+
+	// SRV with targets and additional addresses
+	resp = exchangeTCP(t, addr, query(4, "_web._tcp.example.test.", TypeSRV))
+	if len(resp.answer) != 3 || len(resp.additional) != 3 {
+		t.Fatalf("Expected 3 SRV records with additional addresses, got %+v", resp)
+	}
+	found := false
+	for _, rr := range resp.answer {
+		target, _, err := readName(rr.Data, 6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target == "node_2.web.example.test." {
+			found = true
+			if weight, port := binary.BigEndian.Uint16(rr.Data[2:]), binary.BigEndian.Uint16(rr.Data[4:]); weight != 10 || port != 8080 {
+				t.Errorf("Expected weight 10 and port 8080, got %d, %d", weight, port)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected target of Node_2, got %+v", resp.answer)
+	}
+	resp = exchangeUDP(t, addr, query(5, "node_2.web.example.test.", TypeA))
+	if len(resp.answer) != 1 || net.IP(resp.answer[0].Data).String() != "10.0.0.2" {
+		t.Errorf("Expected A record of node, got %+v", resp.answer)
+	}
+
+	// Negative answers
+	for _, test := range []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer int
+	}{
+		{"unknown.example.test.", TypeA, RcodeNameError, 0},
+		{"web.other.test.", TypeA, RcodeRefused, 0},
+		{"web.example.test.", TypeNS, RcodeSuccess, 0},
+		{"example.test.", TypeSOA, RcodeSuccess, 1},
+	} {
+		resp = exchangeUDP(t, addr, query(6, test.name, test.qtype))
+		if resp.rcode != test.rcode || len(resp.answer) != test.answer {
+			t.Errorf("%s: Expected rcode %d with %d answers, got %+v", test.name, test.rcode, test.answer, resp)
+		}
+		if test.rcode != RcodeRefused && test.answer == 0 && (len(resp.authority) != 1 || resp.authority[0].Type != TypeSOA) {
+			t.Errorf("%s: Expected SOA in authority section, got %+v", test.name, resp.authority)
+		}
+	}
+
+	// Node down is removed
+	eventCh <- pipe.NewEventWithNode("Node1", pipe.NodeDown, "10.0.0.1", 8080)
+	eventCh <- pipe.NewEventWithNode("Node4", pipe.NodeDown, "10.0.0.4", 8080) // Sync with endpoint
+	resp = exchangeUDP(t, addr, query(7, "web.example.test.", TypeA))
+	if len(resp.answer) != 1 || net.IP(resp.answer[0].Data).String() != "10.0.0.2" {
+		t.Errorf("Expected only 10.0.0.2, got %+v", resp.answer)
+	}
+
+	// Server stops with the last service
+	plugintest.Stop(t, manHandle)
+	if react.Addr() != nil {
+		t.Error("Expected server to be stopped")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("Expected tcp server to be stopped")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	svc := &service{label: "web", ttl: 5}
+	for i := 0; i < 50; i++ {
+		svc.nodes = append(svc.nodes, pipe.NewNodeInfo(fmt.Sprintf("Node%d", i), pipe.NodeUp, fmt.Sprintf("10.0.0.%d", i), 80))
+	}
+	q, err := ParseQuery(query(1, "web.example.test.", TypeSRV))
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, additional := svc.records(q.Question.Name, "example.test.", TypeSRV)
+	r := &Response{Answer: answer, Additional: additional}
+	resp := parseResponse(t, r.Pack(q, 512))
+	if resp.flags&flagTruncated == 0 || len(resp.answer) != 0 {
+		t.Errorf("Expected truncated response, got %+v", resp)
+	}
+	resp = parseResponse(t, r.Pack(q, 65535))
+	if resp.flags&flagTruncated != 0 || len(resp.answer) != 50 || len(resp.additional) != 50 {
+		t.Errorf("Expected full response, got flags %x, %d answers", resp.flags, len(resp.answer))
+	}
+}
+
+func TestParseQueryCompression(t *testing.T) {
+	// Question name "web.example.test." with the suffix as compression pointer to an earlier label
+	b := query(1, "example.test.", TypeA)
+	b[5] = 2 // Two questions, only the first is read
+	b = append(b, 3, 'w', 'e', 'b', 0xc0, 12)
+	if _, err := ParseQuery(b); err == nil {
+		t.Error("Expected error for multiple questions")
+	}
+	name, end, err := readName(b, len(b)-6)
+	if err != nil || name != "web.example.test." || end != len(b) {
+		t.Errorf("Expected compressed name, got %q, %d: %v", name, end, err)
+	}
+	loop := []byte{0xc0, 0}
+	if _, _, err := readName(loop, 0); err == nil {
+		t.Error("Expected error for compression loop")
+	}
+}
+
+func TestHostnameTarget(t *testing.T) {
+	svc := &service{label: "web", ttl: 5, nodes: []pipe.NodeInfo{
+		pipe.NewNodeInfo("Node1", pipe.NodeUp, "10.0.0.1", 80),
+		pipe.NewNodeInfo("Node2", pipe.NodeUp, "web2.internal", 80),
+	}}
+	answer, additional := svc.records("_web._tcp.example.test.", "example.test.", TypeSRV)
+	if len(answer) != 2 || len(additional) != 1 {
+		t.Fatalf("Expected 2 SRV records and 1 address, got %+v, %+v", answer, additional)
+	}
+	var targets []string
+	for _, rr := range answer {
+		target, _, err := readName(rr.Data, 6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targets = append(targets, target)
+	}
+	if targets[0] != "node1.web.example.test." || targets[1] != "web2.internal." {
+		t.Errorf("Expected hostname as target, got %v", targets)
+	}
+}
@@ -0,0 +1,122 @@
+package xds
+
+import (
+	"encoding/json"
+)
+
+// Type urls of the served resources
+const (
+	TypeCluster               = "type.googleapis.com/envoy.config.cluster.v3.Cluster"
+	TypeClusterLoadAssignment = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+)
+
+// The following types are the JSON representations of the v3 xDS protos used by the REST API.
+// Only fields needed by receptor are defined.
+
+type DiscoveryRequest struct {
+	VersionInfo   string          `json:"version_info"`
+	Node          json.RawMessage `json:"node,omitempty"`
+	ResourceNames []string        `json:"resource_names"`
+	TypeURL       string          `json:"type_url"`
+	ResponseNonce string          `json:"response_nonce"`
+	ErrorDetail   *Status         `json:"error_detail"`
+}
+
+// UnmarshalJSON accepts proto field names as well as their lowerCamelCase JSON names.
+func (d *DiscoveryRequest) UnmarshalJSON(b []byte) error {
+	type plain DiscoveryRequest
+	err := json.Unmarshal(b, (*plain)(d))
+	if err != nil {
+		return err
+	}
+	var camel struct {
+		VersionInfo   string   `json:"versionInfo"`
+		ResourceNames []string `json:"resourceNames"`
+		TypeURL       string   `json:"typeUrl"`
+		ResponseNonce string   `json:"responseNonce"`
+		ErrorDetail   *Status  `json:"errorDetail"`
+	}
+	err = json.Unmarshal(b, &camel)
+	if err != nil {
+		return err
+	}
+	if d.VersionInfo == "" {
+		d.VersionInfo = camel.VersionInfo
+	}
+	if d.ResourceNames == nil {
+		d.ResourceNames = camel.ResourceNames
+	}
+	if d.TypeURL == "" {
+		d.TypeURL = camel.TypeURL
+	}
+	if d.ResponseNonce == "" {
+		d.ResponseNonce = camel.ResponseNonce
+	}
+	if d.ErrorDetail == nil {
+		d.ErrorDetail = camel.ErrorDetail
+	}
+	return nil
+}
+
+type Status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type DiscoveryResponse struct {
+	VersionInfo string        `json:"version_info"`
+	Resources   []interface{} `json:"resources"`
+	TypeURL     string        `json:"type_url"`
+	Nonce       string        `json:"nonce"`
+}
+
+type Cluster struct {
+	Type             string           `json:"@type"`
+	Name             string           `json:"name"`
+	ClusterType      string           `json:"type"`
+	ConnectTimeout   string           `json:"connect_timeout"`
+	LbPolicy         string           `json:"lb_policy,omitempty"`
+	EdsClusterConfig EdsClusterConfig `json:"eds_cluster_config"`
+}
+
+type EdsClusterConfig struct {
+	EdsConfig   json.RawMessage `json:"eds_config"`
+	ServiceName string          `json:"service_name"`
+}
+
+type ClusterLoadAssignment struct {
+	Type        string                `json:"@type"`
+	ClusterName string                `json:"cluster_name"`
+	Endpoints   []LocalityLbEndpoints `json:"endpoints"`
+}
+
+type LocalityLbEndpoints struct {
+	Locality    *Locality    `json:"locality,omitempty"`
+	LbEndpoints []LbEndpoint `json:"lb_endpoints"`
+	Priority    uint32       `json:"priority,omitempty"`
+}
+
+type Locality struct {
+	Region string `json:"region,omitempty"`
+	Zone   string `json:"zone,omitempty"`
+}
+
+type LbEndpoint struct {
+	Endpoint            Endpoint `json:"endpoint"`
+	HealthStatus        string   `json:"health_status"`
+	LoadBalancingWeight uint32   `json:"load_balancing_weight,omitempty"`
+}
+
+type Endpoint struct {
+	Address  Address `json:"address"`
+	Hostname string  `json:"hostname,omitempty"`
+}
+
+type Address struct {
+	SocketAddress SocketAddress `json:"socket_address"`
+}
+
+type SocketAddress struct {
+	Address   string `json:"address"`
+	PortValue uint16 `json:"port_value"`
+}
@@ -0,0 +1,431 @@
+package xds
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/sharedserver"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnvoyReactor serves clusters and endpoints of all services using the REST xDS API of Envoy.
+// The server is started with the first running endpoint and stopped after the last one closed.
+type EnvoyReactor struct {
+	mutex      sync.Mutex
+	listen     string
+	longPoll   time.Duration
+	edsConfig  json.RawMessage     // Config source of the endpoints, pointing back to receptor
+	clusters   map[string]*cluster // Running services by cluster name
+	accepted   map[string]struct{} // Cluster names in use
+	seq        uint64              // Incremented on every change
+	clusterSeq uint64              // Sequence of the last change of the cluster list
+	nonce      uint64
+	changeCh   chan struct{} // Closed and replaced on every change
+	stopCh     chan struct{} // Closed if the server is stopping
+	server     sharedserver.Server
+}
+
+type Config struct {
+	Listen       string `json:"listen"`
+	LongPoll     string `json:"longPoll"`     // Time to hold requests of current versions, 0 answers immediately
+	XDSCluster   string `json:"xdsCluster"`   // Name of the cluster pointing to receptor in the bootstrap config of envoy
+	RefreshDelay string `json:"refreshDelay"` // Polling interval of envoy
+}
+
+type ServiceConfig struct {
+	Cluster        string `json:"cluster"`
+	ConnectTimeout string `json:"connectTimeout"`
+	LbPolicy       string `json:"lbPolicy"`
+	WeightKey      string `json:"weightKey"`   // Metadata key of the endpoint weight
+	RegionKey      string `json:"regionKey"`   // Metadata key of the locality region
+	ZoneKey        string `json:"zoneKey"`     // Metadata key of the locality zone
+	PriorityKey    string `json:"priorityKey"` // Metadata key of the locality priority
+}
+
+// cluster holds the nodes of a single service.
+type cluster struct {
+	cfg   ServiceConfig
+	seq   uint64          // Sequence of the last change
+	nodes []pipe.NodeInfo // Nodes up sorted by name
+}
+
+func (r *EnvoyReactor) Setup(cfgData json.RawMessage) error {
+	conf := Config{
+		Listen:       "127.0.0.1:18000",
+		LongPoll:     "0s",
+		XDSCluster:   "receptor",
+		RefreshDelay: "1s",
+	}
+	err := json.Unmarshal(cfgData, &conf)
+	if err != nil {
+		return err
+	}
+	longPoll, err := time.ParseDuration(conf.LongPoll)
+	if err != nil {
+		return fmt.Errorf("Invalid long poll: %s", err)
+	}
+	refreshDelay, err := time.ParseDuration(conf.RefreshDelay)
+	if err != nil {
+		return fmt.Errorf("Invalid refresh delay: %s", err)
+	}
+	if conf.XDSCluster == "" {
+		return errors.New("No xds cluster configured")
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.init()
+	r.listen = conf.Listen
+	r.longPoll = longPoll
+	r.edsConfig = newEDSConfig(conf.XDSCluster, refreshDelay, longPoll)
+	return nil
+}
+
+// init sets defaults, the reactor may be used without global config. Needs to hold the mutex.
+func (r *EnvoyReactor) init() {
+	if r.clusters != nil {
+		return
+	}
+	r.listen = "127.0.0.1:18000"
+	r.edsConfig = newEDSConfig("receptor", time.Second, 0)
+	r.clusters = make(map[string]*cluster)
+	r.accepted = make(map[string]struct{})
+	r.changeCh = make(chan struct{})
+}
+
+// newEDSConfig creates the config source used by clusters to fetch their endpoints from receptor.
+func newEDSConfig(xdsCluster string, refreshDelay time.Duration, longPoll time.Duration) json.RawMessage {
+	b, _ := json.Marshal(map[string]interface{}{
+		"resource_api_version": "V3",
+		"api_config_source": map[string]interface{}{
+			"api_type":              "REST",
+			"transport_api_version": "V3",
+			"cluster_names":         []string{xdsCluster},
+			"refresh_delay":         protoDuration(refreshDelay),
+			"request_timeout":       protoDuration(longPoll + time.Second),
+		},
+	})
+	return b
+}
+
+// protoDuration formats a duration in the JSON format of protobuf.
+func protoDuration(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}
+
+func (r *EnvoyReactor) Accept(cfgData json.RawMessage) (pipe.Endpoint, error) {
+	cfg := ServiceConfig{
+		ConnectTimeout: "1s",
+		WeightKey:      "weight",
+		RegionKey:      "region",
+		ZoneKey:        "zone",
+		PriorityKey:    "priority",
+	}
+	err := json.Unmarshal(cfgData, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Cluster == "" {
+		return nil, errors.New("No cluster configured")
+	}
+	connectTimeout, err := time.ParseDuration(cfg.ConnectTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid connect timeout: %s", err)
+	}
+	cfg.ConnectTimeout = protoDuration(connectTimeout)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.init()
+	if _, found := r.accepted[cfg.Cluster]; found {
+		return nil, fmt.Errorf("Cluster %q already in use", cfg.Cluster)
+	}
+	r.accepted[cfg.Cluster] = struct{}{}
+
+	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
+		c := &cluster{
+			cfg: cfg,
+		}
+		err := r.register(c)
+		if err != nil {
+			log.Printf("Could not start xds server: %s", err)
+			return
+		}
+		defer r.unregister(cfg.Cluster)
+
+		book := pipe.NewBook()
+		for {
+			select {
+			case ev, ok := <-eventCh:
+				if !ok {
+					return
+				}
+				if book.UpdateInc(ev) == nil {
+					continue
+				}
+				var nodes []pipe.NodeInfo
+				for _, node := range book.Full() {
+					nodes = append(nodes, node)
+				}
+				sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+				r.mutex.Lock()
+				c.nodes = nodes
+				c.seq = r.changed()
+				r.mutex.Unlock()
+			case <-closeCh:
+				return
+			}
+		}
+	}), nil
+}
+
+// changed increments the sequence and wakes up waiting requests. Needs to hold the mutex.
+func (r *EnvoyReactor) changed() uint64 {
+	r.seq++
+	close(r.changeCh)
+	r.changeCh = make(chan struct{})
+	return r.seq
+}
+
+// Addr returns the address the server listens on or nil if not running.
+func (r *EnvoyReactor) Addr() net.Addr {
+	return r.server.Addr()
+}
+
+// register adds the cluster and starts the server if needed.
+func (r *EnvoyReactor) register(c *cluster) error {
+	r.mutex.Lock()
+	r.clusters[c.cfg.Cluster] = c
+	c.seq = r.changed()
+	r.clusterSeq = c.seq
+	listen := r.listen
+	r.mutex.Unlock()
+	err := r.server.Acquire(func() (net.Addr, func(), error) {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/v3/discovery:clusters", func(w http.ResponseWriter, req *http.Request) {
+			r.discover(w, req, TypeCluster)
+		})
+		mux.HandleFunc("/v3/discovery:endpoints", func(w http.ResponseWriter, req *http.Request) {
+			r.discover(w, req, TypeClusterLoadAssignment)
+		})
+		stopCh := make(chan struct{})
+		r.mutex.Lock()
+		r.stopCh = stopCh
+		r.mutex.Unlock()
+		addr, stop, err := sharedserver.HTTP(listen, nil, mux)()
+		if err != nil {
+			return nil, nil, err
+		}
+		return addr, func() {
+			close(stopCh) // Answer long polls
+			stop()
+		}, nil
+	})
+	if err != nil {
+		r.remove(c.cfg.Cluster)
+	}
+	return err
+}
+
+// unregister removes the cluster and stops the server if it was the last one.
+func (r *EnvoyReactor) unregister(name string) {
+	r.remove(name)
+	r.server.Release()
+}
+
+// remove removes the cluster and releases its name.
+func (r *EnvoyReactor) remove(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, found := r.clusters[name]; found {
+		delete(r.clusters, name)
+		r.clusterSeq = r.changed()
+	}
+	delete(r.accepted, name)
+}
+
+// discover answers a discovery request of the type.
+// If the requested version is current, the request is held up to the long poll duration
+// and answered by 304 Not Modified if nothing changed.
+func (r *EnvoyReactor) discover(w http.ResponseWriter, req *http.Request, typeURL string) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var dreq DiscoveryRequest
+	err := json.NewDecoder(req.Body).Decode(&dreq)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %s", err), http.StatusBadRequest)
+		return
+	}
+	if dreq.TypeURL != "" && dreq.TypeURL != typeURL {
+		http.Error(w, fmt.Sprintf("Invalid type %q", dreq.TypeURL), http.StatusBadRequest)
+		return
+	}
+	if dreq.ErrorDetail != nil {
+		log.Printf("Envoy rejected %s version %s: %s", typeURL, dreq.VersionInfo, dreq.ErrorDetail.Message)
+	}
+
+	timeout := time.NewTimer(r.longPollTimeout())
+	defer timeout.Stop()
+	for {
+		r.mutex.Lock()
+		resp := r.response(typeURL, dreq.ResourceNames)
+		changeCh, stopCh := r.changeCh, r.stopCh
+		r.mutex.Unlock()
+		if resp.VersionInfo != dreq.VersionInfo {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+		select {
+		case <-changeCh:
+		case <-timeout.C:
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case <-stopCh:
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func (r *EnvoyReactor) longPollTimeout() time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.longPoll
+}
+
+// response creates the discovery response of the requested resources, all if names is empty.
+// Needs to hold the mutex.
+func (r *EnvoyReactor) response(typeURL string, names []string) *DiscoveryResponse {
+	if len(names) == 0 {
+		for name := range r.clusters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	r.nonce++
+	resp := &DiscoveryResponse{
+		TypeURL:   typeURL,
+		Nonce:     strconv.FormatUint(r.nonce, 10),
+		Resources: []interface{}{},
+	}
+	if typeURL == TypeCluster {
+		resp.VersionInfo = strconv.FormatUint(r.clusterSeq, 10)
+		for _, name := range names {
+			if c, found := r.clusters[name]; found {
+				resp.Resources = append(resp.Resources, c.resource(r.edsConfig))
+			}
+		}
+		return resp
+	}
+
+	// The version of endpoints is made up of the sequences of the requested clusters
+	versions := make([]string, len(names))
+	for i, name := range names {
+		versions[i] = "0"
+		if c, found := r.clusters[name]; found {
+			versions[i] = strconv.FormatUint(c.seq, 10)
+			resp.Resources = append(resp.Resources, c.loadAssignment())
+		}
+	}
+	resp.VersionInfo = strings.Join(versions, ".")
+	return resp
+}
+
+// resource returns the cluster fetching its endpoints by eds.
+func (c *cluster) resource(edsConfig json.RawMessage) *Cluster {
+	return &Cluster{
+		Type:           TypeCluster,
+		Name:           c.cfg.Cluster,
+		ClusterType:    "EDS",
+		ConnectTimeout: c.cfg.ConnectTimeout,
+		LbPolicy:       c.cfg.LbPolicy,
+		EdsClusterConfig: EdsClusterConfig{
+			EdsConfig:   edsConfig,
+			ServiceName: c.cfg.Cluster,
+		},
+	}
+}
+
+// loadAssignment groups the nodes by locality and priority.
+// Nodes without an ip address are skipped, envoy does not resolve hostnames of eds endpoints.
+func (c *cluster) loadAssignment() *ClusterLoadAssignment {
+	type key struct {
+		region, zone string
+		priority     uint32
+	}
+	groups := make(map[key][]LbEndpoint)
+	var keys []key
+	for _, node := range c.nodes {
+		if net.ParseIP(node.Host) == nil {
+			continue
+		}
+		k := key{
+			region:   node.Meta[c.cfg.RegionKey],
+			zone:     node.Meta[c.cfg.ZoneKey],
+			priority: metaUint32(node, c.cfg.PriorityKey, 0),
+		}
+		if _, found := groups[k]; !found {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], LbEndpoint{
+			Endpoint: Endpoint{
+				Address: Address{
+					SocketAddress: SocketAddress{Address: node.Host, PortValue: node.Port},
+				},
+				Hostname: node.Name,
+			},
+			HealthStatus:        "HEALTHY",
+			LoadBalancingWeight: metaUint32(node, c.cfg.WeightKey, 0),
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].priority != keys[j].priority {
+			return keys[i].priority < keys[j].priority
+		}
+		if keys[i].region != keys[j].region {
+			return keys[i].region < keys[j].region
+		}
+		return keys[i].zone < keys[j].zone
+	})
+	cla := &ClusterLoadAssignment{
+		Type:        TypeClusterLoadAssignment,
+		ClusterName: c.cfg.Cluster,
+		Endpoints:   []LocalityLbEndpoints{},
+	}
+	for _, k := range keys {
+		endpoints := LocalityLbEndpoints{
+			LbEndpoints: groups[k],
+			Priority:    k.priority,
+		}
+		if k.region != "" || k.zone != "" {
+			endpoints.Locality = &Locality{Region: k.region, Zone: k.zone}
+		}
+		cla.Endpoints = append(cla.Endpoints, endpoints)
+	}
+	return cla
+}
+
+// metaUint32 returns the metadata value of key as uint32 or def if missing or invalid.
+func metaUint32(node pipe.NodeInfo, key string, def uint32) uint32 {
+	value, found := node.Meta[key]
+	if !found || key == "" {
+		return def
+	}
+	i, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return def
+	}
+	return uint32(i)
+}
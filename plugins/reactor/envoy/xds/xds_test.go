@@ -0,0 +1,177 @@
+package xds
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// waitServer waits until the server is running and returns its url.
+func waitServer(t *testing.T, react *EnvoyReactor) string {
+	for i := 0; i < 500; i++ {
+		if addr := react.Addr(); addr != nil {
+			return "http://" + addr.String()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Server not started")
+	return ""
+}
+
+// client does not keep connections, idle connections would delay the server shutdown.
+var client = &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+// discover posts a discovery request as envoy does and decodes successful responses into v.
+func discover(t *testing.T, url string, path string, req string, v interface{}) *http.Response {
+	resp, err := client.Post(url+path, "application/json", bytes.NewBufferString(req))
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		err = json.NewDecoder(resp.Body).Decode(v)
+		if err != nil {
+			t.Fatalf("Invalid response: %s", err)
+		}
+	}
+	return resp
+}
+
+type endpointsResponse struct {
+	VersionInfo string                  `json:"version_info"`
+	Resources   []ClusterLoadAssignment `json:"resources"`
+	TypeURL     string                  `json:"type_url"`
+}
+
+type clustersResponse struct {
+	VersionInfo string    `json:"version_info"`
+	Resources   []Cluster `json:"resources"`
+}
+
+func TestFunc(t *testing.T) {
+	react := &EnvoyReactor{}
+	err := react.Setup(json.RawMessage(`{"listen":"127.0.0.1:0","longPoll":"200ms","xdsCluster":"xds"}`))
+	if err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	web, webCh := plugintest.StartReactor(t, react, `{"cluster":"web","lbPolicy":"LEAST_REQUEST"}`)
+	if _, err := react.Accept(json.RawMessage(`{"cluster":"web"}`)); err == nil {
+		t.Error("Expected cluster to be used only once")
+	}
+	url := waitServer(t, react)
+
+	node1 := pipe.NewNodeInfo("web1", pipe.NodeUp, "10.0.0.1", 80)
+	node1.Meta = map[string]string{"zone": "a", "weight": "10"}
+	node2 := pipe.NewNodeInfo("web2", pipe.NodeUp, "10.0.0.2", 80)
+	node2.Meta = map[string]string{"zone": "b", "priority": "1"}
+	ev := pipe.NewEvent()
+	ev.AddNode(node1)
+	ev.AddNode(node2)
+	ev.AddNewNode("web3", pipe.NodeUp, "web3.example.com", 80) // No ip, skipped
+	webCh <- ev
+
+	var eds endpointsResponse
+	var version string
+	for i := 0; i < 500; i++ {
+		discover(t, url, "/v3/discovery:endpoints", `{"resource_names":["web"],"type_url":"`+TypeClusterLoadAssignment+`"}`, &eds)
+		if len(eds.Resources) == 1 && len(eds.Resources[0].Endpoints) == 2 {
+			version = eds.VersionInfo
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if version == "" {
+		t.Fatalf("Expected endpoints of web, got %+v", eds)
+	}
+	cla := eds.Resources[0]
+	if cla.ClusterName != "web" || cla.Type != TypeClusterLoadAssignment {
+		t.Errorf("Invalid load assignment: %+v", cla)
+	}
+	if l := cla.Endpoints[0]; l.Priority != 0 || l.Locality.Zone != "a" || len(l.LbEndpoints) != 1 ||
+		l.LbEndpoints[0].LoadBalancingWeight != 10 || l.LbEndpoints[0].Endpoint.Address.SocketAddress.Address != "10.0.0.1" {
+		t.Errorf("Invalid locality of web1: %+v", l)
+	}
+	if l := cla.Endpoints[1]; l.Priority != 1 || l.Locality.Zone != "b" || l.LbEndpoints[0].Endpoint.Hostname != "web2" {
+		t.Errorf("Invalid locality of web2: %+v", l)
+	}
+
+	// Current version is not modified after long poll
+	start := time.Now()
+	req := fmt.Sprintf(`{"versionInfo":%q,"resourceNames":["web"]}`, version)
+	if resp := discover(t, url, "/v3/discovery:endpoints", req, &eds); resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("Expected not modified, got %s", resp.Status)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("Expected request to be held, answered after %s", d)
+	}
+
+	// Waiting request receives update
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		webCh <- pipe.NewEventWithNode("web2", pipe.NodeDown, "10.0.0.2", 80)
+	}()
+	eds = endpointsResponse{}
+	discover(t, url, "/v3/discovery:endpoints", req, &eds)
+	if eds.VersionInfo == version || len(eds.Resources) != 1 || len(eds.Resources[0].Endpoints) != 1 {
+		t.Fatalf("Expected update of web, got %+v", eds)
+	}
+
+	// Clusters
+	db, dbCh := plugintest.StartReactor(t, react, `{"cluster":"db","connectTimeout":"250ms"}`)
+	var cds clustersResponse
+	for i := 0; i < 500; i++ {
+		discover(t, url, "/v3/discovery:clusters", `{"type_url":"`+TypeCluster+`"}`, &cds)
+		if len(cds.Resources) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(cds.Resources) != 2 {
+		t.Fatalf("Expected 2 clusters, got %+v", cds)
+	}
+	if c := cds.Resources[0]; c.Name != "db" || c.ClusterType != "EDS" || c.ConnectTimeout != "0.25s" || c.EdsClusterConfig.ServiceName != "db" {
+		t.Errorf("Invalid cluster: %+v", c)
+	}
+	if c := cds.Resources[1]; c.Name != "web" || c.LbPolicy != "LEAST_REQUEST" {
+		t.Errorf("Invalid cluster: %+v", c)
+	}
+	var edsConfig struct {
+		APIConfigSource struct {
+			APIType      string   `json:"api_type"`
+			ClusterNames []string `json:"cluster_names"`
+		} `json:"api_config_source"`
+	}
+	json.Unmarshal(cds.Resources[0].EdsClusterConfig.EdsConfig, &edsConfig)
+	if edsConfig.APIConfigSource.APIType != "REST" || len(edsConfig.APIConfigSource.ClusterNames) != 1 || edsConfig.APIConfigSource.ClusterNames[0] != "xds" {
+		t.Errorf("Invalid eds config: %s", cds.Resources[0].EdsClusterConfig.EdsConfig)
+	}
+
+	// Endpoint updates don't change the version of clusters
+	dbCh <- pipe.NewEventWithNode("db1", pipe.NodeUp, "10.0.1.1", 5432)
+	req = fmt.Sprintf(`{"version_info":%q}`, cds.VersionInfo)
+	if resp := discover(t, url, "/v3/discovery:clusters", req, &cds); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected not modified, got %s", resp.Status)
+	}
+
+	if resp := discover(t, url, "/v3/discovery:clusters", `{"type_url":"`+TypeClusterLoadAssignment+`"}`, &cds); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected bad request on wrong type, got %s", resp.Status)
+	}
+
+	// Removed cluster
+	plugintest.Stop(t, db)
+	cds = clustersResponse{}
+	discover(t, url, "/v3/discovery:clusters", req, &cds)
+	if len(cds.Resources) != 1 || cds.Resources[0].Name != "web" {
+		t.Errorf("Expected only web, got %+v", cds)
+	}
+
+	plugintest.Stop(t, web)
+	if react.Addr() != nil {
+		t.Error("Expected server to be stopped")
+	}
+}
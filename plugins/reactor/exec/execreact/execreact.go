@@ -0,0 +1,204 @@
+package execreact
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Failure policies
+const (
+	FailureIgnore = "ignore" // Log and wait for the next event
+	FailureRetry  = "retry"  // Retry up to the configured number of retries, then ignore
+	FailureFail   = "fail"   // Stop the endpoint, shuts down the service
+)
+
+type ExecReactor struct {
+}
+
+type ServiceConfig struct {
+	Command    []string `json:"command"`
+	Stdin      *bool    `json:"stdin"` // Pass nodes as json on stdin, defaults to true
+	Env        bool     `json:"env"`   // Pass nodes as environment variables
+	Timeout    string   `json:"timeout"`
+	OnFailure  string   `json:"onFailure"` // ignore, retry or fail
+	Retries    int      `json:"retries"`
+	RetryDelay string   `json:"retryDelay"`
+}
+
+// Node is the description of a single node passed to the command.
+type Node struct {
+	Name   string            `json:"name"`
+	Status string            `json:"status"` // "up" or "down"
+	Host   string            `json:"host"`
+	Port   uint16            `json:"port"`
+	Meta   map[string]string `json:"meta,omitempty"`
+}
+
+func (r *ExecReactor) Setup(_ json.RawMessage) error {
+	return nil
+}
+
+func (r *ExecReactor) Accept(cfgData json.RawMessage) (pipe.Endpoint, error) {
+	cfg := ServiceConfig{
+		Timeout:    "30s",
+		OnFailure:  FailureIgnore,
+		Retries:    3,
+		RetryDelay: "1s",
+	}
+	err := json.Unmarshal(cfgData, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Command) == 0 {
+		return nil, errors.New("No command configured")
+	}
+	timeout, err := time.ParseDuration(cfg.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid timeout: %s", err)
+	}
+	retryDelay, err := time.ParseDuration(cfg.RetryDelay)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid retry delay: %s", err)
+	}
+	switch cfg.OnFailure {
+	case FailureIgnore, FailureRetry, FailureFail:
+	default:
+		return nil, fmt.Errorf("Invalid failure policy %q", cfg.OnFailure)
+	}
+	stdin := cfg.Stdin == nil || *cfg.Stdin
+
+	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-closeCh
+			cancel() // Kills running command
+		}()
+
+		book := pipe.NewBook()
+		for {
+			var changed pipe.Event
+			select {
+			case ev, ok := <-eventCh:
+				if !ok {
+					return
+				}
+				changed = book.UpdateInc(ev)
+			case <-closeCh:
+				return
+			}
+			// Coalesce events arrived meanwhile into a single run
+		drain:
+			for {
+				select {
+				case ev, ok := <-eventCh:
+					if !ok {
+						return
+					}
+					if outEv := book.UpdateInc(ev); outEv != nil {
+						if changed == nil {
+							changed = pipe.NewEvent()
+						}
+						for _, node := range outEv {
+							changed.AddNode(node)
+						}
+					}
+				default:
+					break drain
+				}
+			}
+			if changed == nil {
+				continue
+			}
+
+			nodes := toNodes(book.Full())
+			changedNodes := toNodes(changed)
+			for try := 0; ; try++ {
+				err := run(ctx, cfg.Command, nodes, changedNodes, stdin, cfg.Env, timeout)
+				if err == nil || ctx.Err() != nil {
+					break
+				}
+				log.Printf("Command %q failed: %s", cfg.Command, err)
+				if cfg.OnFailure == FailureFail {
+					return
+				}
+				if cfg.OnFailure == FailureIgnore || try >= cfg.Retries {
+					break
+				}
+				select {
+				case <-time.After(retryDelay):
+				case <-closeCh:
+					return
+				}
+			}
+		}
+	}), nil
+}
+
+// toNodes converts the event to a list of nodes sorted by name.
+func toNodes(ev pipe.Event) []Node {
+	nodes := []Node{}
+	for _, node := range ev {
+		status := "up"
+		if node.Status == pipe.NodeDown {
+			status = "down"
+		}
+		nodes = append(nodes, Node{
+			Name:   node.Name,
+			Status: status,
+			Host:   node.Host,
+			Port:   node.Port,
+			Meta:   node.Meta,
+		})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	return nodes
+}
+
+// run runs the command once and logs its output.
+// All nodes up are passed as json array on stdin and in RECEPTOR_NODES,
+// the nodes changed since the last run in RECEPTOR_CHANGED.
+func run(ctx context.Context, command []string, nodes []Node, changed []Node, stdin bool, env bool, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	nodesJSON, err := json.Marshal(nodes)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.WaitDelay = time.Second // Don't wait for children holding stdout
+	if stdin {
+		cmd.Stdin = bytes.NewReader(nodesJSON)
+	}
+	if env {
+		changedJSON, err := json.Marshal(changed)
+		if err != nil {
+			return err
+		}
+		cmd.Env = append(os.Environ(),
+			"RECEPTOR_NODES="+string(nodesJSON),
+			"RECEPTOR_NODE_COUNT="+strconv.Itoa(len(nodes)),
+			"RECEPTOR_CHANGED="+string(changedJSON),
+		)
+	}
+	out, err := cmd.CombinedOutput()
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		log.Printf("[%s] %s", command[0], scanner.Text())
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("Timeout after %s", timeout)
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+package execreact
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readLines waits until the file contains at least n lines.
+func readLines(t *testing.T, filename string, n int) []string {
+	var lines []string
+	for i := 0; i < 500; i++ {
+		data, _ := ioutil.ReadFile(filename)
+		lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(data) > 0 && len(lines) >= n {
+			return lines
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d lines, got %q", n, lines)
+	return nil
+}
+
+// startReactor runs the reactor on a buffered channel like the merged channel of the plugin server.
+func startReactor(t *testing.T, cfg string) (*pipe.ManagedEndpoint, chan pipe.Event) {
+	handle, err := (&ExecReactor{}).Accept(json.RawMessage(cfg))
+	if err != nil {
+		t.Fatalf("Does not accept config: %s", err)
+	}
+	eventCh := make(chan pipe.Event, 10)
+	return plugintest.Handle(handle, eventCh), eventCh
+}
+
+func TestFunc(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	out := filepath.Join(tmpDir, "out")
+
+	script := fmt.Sprintf(`read nodes; echo "$nodes|$RECEPTOR_NODE_COUNT|$RECEPTOR_CHANGED" >> %s; sleep 0.2`, out)
+	manHandle, eventCh := startReactor(t, fmt.Sprintf(`{"command":["sh","-c",%q],"env":true}`, script))
+
+	eventCh <- pipe.NewEventWithNode("Node1", pipe.NodeUp, "127.0.0.1", 80)
+	lines := readLines(t, out, 1)
+	expected := `[{"name":"Node1","status":"up","host":"127.0.0.1","port":80}]|1|[{"name":"Node1","status":"up","host":"127.0.0.1","port":80}]`
+	if lines[0] != expected {
+		t.Errorf("Expected %q, got %q", expected, lines[0])
+	}
+
+	// Events during a run are coalesced
+	time.Sleep(50 * time.Millisecond)
+	eventCh <- pipe.NewEventWithNode("Node2", pipe.NodeUp, "127.0.0.2", 81)
+	eventCh <- pipe.NewEventWithNode("Node3", pipe.NodeUp, "127.0.0.3", 82)
+	eventCh <- pipe.NewEventWithNode("Node1", pipe.NodeDown, "127.0.0.1", 80)
+	time.Sleep(500 * time.Millisecond)
+	lines = readLines(t, out, 2)
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 runs, got %q", lines)
+	}
+	expected = `[{"name":"Node2","status":"up","host":"127.0.0.2","port":81},{"name":"Node3","status":"up","host":"127.0.0.3","port":82}]|2|` +
+		`[{"name":"Node1","status":"down","host":"127.0.0.1","port":80},{"name":"Node2","status":"up","host":"127.0.0.2","port":81},{"name":"Node3","status":"up","host":"127.0.0.3","port":82}]`
+	if lines[1] != expected {
+		t.Errorf("Expected %q, got %q", expected, lines[1])
+	}
+
+	close(eventCh)
+	if err := manHandle.WaitTimeout(5 * time.Second); err != nil {
+		t.Errorf("Stop handle timeout: %s", err)
+	}
+}
+
+func TestFailurePolicy(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, test := range []struct {
+		policy string
+		runs   int
+		stops  bool
+	}{
+		{FailureIgnore, 1, false},
+		{FailureRetry, 3, false},
+		{FailureFail, 1, true},
+	} {
+		out := filepath.Join(tmpDir, test.policy)
+		cfg := fmt.Sprintf(`{"command":["sh","-c",%q],"onFailure":%q,"retries":2,"retryDelay":"10ms"}`, "echo run >> "+out+"; exit 1", test.policy)
+		manHandle, eventCh := startReactor(t, cfg)
+		eventCh <- pipe.NewEventWithNode("Node1", pipe.NodeUp, "127.0.0.1", 80)
+		time.Sleep(200 * time.Millisecond)
+		if lines := readLines(t, out, test.runs); len(lines) != test.runs {
+			t.Errorf("Policy %s: Expected %d runs, got %d", test.policy, test.runs, len(lines))
+		}
+		select {
+		case <-manHandle.DoneCh:
+			if !test.stops {
+				t.Errorf("Policy %s: Endpoint stopped unexpectedly", test.policy)
+			}
+		default:
+			if test.stops {
+				t.Errorf("Policy %s: Expected endpoint to stop", test.policy)
+			}
+		}
+		plugintest.Stop(t, manHandle)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	cfg := `{"command":["sleep","10"],"timeout":"50ms","stdin":false}`
+	manHandle, eventCh := startReactor(t, cfg)
+	start := time.Now()
+	eventCh <- pipe.NewEventWithNode("Node1", pipe.NodeUp, "127.0.0.1", 80)
+	time.Sleep(100 * time.Millisecond)
+	eventCh <- pipe.NewEventWithNode("Node2", pipe.NodeUp, "127.0.0.2", 80)
+	manHandle.Stop() // Kills the second run
+	if err := manHandle.WaitTimeout(5 * time.Second); err != nil {
+		t.Errorf("Stop handle timeout: %s", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Command was not killed, took %s", d)
+	}
+}
@@ -0,0 +1,303 @@
+package fedforward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugins/watcher/federation/fedwatch"
+	"github.com/ugorji/go/codec"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// FederationReactor forwards the events of services to a remote receptor
+// running the federation watcher.
+type FederationReactor struct {
+	Config Config
+}
+
+type Config struct {
+	Address string     `json:"address"` // Address of the remote receptor
+	Site    string     `json:"site"`    // Name of the local site
+	Token   string     `json:"token"`
+	TLS     *TLSConfig `json:"tls"`
+}
+
+type TLSConfig struct {
+	CA         string `json:"ca"`   // Verify the server certificate, system roots if empty
+	Cert       string `json:"cert"` // Client certificate
+	Key        string `json:"key"`
+	ServerName string `json:"serverName"`
+	Insecure   bool   `json:"insecure"` // Skip verification of the server certificate
+}
+
+type ServiceConfig struct {
+	Config
+	Service   string `json:"service"` // Name of the service at the remote receptor
+	Retry     string `json:"retry"`   // Delay before reconnecting
+	Heartbeat string `json:"heartbeat"`
+	Timeout   string `json:"timeout"`
+	QueueSize int    `json:"queueSize"` // Changes buffered while sending, a full update is sent on overflow
+}
+
+func (r *FederationReactor) Setup(cfgData json.RawMessage) error {
+	var conf Config
+	err := json.Unmarshal(cfgData, &conf)
+	if err != nil {
+		return err
+	}
+	r.Config = conf
+	return nil
+}
+
+func (r *FederationReactor) Accept(cfgData json.RawMessage) (pipe.Endpoint, error) {
+	cfg := ServiceConfig{
+		Config:    r.Config,
+		Retry:     "5s",
+		Heartbeat: "10s",
+		Timeout:   "10s",
+		QueueSize: 100,
+	}
+	err := json.Unmarshal(cfgData, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Address == "" {
+		return nil, errors.New("No address configured")
+	}
+	if cfg.Service == "" {
+		return nil, errors.New("No service configured")
+	}
+	if cfg.Site == "" {
+		cfg.Site, err = os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("No site configured: %s", err)
+		}
+	}
+	if cfg.QueueSize < 1 {
+		return nil, errors.New("Invalid queue size")
+	}
+	s := &stream{
+		address: cfg.Address,
+		hello: fedwatch.Hello{
+			Version: fedwatch.ProtocolVersion,
+			Site:    cfg.Site,
+			Service: cfg.Service,
+			Token:   cfg.Token,
+		},
+	}
+	s.retry, err = time.ParseDuration(cfg.Retry)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid retry delay: %s", err)
+	}
+	s.heartbeat, err = time.ParseDuration(cfg.Heartbeat)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid heartbeat: %s", err)
+	}
+	s.timeout, err = time.ParseDuration(cfg.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid timeout: %s", err)
+	}
+	if s.heartbeat <= 0 {
+		return nil, errors.New("Invalid heartbeat: Must be positive")
+	}
+	if s.timeout <= 0 {
+		return nil, errors.New("Invalid timeout: Must be positive")
+	}
+	if cfg.TLS != nil {
+		s.tlsConfig, err = newTLSConfig(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
+		s.book = pipe.NewBook()
+		s.incCh = make(chan []pipe.NodeInfo, cfg.QueueSize)
+		s.resyncCh = make(chan struct{}, 1)
+		doneCh := make(chan struct{})
+		go func() {
+			defer close(doneCh)
+			s.run(closeCh)
+		}()
+		defer func() { <-doneCh }()
+
+		for {
+			select {
+			case ev, ok := <-eventCh:
+				if !ok {
+					return
+				}
+				changed := s.book.UpdateInc(ev)
+				if changed == nil {
+					continue
+				}
+				var nodes []pipe.NodeInfo
+				for _, node := range changed {
+					nodes = append(nodes, node)
+				}
+				select {
+				case s.incCh <- nodes:
+				default:
+					// Queue full, the next full update contains the change
+					select {
+					case s.resyncCh <- struct{}{}:
+					default:
+					}
+				}
+			case <-closeCh:
+				return
+			}
+		}
+	}), nil
+}
+
+func newTLSConfig(conf *TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         conf.ServerName,
+		InsecureSkipVerify: conf.Insecure,
+	}
+	if conf.CA != "" {
+		b, err := ioutil.ReadFile(conf.CA)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load ca: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(b) {
+			return nil, errors.New("No valid certificates found in ca")
+		}
+	}
+	if conf.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// stream sends the nodes of a service to the remote receptor, reconnecting after errors.
+type stream struct {
+	address   string
+	tlsConfig *tls.Config
+	hello     fedwatch.Hello
+	retry     time.Duration
+	heartbeat time.Duration
+	timeout   time.Duration
+	book      *pipe.Book
+	incCh     chan []pipe.NodeInfo
+	resyncCh  chan struct{}
+}
+
+// run streams until closeCh is closed.
+func (s *stream) run(closeCh chan struct{}) {
+	for {
+		err := s.connect(closeCh)
+		select {
+		case <-closeCh:
+			return
+		default:
+		}
+		log.Printf("Stream of %s to %s failed: %s", s.hello.Service, s.address, err)
+		select {
+		case <-time.After(s.retry):
+		case <-closeCh:
+			return
+		}
+	}
+}
+
+// connect establishes a connection and sends updates until an error occurs or closeCh is closed.
+func (s *stream) connect(closeCh chan struct{}) error {
+	dialer := &net.Dialer{Timeout: s.timeout}
+	var conn net.Conn
+	var err error
+	if s.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.address, s.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", s.address)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var mh codec.MsgpackHandle
+	enc := codec.NewEncoder(conn, &mh)
+	dec := codec.NewDecoder(conn, &mh)
+	conn.SetDeadline(time.Now().Add(s.timeout))
+	err = enc.Encode(s.hello)
+	if err != nil {
+		return err
+	}
+	var reply fedwatch.HelloReply
+	err = dec.Decode(&reply)
+	if err != nil {
+		return err
+	}
+	if reply.Error != "" {
+		return fmt.Errorf("Rejected: %s", reply.Error)
+	}
+	conn.SetDeadline(time.Time{})
+	log.Printf("Streaming %s to %s", s.hello.Service, s.address)
+
+	// The server does not send anything after the reply, reading detects closed connections
+	errCh := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		_, err := conn.Read(b[:])
+		if err == nil {
+			err = errors.New("Unexpected data received")
+		}
+		errCh <- err
+	}()
+
+	send := func(msg *fedwatch.Message) error {
+		conn.SetWriteDeadline(time.Now().Add(s.timeout))
+		return enc.Encode(msg)
+	}
+	sendFull := func() error {
+		// Changes queued until now are part of the full update
+		for len(s.incCh) > 0 {
+			<-s.incCh
+		}
+		msg := &fedwatch.Message{Type: fedwatch.MessageFull, Nodes: []pipe.NodeInfo{}}
+		for _, node := range s.book.Full() {
+			msg.Nodes = append(msg.Nodes, node)
+		}
+		return send(msg)
+	}
+	select {
+	case <-s.resyncCh:
+	default:
+	}
+	err = sendFull()
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(s.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case nodes := <-s.incCh:
+			err = send(&fedwatch.Message{Type: fedwatch.MessageInc, Nodes: nodes})
+		case <-s.resyncCh:
+			err = sendFull()
+		case <-ticker.C:
+			err = send(&fedwatch.Message{Type: fedwatch.MessagePing})
+		case err = <-errCh:
+		case <-closeCh:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
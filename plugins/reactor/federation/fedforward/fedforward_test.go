@@ -0,0 +1,174 @@
+package fedforward
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
+	"github.com/blang/receptor/plugins/watcher/federation/fedwatch"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func generateCert(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return cert, key, certPEM, keyPEM
+}
+
+func writeTempFile(t *testing.T, dir string, name string, data []byte) string {
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// freeAddr returns a local address not in use.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// startWatcher starts a federation watcher accepting the service web.
+func startWatcher(t *testing.T, cfg string) (*pipe.ManagedEndpoint, chan pipe.Event) {
+	watcher := &fedwatch.FederationWatcher{}
+	if err := watcher.Setup(json.RawMessage(cfg)); err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	return plugintest.StartWatcher(t, watcher, `{"service":"web"}`)
+}
+
+// waitNode waits for an event containing the node in the expected state.
+func waitNode(t *testing.T, eventCh chan pipe.Event, name string, status pipe.NodeStatus) pipe.NodeInfo {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-eventCh:
+			if node, found := ev[name]; found && node.Status == status {
+				return node
+			}
+		case <-timeout:
+			t.Fatalf("Timeout: Node %s not %s", name, status)
+		}
+	}
+}
+
+func TestFunc(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ca, caKey, caPEM, _ := generateCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	_, _, serverPEM, serverKeyPEM := generateCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	_, _, clientPEM, clientKeyPEM := generateCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "client"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	caFile := writeTempFile(t, tmpDir, "ca.pem", caPEM)
+	serverFile := writeTempFile(t, tmpDir, "server.pem", serverPEM)
+	serverKeyFile := writeTempFile(t, tmpDir, "server.key", serverKeyPEM)
+	clientFile := writeTempFile(t, tmpDir, "client.pem", clientPEM)
+	clientKeyFile := writeTempFile(t, tmpDir, "client.key", clientKeyPEM)
+
+	addr := freeAddr(t)
+	watcherCfg := fmt.Sprintf(`{"listen":%q,"tokens":{"secret":["*"]},"tls":{"cert":%q,"key":%q,"clientCA":%q,"requireClientCert":true}}`,
+		addr, serverFile, serverKeyFile, caFile)
+	watcherHandle, watcherCh := startWatcher(t, watcherCfg)
+
+	react := &FederationReactor{}
+	err = react.Setup(json.RawMessage(fmt.Sprintf(`{"address":%q,"site":"dc1","token":"secret","tls":{"ca":%q,"cert":%q,"key":%q}}`,
+		addr, caFile, clientFile, clientKeyFile)))
+	if err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	reactHandle, reactCh := plugintest.StartReactor(t, react, `{"service":"web","retry":"50ms","heartbeat":"100ms"}`)
+
+	node := pipe.NewNodeInfo("web1", pipe.NodeUp, "10.0.0.1", 80)
+	node.Meta = map[string]string{"zone": "a"}
+	ev := pipe.NewEvent()
+	ev.AddNode(node)
+	reactCh <- ev
+	received := waitNode(t, watcherCh, "dc1/web1", pipe.NodeUp)
+	if received.Host != "10.0.0.1" || received.Port != 80 || received.Meta["zone"] != "a" || received.Meta["site"] != "dc1" {
+		t.Errorf("Unexpected node: %v", received)
+	}
+
+	reactCh <- pipe.NewEventWithNode("web1", pipe.NodeDown, "10.0.0.1", 80)
+	waitNode(t, watcherCh, "dc1/web1", pipe.NodeDown)
+
+	// Changes while disconnected are sent as full update after reconnect
+	plugintest.Stop(t, watcherHandle)
+	reactCh <- pipe.NewEventWithNode("web2", pipe.NodeUp, "10.0.0.2", 80)
+	watcherHandle, watcherCh = startWatcher(t, watcherCfg)
+	waitNode(t, watcherCh, "dc1/web2", pipe.NodeUp)
+
+	plugintest.Stop(t, reactHandle)
+	plugintest.Stop(t, watcherHandle)
+}
+
+func TestAccept(t *testing.T) {
+	react := &FederationReactor{}
+	for _, cfg := range []string{
+		`{"service":"web"}`,
+		`{"address":"127.0.0.1:7900"}`,
+		`{"address":"127.0.0.1:7900","service":"web","retry":"soon"}`,
+		`{"address":"127.0.0.1:7900","service":"web","heartbeat":"0s"}`,
+		`{"address":"127.0.0.1:7900","service":"web","timeout":"0s"}`,
+		`{"address":"127.0.0.1:7900","service":"web","queueSize":0}`,
+	} {
+		if _, err := react.Accept(json.RawMessage(cfg)); err == nil {
+			t.Errorf("Expected %s to be rejected", cfg)
+		}
+	}
+}
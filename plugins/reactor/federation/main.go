@@ -0,0 +1,10 @@
+package main
+
+import (
+	"github.com/blang/receptor/plugin"
+	"github.com/blang/receptor/plugins/reactor/federation/fedforward"
+)
+
+func main() {
+	plugin.ServeReactor(&fedforward.FederationReactor{})
+}
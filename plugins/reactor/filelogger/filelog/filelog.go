@@ -1,41 +1,97 @@
 package filelog
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/blang/receptor/pipe"
+	"log"
 	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"text/template"
 	"time"
 )
 
+// Output formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
 type FileLogReactor struct {
 }
 
 type ServiceConfig struct {
 	Filename   string `json:"filename"`
 	Unbuffered bool   `json:"unbuffered"`
+	Service    string `json:"service"`  // Name of the service written with every entry
+	Format     string `json:"format"`   // text or json
+	Template   string `json:"template"` // Template of a text entry, executed per node with a Record
+	MaxSize    string `json:"maxSize"`  // Rotate if the file would grow beyond, e.g. 10MB
+	MaxAge     string `json:"maxAge"`   // Rotate if the file is older, e.g. 24h
+	MaxBackups int    `json:"maxBackups"`
+	Compress   bool   `json:"compress"`
+}
+
+// Record is a single entry of the log.
+type Record struct {
+	Time    time.Time         `json:"time"`
+	Service string            `json:"service,omitempty"`
+	Name    string            `json:"name"`
+	Status  string            `json:"status"` // "up" or "down"
+	Host    string            `json:"host"`
+	Port    uint16            `json:"port"`
+	Meta    map[string]string `json:"meta,omitempty"`
 }
 
 func (r *FileLogReactor) Setup(_ json.RawMessage) error {
 	return nil
 }
 func (r *FileLogReactor) Accept(cfgData json.RawMessage) (pipe.Endpoint, error) {
-	var cfg ServiceConfig
+	cfg := ServiceConfig{
+		Format: FormatText,
+	}
 	err := json.Unmarshal(cfgData, &cfg)
 	if err != nil {
 		return nil, err
 	}
-	f, err := os.OpenFile(cfg.Filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	format, err := newFormatter(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	var opts RotateOptions
+	if cfg.MaxSize != "" {
+		opts.MaxSize, err = ParseSize(cfg.MaxSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.MaxAge != "" {
+		opts.MaxAge, err = time.ParseDuration(cfg.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid max age: %s", err)
+		}
+	}
+	opts.MaxBackups = cfg.MaxBackups
+	opts.Compress = cfg.Compress
+	f, err := OpenLogFile(cfg.Filename, opts)
 	if err != nil {
 		return nil, err
 	}
-	bufW := bufio.NewWriter(f)
 
 	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
+		// Reopen on SIGHUP after the file was moved by an external logrotate
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		defer signal.Stop(hupCh)
 		defer func() {
-			bufW.Flush()
-			f.Close()
+			err := f.Close()
+			if err != nil {
+				log.Printf("Could not close %s: %s", cfg.Filename, err)
+			}
 		}()
 		for {
 			select {
@@ -43,11 +99,23 @@ func (r *FileLogReactor) Accept(cfgData json.RawMessage) (pipe.Endpoint, error)
 				if !ok {
 					return
 				}
-				for _, node := range e {
-					fmt.Fprintf(bufW, "%s: %s (%s) %s:%d\n", time.Now(), node.Name, node.Status, node.Host, node.Port)
+				now := time.Now()
+				for _, node := range sortedNodes(e) {
+					b, err := format(now, node)
+					if err == nil {
+						err = f.Write(b)
+					}
+					if err != nil {
+						log.Printf("Could not log to %s: %s", cfg.Filename, err)
+					}
 				}
 				if cfg.Unbuffered {
-					bufW.Flush()
+					f.Flush()
+				}
+			case <-hupCh:
+				err := f.Reopen()
+				if err != nil {
+					log.Printf("Could not reopen %s: %s", cfg.Filename, err)
 				}
 			case <-closeCh:
 				return
@@ -56,3 +124,63 @@ func (r *FileLogReactor) Accept(cfgData json.RawMessage) (pipe.Endpoint, error)
 
 	}), nil
 }
+
+// newFormatter returns a function formatting a single node as a line of the configured format.
+func newFormatter(cfg *ServiceConfig) (func(now time.Time, node pipe.NodeInfo) ([]byte, error), error) {
+	switch cfg.Format {
+	case FormatJSON:
+		return func(now time.Time, node pipe.NodeInfo) ([]byte, error) {
+			b, err := json.Marshal(newRecord(now, cfg.Service, node))
+			return append(b, '\n'), err
+		}, nil
+	case FormatText, "":
+		if cfg.Template == "" {
+			return func(now time.Time, node pipe.NodeInfo) ([]byte, error) {
+				return []byte(fmt.Sprintf("%s: %s (%s) %s:%d\n", now, node.Name, node.Status, node.Host, node.Port)), nil
+			}, nil
+		}
+		t, err := template.New("entry").Option("missingkey=zero").Parse(cfg.Template)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid template: %s", err)
+		}
+		return func(now time.Time, node pipe.NodeInfo) ([]byte, error) {
+			var buf bytes.Buffer
+			err := t.Execute(&buf, newRecord(now, cfg.Service, node))
+			if err != nil {
+				return nil, err
+			}
+			if b := buf.Bytes(); len(b) == 0 || b[len(b)-1] != '\n' {
+				buf.WriteByte('\n')
+			}
+			return buf.Bytes(), nil
+		}, nil
+	default:
+		return nil, errors.New("Invalid format, use text or json")
+	}
+}
+
+func newRecord(now time.Time, service string, node pipe.NodeInfo) Record {
+	status := "up"
+	if node.Status == pipe.NodeDown {
+		status = "down"
+	}
+	return Record{
+		Time:    now,
+		Service: service,
+		Name:    node.Name,
+		Status:  status,
+		Host:    node.Host,
+		Port:    node.Port,
+		Meta:    node.Meta,
+	}
+}
+
+// sortedNodes returns the nodes of the event sorted by name.
+func sortedNodes(ev pipe.Event) []pipe.NodeInfo {
+	nodes := make([]pipe.NodeInfo, 0, len(ev))
+	for _, node := range ev {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	return nodes
+}
@@ -1,11 +1,16 @@
 package filelog
 
 import (
+	"compress/gzip"
 	"encoding/json"
+	"fmt"
 	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -34,14 +39,7 @@ func TestFunc(t *testing.T) {
 		t.Fatalf("Test internal failed: %s\n", err)
 	}
 
-	handle, err := react.Accept(json.RawMessage(b))
-	if err != nil {
-		t.Fatalf("Does not accept config: %s\n", err)
-	}
-	manHandle := pipe.NewManagedEndpoint(handle)
-
-	eventCh := make(chan pipe.Event)
-	go manHandle.Handle(eventCh)
+	manHandle, eventCh := plugintest.StartReactor(t, react, string(b))
 
 	eventCh <- pipe.NewEventWithNode("Node1", pipe.NodeUp, "127.0.0.1", 80)
 
@@ -61,3 +59,174 @@ func TestFunc(t *testing.T) {
 	}
 	t.Logf("Logger output:\n%s", string(data))
 }
+
+func TestFormats(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	jsonFile := filepath.Join(tmpDir, "events.json")
+	textFile := filepath.Join(tmpDir, "events.log")
+
+	jsonHandle, jsonCh := plugintest.StartReactor(t, &FileLogReactor{}, fmt.Sprintf(`{"filename":%q,"format":"json","service":"web","unbuffered":true}`, jsonFile))
+	textHandle, textCh := plugintest.StartReactor(t, &FileLogReactor{}, fmt.Sprintf(`{"filename":%q,"template":"{{.Service}} {{.Name}} {{.Status}} {{.Host}}:{{.Port}} {{.Meta.zone}}","service":"web","unbuffered":true}`, textFile))
+
+	node := pipe.NewNodeInfo("Node2", pipe.NodeDown, "127.0.0.2", 81)
+	node.Meta = map[string]string{"zone": "a"}
+	ev := pipe.NewEventWithNode("Node1", pipe.NodeUp, "127.0.0.1", 80)
+	ev.AddNode(node)
+	jsonCh <- ev
+	textCh <- ev
+
+	plugintest.WaitContent(t, textFile, "web Node1 up 127.0.0.1:80 \nweb Node2 down 127.0.0.2:81 a\n")
+	var data []byte
+	for i := 0; i < 500 && strings.Count(string(data), "\n") < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		data, _ = ioutil.ReadFile(jsonFile)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", data)
+	}
+	var rec Record
+	if err := json.Unmarshal([]byte(lines[1]), &rec); err != nil {
+		t.Fatalf("Invalid json line %q: %s", lines[1], err)
+	}
+	if rec.Service != "web" || rec.Name != "Node2" || rec.Status != "down" || rec.Host != "127.0.0.2" ||
+		rec.Port != 81 || rec.Meta["zone"] != "a" || rec.Time.IsZero() {
+		t.Errorf("Invalid record: %+v", rec)
+	}
+
+	plugintest.Stop(t, jsonHandle)
+	plugintest.Stop(t, textHandle)
+
+	if _, err := pipe.Reactor(&FileLogReactor{}).Accept(json.RawMessage(`{"filename":"x","format":"xml"}`)); err == nil {
+		t.Error("Expected invalid format to be rejected")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	name := filepath.Join(tmpDir, "events.log")
+
+	l, err := OpenLogFile(name, RotateOptions{MaxSize: 10, MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []string{"entry1\n", "entry2\n", "entry3\n", "entry4\n"} {
+		if err := l.Write([]byte(entry)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := ioutil.ReadFile(name); string(data) != "entry4\n" {
+		t.Errorf("Expected only last entry in current file, got %q", data)
+	}
+	backups, err := l.Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("Expected 2 backups, got %v", backups)
+	}
+	for i, backup := range backups {
+		f, err := os.Open(backup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("Backup %s not compressed: %s", backup, err)
+		}
+		data, _ := ioutil.ReadAll(gz)
+		f.Close()
+		if expected := fmt.Sprintf("entry%d\n", i+2); string(data) != expected {
+			t.Errorf("Expected %q in %s, got %q", expected, backup, data)
+		}
+	}
+
+	for size, expected := range map[string]int64{"512": 512, "64KB": 64 << 10, "10m": 10 << 20, "1 GB": 1 << 30} {
+		if n, err := ParseSize(size); err != nil || n != expected {
+			t.Errorf("Expected %d for %q, got %d (%v)", expected, size, n, err)
+		}
+	}
+	if _, err := ParseSize("ten"); err == nil {
+		t.Error("Expected invalid size to fail")
+	}
+}
+
+func TestRotateAge(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	name := filepath.Join(tmpDir, "events.log")
+
+	// Age is kept across restarts by the time of the last rotation
+	rotated := name + "." + time.Now().Add(-2*time.Hour).Format(rotatedTimeFormat)
+	if err := ioutil.WriteFile(rotated, []byte("entry1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte("entry2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := OpenLogFile(name, RotateOptions{MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []string{"entry3\n", "entry4\n"} {
+		if err := l.Write([]byte(entry)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(name); string(data) != "entry3\nentry4\n" {
+		t.Errorf("Expected new entries in current file, got %q", data)
+	}
+	if backups, _ := l.Backups(); len(backups) != 2 {
+		t.Errorf("Expected 2 backups, got %v", backups)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	name := filepath.Join(tmpDir, "events.log")
+
+	manHandle, eventCh := plugintest.StartReactor(t, &FileLogReactor{}, fmt.Sprintf(`{"filename":%q,"template":"{{.Name}}","unbuffered":true}`, name))
+	eventCh <- pipe.NewEventWithNode("Node1", pipe.NodeUp, "127.0.0.1", 80)
+	plugintest.WaitContent(t, name, "Node1\n")
+
+	// Moved by logrotate
+	if err := os.Rename(name, name+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		if _, err := os.Stat(name); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	eventCh <- pipe.NewEventWithNode("Node2", pipe.NodeUp, "127.0.0.1", 80)
+	plugintest.WaitContent(t, name, "Node2\n")
+	plugintest.WaitContent(t, name+".1", "Node1\n")
+
+	plugintest.Stop(t, manHandle)
+}
@@ -0,0 +1,247 @@
+package filelog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rotatedTimeFormat is appended to the name of rotated files, sorts chronologically.
+const rotatedTimeFormat = "20060102T150405.000000000"
+
+// RotateOptions configures rotation of a log file.
+type RotateOptions struct {
+	MaxSize    int64         // Rotate if the file would grow beyond, 0 disables
+	MaxAge     time.Duration // Rotate if the first entry was written longer ago, 0 disables
+	MaxBackups int           // Number of rotated files to keep, 0 keeps all
+	Compress   bool          // Gzip rotated files
+}
+
+// LogFile is an append-only buffered log file which is rotated by size and age.
+type LogFile struct {
+	name    string
+	opts    RotateOptions
+	f       *os.File
+	w       *bufio.Writer
+	size    int64
+	started time.Time // First entry written, zero if the file is empty
+}
+
+// OpenLogFile opens or creates the file for appending.
+func OpenLogFile(name string, opts RotateOptions) (*LogFile, error) {
+	l := &LogFile{
+		name: name,
+		opts: opts,
+	}
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *LogFile) open() error {
+	f, err := os.OpenFile(l.name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.w = bufio.NewWriter(f)
+	l.size = fi.Size()
+	l.started = time.Time{}
+	if l.size > 0 {
+		l.started = l.lastRotation()
+	}
+	return nil
+}
+
+// lastRotation returns the time the current file was started by the newest rotation.
+// Falls back to now if there is no rotated file, e.g. on the first start.
+func (l *LogFile) lastRotation() time.Time {
+	backups, err := l.Backups()
+	if err != nil || len(backups) == 0 {
+		return time.Now()
+	}
+	suffix := strings.TrimSuffix(strings.TrimPrefix(backups[len(backups)-1], l.name+"."), ".gz")
+	t, err := time.ParseInLocation(rotatedTimeFormat, suffix, time.Local)
+	if err != nil {
+		return time.Now()
+	}
+	return t
+}
+
+// Write writes a single entry, the file is rotated before if needed.
+// Entries are never split across files.
+func (l *LogFile) Write(b []byte) error {
+	if l.size > 0 && ((l.opts.MaxSize > 0 && l.size+int64(len(b)) > l.opts.MaxSize) ||
+		(l.opts.MaxAge > 0 && time.Since(l.started) >= l.opts.MaxAge)) {
+		err := l.Rotate()
+		if err != nil {
+			return err
+		}
+	}
+	if l.started.IsZero() {
+		l.started = time.Now()
+	}
+	n, err := l.w.Write(b)
+	l.size += int64(n)
+	return err
+}
+
+// Flush writes buffered entries to the file.
+func (l *LogFile) Flush() error {
+	return l.w.Flush()
+}
+
+// Reopen opens the file again, e.g. after it was moved by logrotate.
+// If opening fails, the current file is kept.
+func (l *LogFile) Reopen() error {
+	err := l.w.Flush()
+	if err != nil {
+		return err
+	}
+	old := l.f
+	err = l.open()
+	if err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+// Close flushes and closes the file.
+func (l *LogFile) Close() error {
+	err := l.w.Flush()
+	if closeErr := l.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Rotate moves the current file aside and opens a new one.
+// If the new file can't be opened, the current file is moved back and kept.
+// The rotated file is compressed if configured and old rotated files are removed.
+func (l *LogFile) Rotate() error {
+	err := l.w.Flush()
+	if err != nil {
+		return err
+	}
+	old := l.f
+	rotated := l.name + "." + time.Now().Format(rotatedTimeFormat)
+	err = os.Rename(l.name, rotated)
+	if err != nil {
+		return err // Keep writing to the current file
+	}
+	err = l.open()
+	if err != nil {
+		if renameErr := os.Rename(rotated, l.name); renameErr != nil {
+			return fmt.Errorf("%s, could not restore %s: %s", err, l.name, renameErr)
+		}
+		return err
+	}
+	err = old.Close()
+	if err != nil {
+		return fmt.Errorf("Could not close %s: %s", rotated, err)
+	}
+	if l.opts.Compress {
+		err = compressFile(rotated)
+		if err != nil {
+			return fmt.Errorf("Could not compress %s: %s", rotated, err)
+		}
+	}
+	return l.prune()
+}
+
+// prune removes the oldest rotated files exceeding the number of backups.
+func (l *LogFile) prune() error {
+	if l.opts.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := l.Backups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > l.opts.MaxBackups {
+		err = os.Remove(backups[0])
+		if err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Backups returns the rotated files, oldest first.
+func (l *LogFile) Backups() ([]string, error) {
+	matches, err := filepath.Glob(l.name + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, match := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(match, l.name+"."), ".gz")
+		if _, err := time.Parse(rotatedTimeFormat, suffix); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// compressFile gzips the file to name.gz and removes it.
+func compressFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
+
+// ParseSize parses sizes like 512, 64KB, 10MB or 1GB, units are powers of 1024.
+func ParseSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size %q", size)
+	}
+	return n * multiplier, nil
+}
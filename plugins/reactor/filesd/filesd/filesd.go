@@ -0,0 +1,184 @@
+package filesd
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugins/reactor/template/tmpl"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// FileSDReactor writes Prometheus file_sd files.
+// Services writing to the same file are combined.
+type FileSDReactor struct {
+	mutex sync.Mutex
+	File  string           // Combined file of all services without own file
+	files map[string]*file // Files by name
+}
+
+type Config struct {
+	File string `json:"file"`
+}
+
+type ServiceConfig struct {
+	File       string            `json:"file"`       // Overrides the global combined file
+	Labels     map[string]string `json:"labels"`     // Additional labels of all targets
+	MetaPrefix string            `json:"metaPrefix"` // Prefix of labels created from metadata
+	PortKey    string            `json:"portKey"`    // Metadata key of the port to scrape instead of the node port
+}
+
+// TargetGroup is a single entry of a file_sd file.
+type TargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// file holds the target groups of all services writing to a file.
+type file struct {
+	name   string
+	groups map[int][]TargetGroup // Endpoint id to target groups
+	nextID int
+}
+
+func (r *FileSDReactor) Setup(cfgData json.RawMessage) error {
+	var conf Config
+	err := json.Unmarshal(cfgData, &conf)
+	if err != nil {
+		return err
+	}
+	r.File = conf.File
+	return nil
+}
+
+func (r *FileSDReactor) Accept(cfgData json.RawMessage) (pipe.Endpoint, error) {
+	var cfg ServiceConfig
+	err := json.Unmarshal(cfgData, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.File == "" {
+		cfg.File = r.File
+	}
+	if cfg.File == "" {
+		return nil, errors.New("No file configured")
+	}
+	labels := make(map[string]string)
+	for name, value := range cfg.Labels {
+		labels[LabelName(name)] = value
+	}
+
+	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
+		f, id := r.register(cfg.File)
+		book := pipe.NewBook()
+		for {
+			select {
+			case ev, ok := <-eventCh:
+				if !ok {
+					return
+				}
+				if book.UpdateInc(ev) == nil {
+					continue
+				}
+				groups := targetGroups(book.Full(), labels, cfg.MetaPrefix, cfg.PortKey)
+				err := r.update(f, id, groups)
+				if err != nil {
+					log.Printf("Could not write %s: %s", cfg.File, err)
+				}
+			case <-closeCh:
+				// Targets are kept on shutdown to keep scraping until receptor is back
+				return
+			}
+		}
+	}), nil
+}
+
+// register adds an endpoint writing to the file and returns its id.
+func (r *FileSDReactor) register(name string) (*file, int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.files == nil {
+		r.files = make(map[string]*file)
+	}
+	f, found := r.files[name]
+	if !found {
+		f = &file{
+			name:   name,
+			groups: make(map[int][]TargetGroup),
+		}
+		r.files[name] = f
+	}
+	f.nextID++
+	return f, f.nextID
+}
+
+// update replaces the target groups of an endpoint and writes the file if changed.
+func (r *FileSDReactor) update(f *file, id int, groups []TargetGroup) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	f.groups[id] = groups
+	all := []TargetGroup{}
+	for _, groups := range f.groups {
+		all = append(all, groups...)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Targets[0] != all[j].Targets[0] {
+			return all[i].Targets[0] < all[j].Targets[0]
+		}
+		// Same target of different services, json encodes labels sorted by name
+		li, _ := json.Marshal(all[i].Labels)
+		lj, _ := json.Marshal(all[j].Labels)
+		return string(li) < string(lj)
+	})
+	b, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = tmpl.WriteFile(f.name, append(b, '\n'), tmpl.FileOptions{UID: -1, GID: -1})
+	return err
+}
+
+// targetGroups creates a target group per node, labeled by the labels and the metadata of the node.
+func targetGroups(ev pipe.Event, labels map[string]string, metaPrefix string, portKey string) []TargetGroup {
+	var names []string
+	for name := range ev {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	groups := []TargetGroup{}
+	for _, name := range names {
+		node := ev[name]
+		port := strconv.Itoa(int(node.Port))
+		if p, found := node.Meta[portKey]; found && portKey != "" {
+			port = p
+		}
+		group := TargetGroup{
+			Targets: []string{net.JoinHostPort(node.Host, port)},
+			Labels:  make(map[string]string),
+		}
+		for key, value := range node.Meta {
+			if key != portKey {
+				group.Labels[LabelName(metaPrefix+key)] = value
+			}
+		}
+		for key, value := range labels {
+			group.Labels[key] = value
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// LabelName converts a name to a valid Prometheus label name, invalid characters are replaced by '_'.
+func LabelName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c >= '0' && c <= '9' && i > 0) {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
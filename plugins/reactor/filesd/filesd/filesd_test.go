@@ -0,0 +1,86 @@
+package filesd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// waitGroups waits until the file contains the expected target groups.
+func waitGroups(t *testing.T, filename string, expected []TargetGroup) {
+	var groups []TargetGroup
+	for i := 0; i < 500; i++ {
+		data, _ := ioutil.ReadFile(filename)
+		groups = nil
+		if json.Unmarshal(data, &groups) == nil && reflect.DeepEqual(groups, expected) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %v, got %v", expected, groups)
+}
+
+func TestFunc(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	combined := filepath.Join(tmpDir, "combined.json")
+	own := filepath.Join(tmpDir, "own.json")
+
+	react := &FileSDReactor{}
+	if err := react.Setup(json.RawMessage(fmt.Sprintf(`{"file":%q}`, combined))); err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	web, webCh := plugintest.StartReactor(t, react, `{"labels":{"service":"web"},"metaPrefix":"meta_","portKey":"metrics-port"}`)
+	db, dbCh := plugintest.StartReactor(t, react, `{"labels":{"service":"db"}}`)
+	cache, cacheCh := plugintest.StartReactor(t, react, fmt.Sprintf(`{"file":%q}`, own))
+
+	node := pipe.NewNodeInfo("Node1", pipe.NodeUp, "10.0.0.1", 80)
+	node.Meta = map[string]string{"zone": "a", "metrics-port": "9100"}
+	ev := pipe.NewEvent()
+	ev.AddNode(node)
+	webCh <- ev
+	waitGroups(t, combined, []TargetGroup{
+		{Targets: []string{"10.0.0.1:9100"}, Labels: map[string]string{"service": "web", "meta_zone": "a"}},
+	})
+
+	dbCh <- pipe.NewEventWithNode("Node1", pipe.NodeUp, "fd00::1", 5432)
+	waitGroups(t, combined, []TargetGroup{ // Sorted by target
+		{Targets: []string{"10.0.0.1:9100"}, Labels: map[string]string{"service": "web", "meta_zone": "a"}},
+		{Targets: []string{"[fd00::1]:5432"}, Labels: map[string]string{"service": "db"}},
+	})
+
+	cacheCh <- pipe.NewEventWithNode("Node1", pipe.NodeUp, "10.0.1.1", 6379)
+	waitGroups(t, own, []TargetGroup{{Targets: []string{"10.0.1.1:6379"}}})
+
+	webCh <- pipe.NewEventWithNode("Node1", pipe.NodeDown, "10.0.0.1", 80)
+	waitGroups(t, combined, []TargetGroup{
+		{Targets: []string{"[fd00::1]:5432"}, Labels: map[string]string{"service": "db"}},
+	})
+
+	for _, h := range []*pipe.ManagedEndpoint{web, db, cache} {
+		plugintest.Stop(t, h)
+	}
+}
+
+func TestLabelName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"zone":       "zone",
+		"rack-id":    "rack_id",
+		"1st":        "_st",
+		"app.io/tag": "app_io_tag",
+	} {
+		if label := LabelName(name); label != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, name, label)
+		}
+	}
+}
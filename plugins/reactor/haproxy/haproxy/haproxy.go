@@ -0,0 +1,327 @@
+package haproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugins/reactor/template/tmpl"
+	"log"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultSocket = "/var/run/haproxy.sock"
+
+var errNoSlots = errors.New("No free server slots left")
+
+type HAProxyReactor struct {
+	Socket  string
+	Timeout time.Duration
+}
+
+type Config struct {
+	Socket  string `json:"socket"` // Unix socket path or tcp://host:port
+	Timeout string `json:"timeout"`
+}
+
+type ServiceConfig struct {
+	Socket     string          `json:"socket"` // Overrides global socket
+	Backend    string          `json:"backend"`
+	SlotPrefix string          `json:"slotPrefix"` // Only servers with this prefix are used as slots
+	WeightKey  string          `json:"weightKey"`  // Metadata key of the weight
+	Weight     int             `json:"weight"`     // Weight of nodes without weight metadata
+	Retry      string          `json:"retry"`      // Delay before retrying after errors
+	Fallback   *FallbackConfig `json:"fallback"`
+}
+
+// FallbackConfig renders a configuration and reloads HAProxy if all slots are in use.
+type FallbackConfig struct {
+	tmpl.ServiceConfig
+	Reload        []string `json:"reload"`
+	ReloadTimeout string   `json:"reloadTimeout"`
+}
+
+func (r *HAProxyReactor) Setup(cfgData json.RawMessage) error {
+	conf := Config{
+		Socket:  DefaultSocket,
+		Timeout: "5s",
+	}
+	err := json.Unmarshal(cfgData, &conf)
+	if err != nil {
+		return err
+	}
+	r.Socket = conf.Socket
+	r.Timeout, err = time.ParseDuration(conf.Timeout)
+	if err != nil {
+		return fmt.Errorf("Invalid timeout: %s", err)
+	}
+	return nil
+}
+
+func (r *HAProxyReactor) Accept(cfgData json.RawMessage) (pipe.Endpoint, error) {
+	cfg := ServiceConfig{
+		Socket:    r.Socket,
+		WeightKey: "weight",
+		Weight:    1,
+		Retry:     "5s",
+	}
+	err := json.Unmarshal(cfgData, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Backend == "" {
+		return nil, errors.New("No backend configured")
+	}
+	if cfg.SlotPrefix == "" {
+		return nil, errors.New("No slot prefix configured")
+	}
+	if cfg.Socket == "" { // No global configuration
+		cfg.Socket = DefaultSocket
+	}
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	retry, err := time.ParseDuration(cfg.Retry)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid retry delay: %s", err)
+	}
+	var renderer *tmpl.Renderer
+	var reloadTimeout time.Duration
+	if cfg.Fallback != nil {
+		renderer, err = tmpl.NewRenderer(&cfg.Fallback.ServiceConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid fallback: %s", err)
+		}
+		if len(cfg.Fallback.Reload) == 0 {
+			return nil, errors.New("Invalid fallback: No reload command configured")
+		}
+		reloadTimeout = 30 * time.Second
+		if cfg.Fallback.ReloadTimeout != "" {
+			reloadTimeout, err = time.ParseDuration(cfg.Fallback.ReloadTimeout)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid reload timeout: %s", err)
+			}
+		}
+	}
+
+	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
+		b := &backend{
+			client:    NewClient(cfg.Socket, timeout),
+			name:      cfg.Backend,
+			prefix:    cfg.SlotPrefix,
+			weightKey: cfg.WeightKey,
+			weight:    cfg.Weight,
+			resync:    true,
+		}
+		book := pipe.NewBook()
+		var retryCh <-chan time.Time
+		var noSlots bool // Logged that nodes are waiting for a free slot
+		for {
+			select {
+			case ev, ok := <-eventCh:
+				if !ok {
+					return
+				}
+				book.UpdateInc(ev)
+			case <-retryCh:
+			case <-closeCh:
+				return
+			}
+			retryCh = nil
+
+			full := book.Full()
+			err := b.sync(full)
+			if err == errNoSlots && renderer == nil {
+				// Slots are freed by nodes going down, retry on the next event
+				if !noSlots {
+					log.Printf("Backend %s: %s, waiting for nodes to go down", cfg.Backend, err)
+					noSlots = true
+				}
+				continue
+			}
+			if err == errNoSlots {
+				log.Printf("Backend %s: %s, falling back to reload", cfg.Backend, err)
+				err = fallback(renderer, full, cfg.Fallback.Reload, reloadTimeout)
+				b.resync = true // Servers changed by reload
+			}
+			if err != nil {
+				log.Printf("Backend %s: Update failed: %s", cfg.Backend, err)
+				b.resync = true
+				retryCh = time.After(retry)
+				continue
+			}
+			noSlots = false
+		}
+	}), nil
+}
+
+// fallback renders the configuration and reloads HAProxy if it changed.
+func fallback(renderer *tmpl.Renderer, full pipe.Event, reload []string, timeout time.Duration) error {
+	changed, err := renderer.Update(full)
+	if err != nil || !changed {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, reload[0], reload[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Reload %q failed: %s: %s", reload, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// backend assigns nodes to a pool of pre-provisioned server slots of a HAProxy backend.
+type backend struct {
+	client    *Client
+	name      string
+	prefix    string
+	weightKey string
+	weight    int
+	resync    bool               // Read servers state before next sync
+	slots     map[string]*Server // Server name to last known state
+	assigned  map[string]string  // Node name to server name
+}
+
+// load reads the servers state and assigns servers in use to the nodes matching their address.
+// Servers in use by unknown nodes are put into maintenance.
+func (b *backend) load(full pipe.Event) error {
+	servers, err := b.client.ServersState(b.name)
+	if err != nil {
+		return err
+	}
+	b.slots = make(map[string]*Server)
+	b.assigned = make(map[string]string)
+	byAddr := make(map[string]string)
+	for _, node := range full {
+		byAddr[node.Host+":"+strconv.Itoa(int(node.Port))] = node.Name
+	}
+	for i := range servers {
+		srv := &servers[i]
+		if !strings.HasPrefix(srv.Name, b.prefix) {
+			continue
+		}
+		b.slots[srv.Name] = srv
+		if srv.Maint {
+			continue
+		}
+		addr := srv.Addr + ":" + strconv.Itoa(int(srv.Port))
+		if name, found := byAddr[addr]; found {
+			b.assigned[name] = srv.Name
+			delete(byAddr, addr)
+			continue
+		}
+		err := b.client.SetState(b.name, srv.Name, "maint")
+		if err != nil {
+			return err
+		}
+		srv.Maint = true
+	}
+	if len(b.slots) == 0 {
+		return fmt.Errorf("No servers with prefix %q found in backend", b.prefix)
+	}
+	return nil
+}
+
+// sync updates the servers to serve exactly the nodes in full.
+// Returns errNoSlots if some nodes could not be assigned to a server.
+func (b *backend) sync(full pipe.Event) error {
+	if b.resync {
+		err := b.load(full)
+		if err != nil {
+			return err
+		}
+		b.resync = false
+	}
+
+	for name, srvName := range b.assigned {
+		if _, found := full[name]; found {
+			continue
+		}
+		err := b.client.SetState(b.name, srvName, "maint")
+		if err != nil {
+			return err
+		}
+		b.slots[srvName].Maint = true
+		delete(b.assigned, name)
+	}
+
+	var names []string
+	for name := range full {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var noSlots bool
+	for _, name := range names {
+		node := full[name]
+		srvName, found := b.assigned[name]
+		if !found {
+			srvName, found = b.freeSlot()
+			if !found {
+				noSlots = true
+				continue
+			}
+			b.assigned[name] = srvName
+		}
+		srv := b.slots[srvName]
+		if srv.Addr != node.Host || srv.Port != node.Port {
+			err := b.client.SetAddr(b.name, srvName, node.Host, node.Port)
+			if err != nil {
+				return err
+			}
+			srv.Addr, srv.Port = node.Host, node.Port
+		}
+		if weight := b.weightOf(node); srv.Weight != weight {
+			err := b.client.SetWeight(b.name, srvName, weight)
+			if err != nil {
+				return err
+			}
+			srv.Weight = weight
+		}
+		if srv.Maint {
+			err := b.client.SetState(b.name, srvName, "ready")
+			if err != nil {
+				return err
+			}
+			srv.Maint = false
+		}
+	}
+	if noSlots {
+		return errNoSlots
+	}
+	return nil
+}
+
+// freeSlot returns the first server by name not assigned to a node.
+func (b *backend) freeSlot() (string, bool) {
+	used := make(map[string]struct{})
+	for _, srvName := range b.assigned {
+		used[srvName] = struct{}{}
+	}
+	var free []string
+	for srvName := range b.slots {
+		if _, found := used[srvName]; !found {
+			free = append(free, srvName)
+		}
+	}
+	if len(free) == 0 {
+		return "", false
+	}
+	sort.Strings(free)
+	return free[0], true
+}
+
+// weightOf returns the weight of the node from its metadata or the default weight.
+func (b *backend) weightOf(node pipe.NodeInfo) int {
+	if v, found := node.Meta[b.weightKey]; found {
+		if weight, err := strconv.Atoi(v); err == nil {
+			return weight
+		}
+	}
+	return b.weight
+}
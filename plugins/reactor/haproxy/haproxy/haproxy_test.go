@@ -0,0 +1,284 @@
+package haproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHAProxy speaks the runtime api on a unix socket, one command per connection.
+type fakeHAProxy struct {
+	mutex    sync.Mutex
+	servers  map[string]*Server
+	commands []string
+	reads    int // Servers state requests
+}
+
+func (f *fakeHAProxy) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		fmt.Fprint(conn, f.handle(strings.TrimSpace(line)))
+		conn.Close()
+	}
+}
+
+func (f *fakeHAProxy) handle(command string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	fields := strings.Fields(command)
+	if command == "show servers state web" {
+		f.reads++
+		var names []string
+		for name := range f.servers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		out := "1\n# be_id be_name srv_id srv_name srv_addr srv_op_state srv_admin_state srv_uweight srv_iweight srv_time_since_last_change srv_check_status srv_check_result srv_check_health srv_check_state srv_agent_state bk_f_forced_id srv_f_forced_id srv_fqdn srv_port srvrecord\n"
+		for i, name := range names {
+			srv := f.servers[name]
+			adminState := 0
+			if srv.Maint {
+				adminState = 1
+			}
+			out += fmt.Sprintf("3 web %d %s %s 2 %d %d 1 0 6 3 4 6 0 0 0 - %d -\n", i+1, name, srv.Addr, adminState, srv.Weight, srv.Port)
+		}
+		return out
+	}
+	if len(fields) < 4 || fields[0] != "set" || fields[1] != "server" || !strings.HasPrefix(fields[2], "web/") {
+		return "Unknown command.\n"
+	}
+	srv, found := f.servers[strings.TrimPrefix(fields[2], "web/")]
+	if !found {
+		return "No such server.\n"
+	}
+	f.commands = append(f.commands, command)
+	switch fields[3] {
+	case "addr":
+		srv.Addr = fields[4]
+		fmt.Sscan(fields[6], &srv.Port)
+		return "IP changed\n"
+	case "weight":
+		fmt.Sscan(fields[4], &srv.Weight)
+	case "state":
+		srv.Maint = fields[4] == "maint"
+	}
+	return "\n"
+}
+
+// takeCommands returns and resets the commands received.
+func (f *fakeHAProxy) takeCommands() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	commands := f.commands
+	f.commands = nil
+	return commands
+}
+
+// waitCommands waits until the expected commands were received.
+func waitCommands(t *testing.T, fake *fakeHAProxy, expected ...string) {
+	var commands []string
+	for i := 0; i < 500; i++ {
+		commands = append(commands, fake.takeCommands()...)
+		if len(commands) >= len(expected) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if strings.Join(commands, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected commands %q, got %q", expected, commands)
+	}
+}
+
+func TestFunc(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	socket := filepath.Join(tmpDir, "haproxy.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fake := &fakeHAProxy{servers: map[string]*Server{
+		"slot1":  {Addr: "0.0.0.0", Weight: 1, Maint: true},
+		"slot2":  {Addr: "0.0.0.0", Weight: 1, Maint: true},
+		"static": {Addr: "10.0.0.1", Port: 80, Weight: 1},
+	}}
+	go fake.serve(l)
+
+	dest := filepath.Join(tmpDir, "haproxy.cfg")
+	reloaded := filepath.Join(tmpDir, "reloaded")
+	react := &HAProxyReactor{}
+	if err := react.Setup(json.RawMessage(fmt.Sprintf(`{"socket":%q}`, socket))); err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	manHandle, eventCh := plugintest.StartReactor(t, react, fmt.Sprintf(`{
+  "backend": "web",
+  "slotPrefix": "slot",
+  "retry": "10ms",
+  "fallback": {
+    "template": "{{range .Nodes}}server {{.Name}} {{.Host}}:{{.Port}}\n{{end}}",
+    "dest": %q,
+    "reload": ["touch", %q]
+  }
+}`, dest, reloaded))
+
+	node := pipe.NewNodeInfo("Node1", pipe.NodeUp, "10.0.1.1", 8080)
+	node.Meta = map[string]string{"weight": "10"}
+	ev := pipe.NewEventWithNode("Node2", pipe.NodeUp, "10.0.1.2", 8080)
+	ev.AddNode(node)
+	eventCh <- ev
+	waitCommands(t, fake,
+		"set server web/slot1 addr 10.0.1.1 port 8080",
+		"set server web/slot1 weight 10",
+		"set server web/slot1 state ready",
+		"set server web/slot2 addr 10.0.1.2 port 8080",
+		"set server web/slot2 state ready",
+	)
+
+	// Freed slot is reused
+	eventCh <- pipe.NewEventWithNode("Node1", pipe.NodeDown, "10.0.1.1", 8080)
+	waitCommands(t, fake, "set server web/slot1 state maint")
+	eventCh <- pipe.NewEventWithNode("Node3", pipe.NodeUp, "10.0.1.3", 8080)
+	waitCommands(t, fake,
+		"set server web/slot1 addr 10.0.1.3 port 8080",
+		"set server web/slot1 weight 1",
+		"set server web/slot1 state ready",
+	)
+
+	// No slots left, fallback renders and reloads
+	eventCh <- pipe.NewEventWithNode("Node4", pipe.NodeUp, "10.0.1.4", 8080)
+	for i := 0; i < 500; i++ {
+		if _, err := os.Stat(reloaded); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	data, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("Fallback not rendered: %s", err)
+	}
+	if expected := "server Node2 10.0.1.2:8080\nserver Node3 10.0.1.3:8080\nserver Node4 10.0.1.4:8080\n"; string(data) != expected {
+		t.Errorf("Expected %q, got %q", expected, string(data))
+	}
+	if _, err := os.Stat(reloaded); err != nil {
+		t.Errorf("Expected reload: %s", err)
+	}
+
+	// Reloaded HAProxy has more slots, servers are assigned by address
+	fake.mutex.Lock()
+	fake.servers = map[string]*Server{
+		"slot1": {Addr: "10.0.1.2", Port: 8080, Weight: 1},
+		"slot2": {Addr: "10.0.1.3", Port: 8080, Weight: 1},
+		"slot3": {Addr: "10.0.1.4", Port: 8080, Weight: 1},
+		"slot4": {Addr: "10.0.1.9", Port: 8080, Weight: 1}, // Unknown node
+	}
+	fake.mutex.Unlock()
+	eventCh <- pipe.NewEventWithNode("Node2", pipe.NodeDown, "10.0.1.2", 8080)
+	waitCommands(t, fake,
+		"set server web/slot1 state maint",
+		"set server web/slot4 state maint",
+	)
+
+	close(eventCh)
+	if err := manHandle.WaitTimeout(5 * time.Second); err != nil {
+		t.Errorf("Stop handle timeout: %s", err)
+	}
+}
+
+func TestNoSlots(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	socket := filepath.Join(tmpDir, "haproxy.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fake := &fakeHAProxy{servers: map[string]*Server{
+		"slot1": {Addr: "0.0.0.0", Weight: 1, Maint: true},
+	}}
+	go fake.serve(l)
+
+	react := &HAProxyReactor{}
+	manHandle, eventCh := plugintest.StartReactor(t, react, fmt.Sprintf(`{"socket":%q,"backend":"web","slotPrefix":"slot","retry":"10ms"}`, socket))
+
+	ev := pipe.NewEventWithNode("Node1", pipe.NodeUp, "10.0.1.1", 8080)
+	ev.AddNewNode("Node2", pipe.NodeUp, "10.0.1.2", 8080)
+	eventCh <- ev
+	waitCommands(t, fake,
+		"set server web/slot1 addr 10.0.1.1 port 8080",
+		"set server web/slot1 state ready",
+	)
+
+	// Without fallback there is no retry until the next event
+	time.Sleep(100 * time.Millisecond)
+	fake.mutex.Lock()
+	reads := fake.reads
+	fake.mutex.Unlock()
+	if reads != 1 {
+		t.Errorf("Expected servers state to be read once, got %d", reads)
+	}
+	eventCh <- pipe.NewEventWithNode("Node1", pipe.NodeDown, "10.0.1.1", 8080)
+	waitCommands(t, fake,
+		"set server web/slot1 state maint",
+		"set server web/slot1 addr 10.0.1.2 port 8080",
+		"set server web/slot1 state ready",
+	)
+
+	close(eventCh)
+	if err := manHandle.WaitTimeout(5 * time.Second); err != nil {
+		t.Errorf("Stop handle timeout: %s", err)
+	}
+}
+
+func TestAcceptInvalid(t *testing.T) {
+	for _, cfg := range []string{`{"slotPrefix":"slot"}`, `{"backend":"web"}`} {
+		if _, err := (&HAProxyReactor{}).Accept(json.RawMessage(cfg)); err == nil {
+			t.Errorf("Expected %s to be rejected", cfg)
+		}
+	}
+}
+
+func TestParseServersState(t *testing.T) {
+	servers, err := parseServersState(`1
+# be_id be_name srv_id srv_name srv_addr srv_op_state srv_admin_state srv_uweight srv_iweight srv_time_since_last_change srv_check_status srv_check_result srv_check_health srv_check_state srv_agent_state bk_f_forced_id srv_f_forced_id srv_fqdn srv_port srvrecord
+3 web 1 slot1 10.0.0.1 2 0 5 1 100 6 3 4 6 0 0 0 - 8080 -
+3 web 2 slot2 0.0.0.0 0 1 1 1 100 6 3 4 6 0 0 0 - 0 -
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 2 {
+		t.Fatalf("Expected 2 servers, got %v", servers)
+	}
+	if s := servers[0]; s.Name != "slot1" || s.Addr != "10.0.0.1" || s.Port != 8080 || s.Weight != 5 || s.Maint {
+		t.Errorf("Invalid server: %v", s)
+	}
+	if s := servers[1]; s.Name != "slot2" || !s.Maint {
+		t.Errorf("Invalid server: %v", s)
+	}
+	if _, err := parseServersState("No such backend.\n"); err == nil {
+		t.Error("Expected error for invalid state")
+	}
+}
@@ -0,0 +1,140 @@
+package haproxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Responses of the runtime api starting with these prefixes are errors.
+var errorPrefixes = []string{"no such", "unknown", "permission denied", "require", "invalid", "unexpected"}
+
+// Admin state flag of servers in maintenance
+const adminStateMaint = 0x01
+
+// Client sends commands to the runtime api of HAProxy.
+// Every command uses a new connection.
+type Client struct {
+	Network string // "unix" or "tcp"
+	Address string
+	Timeout time.Duration
+}
+
+// NewClient creates a client of the socket, addresses with prefix tcp:// use tcp, others are unix socket paths.
+func NewClient(socket string, timeout time.Duration) *Client {
+	if strings.HasPrefix(socket, "tcp://") {
+		return &Client{Network: "tcp", Address: strings.TrimPrefix(socket, "tcp://"), Timeout: timeout}
+	}
+	return &Client{Network: "unix", Address: socket, Timeout: timeout}
+}
+
+// Run sends a command and returns the response.
+func (c *Client) Run(command string) (string, error) {
+	conn, err := net.DialTimeout(c.Network, c.Address, c.Timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+	_, err = conn.Write([]byte(command + "\n"))
+	if err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	resp := strings.TrimSpace(string(b))
+	lower := strings.ToLower(resp)
+	for _, prefix := range errorPrefixes {
+		if strings.HasPrefix(lower, prefix) {
+			return "", fmt.Errorf("Command %q failed: %s", command, resp)
+		}
+	}
+	return resp, nil
+}
+
+// Server is the runtime state of a server in a backend.
+type Server struct {
+	Name   string
+	Addr   string
+	Port   uint16
+	Weight int
+	Maint  bool // Server is in maintenance mode
+}
+
+// ServersState returns the state of all servers of the backend.
+func (c *Client) ServersState(backend string) ([]Server, error) {
+	resp, err := c.Run("show servers state " + backend)
+	if err != nil {
+		return nil, err
+	}
+	return parseServersState(resp)
+}
+
+// parseServersState parses the output of "show servers state".
+// The first line is the format version, followed by a header naming the columns.
+func parseServersState(resp string) ([]Server, error) {
+	scanner := bufio.NewScanner(strings.NewReader(resp))
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "1" {
+		return nil, errors.New("Unsupported servers state format")
+	}
+	columns := make(map[string]int)
+	var servers []Server
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			for i, name := range strings.Fields(strings.TrimPrefix(line, "#")) {
+				columns[name] = i
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		field := func(name string) string {
+			if i, found := columns[name]; found && i < len(fields) {
+				return fields[i]
+			}
+			return ""
+		}
+		if field("srv_name") == "" {
+			return nil, errors.New("Invalid servers state, header missing")
+		}
+		port, _ := strconv.ParseUint(field("srv_port"), 10, 16)
+		weight, _ := strconv.Atoi(field("srv_uweight"))
+		adminState, _ := strconv.Atoi(field("srv_admin_state"))
+		servers = append(servers, Server{
+			Name:   field("srv_name"),
+			Addr:   field("srv_addr"),
+			Port:   uint16(port),
+			Weight: weight,
+			Maint:  adminState&adminStateMaint != 0,
+		})
+	}
+	return servers, scanner.Err()
+}
+
+// SetAddr changes address and port of a server.
+func (c *Client) SetAddr(backend string, server string, addr string, port uint16) error {
+	_, err := c.Run(fmt.Sprintf("set server %s/%s addr %s port %d", backend, server, addr, port))
+	return err
+}
+
+// SetWeight changes the weight of a server.
+func (c *Client) SetWeight(backend string, server string, weight int) error {
+	_, err := c.Run(fmt.Sprintf("set server %s/%s weight %d", backend, server, weight))
+	return err
+}
+
+// SetState changes the admin state of a server to ready, drain or maint.
+func (c *Client) SetState(backend string, server string, state string) error {
+	_, err := c.Run(fmt.Sprintf("set server %s/%s state %s", backend, server, state))
+	return err
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"github.com/blang/receptor/plugin"
+	"github.com/blang/receptor/plugins/reactor/haproxy/haproxy"
+)
+
+func main() {
+	plugin.ServeReactor(&haproxy.HAProxyReactor{})
+}
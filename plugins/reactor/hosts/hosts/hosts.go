@@ -0,0 +1,244 @@
+package hosts
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugins/reactor/template/tmpl"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultFile   = "/etc/hosts"
+	DefaultMarker = "receptor"
+)
+
+// HostsReactor maintains a marked block of entries in hosts files.
+// Lines outside of the block are never changed, services writing to the same file share the block.
+type HostsReactor struct {
+	mutex  sync.Mutex
+	File   string
+	Marker string           // Block is enclosed by "# BEGIN <marker>" and "# END <marker>"
+	files  map[string]*file // Files by name
+}
+
+type Config struct {
+	File   string `json:"file"`
+	Marker string `json:"marker"`
+}
+
+type ServiceConfig struct {
+	File   string `json:"file"`   // Overrides the global file
+	Suffix string `json:"suffix"` // Appended to node names, e.g. ".web.internal"
+}
+
+// Entry maps a hostname to an address.
+type Entry struct {
+	Addr string
+	Name string
+}
+
+// file holds the entries of all services writing to a file.
+type file struct {
+	name    string
+	entries map[int][]Entry // Endpoint id to entries
+	nextID  int
+}
+
+func (r *HostsReactor) Setup(cfgData json.RawMessage) error {
+	var conf Config
+	err := json.Unmarshal(cfgData, &conf)
+	if err != nil {
+		return err
+	}
+	r.File = conf.File
+	r.Marker = conf.Marker
+	return nil
+}
+
+func (r *HostsReactor) Accept(cfgData json.RawMessage) (pipe.Endpoint, error) {
+	var cfg ServiceConfig
+	err := json.Unmarshal(cfgData, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.File == "" {
+		cfg.File = r.File
+	}
+	if cfg.File == "" {
+		cfg.File = DefaultFile
+	}
+	if strings.ContainsAny(cfg.Suffix, " \t\n#") {
+		return nil, fmt.Errorf("Invalid suffix %q", cfg.Suffix)
+	}
+	marker := r.Marker
+	if marker == "" {
+		marker = DefaultMarker
+	}
+
+	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
+		f, id := r.register(cfg.File)
+		book := pipe.NewBook()
+		for {
+			select {
+			case ev, ok := <-eventCh:
+				if !ok {
+					return
+				}
+				if book.UpdateInc(ev) == nil {
+					continue
+				}
+				err := r.update(f, id, entries(book.Full(), cfg.Suffix), marker)
+				if err != nil {
+					log.Printf("Could not update %s: %s", cfg.File, err)
+				}
+			case <-closeCh:
+				// Entries are kept on shutdown, names stay resolvable until receptor is back
+				return
+			}
+		}
+	}), nil
+}
+
+// register adds an endpoint writing to the file and returns its id.
+func (r *HostsReactor) register(name string) (*file, int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.files == nil {
+		r.files = make(map[string]*file)
+	}
+	f, found := r.files[name]
+	if !found {
+		f = &file{
+			name:    name,
+			entries: make(map[int][]Entry),
+		}
+		r.files[name] = f
+	}
+	f.nextID++
+	return f, f.nextID
+}
+
+// update replaces the entries of an endpoint and rewrites the block of the file if changed.
+func (r *HostsReactor) update(f *file, id int, entries []Entry, marker string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	f.entries[id] = entries
+	all := []Entry{}
+	for _, entries := range f.entries {
+		all = append(all, entries...)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Name != all[j].Name {
+			return all[i].Name < all[j].Name
+		}
+		return all[i].Addr < all[j].Addr
+	})
+	lines := make([]string, len(all))
+	for i, entry := range all {
+		lines[i] = entry.Addr + "\t" + entry.Name
+	}
+
+	current, err := ioutil.ReadFile(f.name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	data, err := ReplaceBlock(current, marker, lines)
+	if err != nil {
+		return err
+	}
+	_, err = tmpl.WriteFile(f.name, data, tmpl.FileOptions{UID: -1, GID: -1})
+	return err
+}
+
+// entries creates an entry per node up, nodes without an ip address are skipped.
+func entries(ev pipe.Event, suffix string) []Entry {
+	var entries []Entry
+	for _, node := range ev {
+		ip := net.ParseIP(node.Host)
+		if ip == nil {
+			log.Printf("Skipping node %s, %q is not an ip address", node.Name, node.Host)
+			continue
+		}
+		if node.Name == "" || strings.ContainsAny(node.Name, " \t\n#") {
+			log.Printf("Skipping node %q, invalid hostname", node.Name)
+			continue
+		}
+		entries = append(entries, Entry{
+			Addr: ip.String(),
+			Name: node.Name + suffix,
+		})
+	}
+	return entries
+}
+
+// ReplaceBlock replaces the lines between "# BEGIN <marker>" and "# END <marker>" in data.
+// If there is no block, it's appended. All other lines are kept as is.
+func ReplaceBlock(data []byte, marker string, lines []string) ([]byte, error) {
+	begin := []byte("# BEGIN " + marker)
+	end := []byte("# END " + marker)
+
+	var before, after []byte
+	start := findLine(data, begin)
+	if start == -1 {
+		if findLine(data, end) != -1 {
+			return nil, errors.New("Block end found without begin")
+		}
+		before = data
+		if len(before) > 0 && before[len(before)-1] != '\n' {
+			before = append(before[:len(before):len(before)], '\n')
+		}
+	} else {
+		before = data[:start]
+		stop := findLine(data[start:], end)
+		if stop == -1 {
+			return nil, errors.New("Block begin found without end")
+		}
+		after = data[start+stop:]
+		if n := bytes.IndexByte(after, '\n'); n != -1 {
+			after = after[n+1:]
+		} else {
+			after = nil
+		}
+		if findLine(after, begin) != -1 {
+			return nil, errors.New("Multiple blocks found")
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Write(before)
+	buf.Write(begin)
+	buf.WriteByte('\n')
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	buf.Write(end)
+	buf.WriteByte('\n')
+	buf.Write(after)
+	return buf.Bytes(), nil
+}
+
+// findLine returns the offset of the first line equal to line, ignoring trailing whitespace, or -1.
+func findLine(data []byte, line []byte) int {
+	offset := 0
+	for offset < len(data) {
+		n := bytes.IndexByte(data[offset:], '\n')
+		if n == -1 {
+			n = len(data) - offset
+		}
+		if bytes.Equal(bytes.TrimRight(data[offset:offset+n], " \t\r"), line) {
+			return offset
+		}
+		offset += n + 1
+	}
+	return -1
+}
@@ -0,0 +1,94 @@
+package hosts
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFunc(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	hostsFile := filepath.Join(tmpDir, "hosts")
+	err = ioutil.WriteFile(hostsFile, []byte("127.0.0.1\tlocalhost\n::1\tlocalhost\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	react := &HostsReactor{}
+	if err := react.Setup(json.RawMessage(fmt.Sprintf(`{"file":%q}`, hostsFile))); err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	var handles []*pipe.ManagedEndpoint
+	var eventChs []chan pipe.Event
+	for _, cfg := range []string{`{"suffix":".web.internal"}`, `{"suffix":".db.internal"}`} {
+		manHandle, eventCh := plugintest.StartReactor(t, react, cfg)
+		handles = append(handles, manHandle)
+		eventChs = append(eventChs, eventCh)
+	}
+
+	ev := pipe.NewEvent()
+	ev.AddNewNode("web1", pipe.NodeUp, "10.0.0.1", 80)
+	ev.AddNewNode("web2", pipe.NodeUp, "fd00::2", 80)
+	ev.AddNewNode("web3", pipe.NodeUp, "web3.example.com", 80) // No ip, skipped
+	eventChs[0] <- ev
+	plugintest.WaitContent(t, hostsFile, "127.0.0.1\tlocalhost\n::1\tlocalhost\n"+
+		"# BEGIN receptor\n10.0.0.1\tweb1.web.internal\nfd00::2\tweb2.web.internal\n# END receptor\n")
+
+	// Lines around the block are kept
+	data, _ := ioutil.ReadFile(hostsFile)
+	data = append([]byte("# Static\n"), data...)
+	data = append(data, "10.1.0.1\tother\n"...)
+	if err := ioutil.WriteFile(hostsFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	eventChs[1] <- pipe.NewEventWithNode("db1", pipe.NodeUp, "10.0.1.1", 5432)
+	eventChs[0] <- pipe.NewEventWithNode("web1", pipe.NodeDown, "10.0.0.1", 80)
+	plugintest.WaitContent(t, hostsFile, "# Static\n127.0.0.1\tlocalhost\n::1\tlocalhost\n"+
+		"# BEGIN receptor\n10.0.1.1\tdb1.db.internal\nfd00::2\tweb2.web.internal\n# END receptor\n"+
+		"10.1.0.1\tother\n")
+
+	if fi, err := os.Stat(hostsFile); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode to be kept, got %v", fi.Mode())
+	}
+
+	for _, h := range handles {
+		plugintest.Stop(t, h)
+	}
+}
+
+func TestReplaceBlock(t *testing.T) {
+	lines := []string{"10.0.0.1\tnode1"}
+	tests := []struct {
+		data     string
+		expected string
+	}{
+		{"", "# BEGIN m\n10.0.0.1\tnode1\n# END m\n"},
+		{"a", "a\n# BEGIN m\n10.0.0.1\tnode1\n# END m\n"},
+		{"a\n# BEGIN m \nold\n# END m\r\nb\n", "a\n# BEGIN m\n10.0.0.1\tnode1\n# END m\nb\n"},
+		{"# BEGIN m\n# END m", "# BEGIN m\n10.0.0.1\tnode1\n# END m\n"},
+		{"# BEGIN mm\n", "# BEGIN mm\n# BEGIN m\n10.0.0.1\tnode1\n# END m\n"},
+	}
+	for _, test := range tests {
+		b, err := ReplaceBlock([]byte(test.data), "m", lines)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %s", test.data, err)
+		} else if string(b) != test.expected {
+			t.Errorf("Expected %q for %q, got %q", test.expected, test.data, b)
+		}
+	}
+
+	for _, data := range []string{"# BEGIN m\n", "# END m\n", "# BEGIN m\n# END m\n# BEGIN m\n# END m\n"} {
+		if _, err := ReplaceBlock([]byte(data), "m", lines); err == nil {
+			t.Errorf("Expected error for %q", data)
+		}
+	}
+}
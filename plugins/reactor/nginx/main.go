@@ -0,0 +1,10 @@
+package main
+
+import (
+	"github.com/blang/receptor/plugin"
+	"github.com/blang/receptor/plugins/reactor/nginx/nginx"
+)
+
+func main() {
+	plugin.ServeReactor(&nginx.NginxReactor{})
+}
@@ -0,0 +1,108 @@
+package nginx
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIClient manages servers of upstreams using the upstream api of nginx plus.
+type APIClient struct {
+	URL  string // Base url including the api version, e.g. http://127.0.0.1:8080/api/9
+	HTTP *http.Client
+}
+
+// APIServer is a server of an upstream.
+type APIServer struct {
+	ID     int    `json:"id,omitempty"`
+	Server string `json:"server"`
+	Weight int    `json:"weight,omitempty"`
+}
+
+type apiError struct {
+	Error struct {
+		Status int    `json:"status"`
+		Text   string `json:"text"`
+		Code   string `json:"code"`
+	} `json:"error"`
+}
+
+// NewAPIClient creates a client of the api at baseURL.
+func NewAPIClient(baseURL string, timeout time.Duration) *APIClient {
+	return &APIClient{
+		URL:  strings.TrimSuffix(baseURL, "/"),
+		HTTP: &http.Client{Timeout: timeout},
+	}
+}
+
+// Servers returns all servers of the upstream, kind is http or stream.
+func (c *APIClient) Servers(kind string, upstream string) ([]APIServer, error) {
+	var servers []APIServer
+	err := c.do("GET", c.path(kind, upstream), nil, &servers)
+	return servers, err
+}
+
+// AddServer adds a server to the upstream.
+func (c *APIClient) AddServer(kind string, upstream string, srv APIServer) error {
+	srv.ID = 0
+	return c.do("POST", c.path(kind, upstream), srv, nil)
+}
+
+// SetWeight changes the weight of the server.
+func (c *APIClient) SetWeight(kind string, upstream string, id int, weight int) error {
+	return c.do("PATCH", c.path(kind, upstream)+"/"+strconv.Itoa(id), map[string]int{"weight": weight}, nil)
+}
+
+// DeleteServer removes the server from the upstream.
+func (c *APIClient) DeleteServer(kind string, upstream string, id int) error {
+	return c.do("DELETE", c.path(kind, upstream)+"/"+strconv.Itoa(id), nil, nil)
+}
+
+func (c *APIClient) path(kind string, upstream string) string {
+	return c.URL + "/" + kind + "/upstreams/" + url.PathEscape(upstream) + "/servers"
+}
+
+// do sends the request with body encoded as json and decodes the response into v if not nil.
+func (c *APIClient) do(method string, endpoint string, body interface{}, v interface{}) error {
+	var b []byte
+	if body != nil {
+		var err error
+		b, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr apiError
+		if json.Unmarshal(b, &apiErr) == nil && apiErr.Error.Text != "" {
+			return fmt.Errorf("%s %s: %s (%s)", method, endpoint, apiErr.Error.Text, apiErr.Error.Code)
+		}
+		return fmt.Errorf("%s %s: %s", method, endpoint, resp.Status)
+	}
+	if v != nil {
+		return json.Unmarshal(b, v)
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+package nginx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugins/reactor/template/tmpl"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTemplate renders an upstream block of all nodes up.
+// Nginx does not accept empty upstreams, a server marked down is used if no node is up.
+const DefaultTemplate = `# Generated by receptor, do not edit
+upstream {{.Vars.upstream}} {
+{{- with .Vars.zone}}
+    zone {{$.Vars.upstream}} {{.}};
+{{- end}}
+{{- with .Vars.directives}}
+    {{.}}
+{{- end}}
+{{- range .Nodes}}
+    server {{hostPort .}}{{with index .Meta $.Vars.weightKey}} weight={{.}}{{end}};
+{{- else}}
+    server 127.0.0.1:65535 down; # No nodes up
+{{- end}}
+}
+`
+
+// NginxReactor updates nginx upstreams, either by rendering upstream blocks and reloading nginx
+// or by using the upstream api of nginx plus.
+type NginxReactor struct {
+	mutex          sync.Mutex // Serializes writing, checking and reloading
+	API            string
+	Timeout        time.Duration
+	Check          []string
+	Reload         []string
+	CommandTimeout time.Duration
+	configured     bool // Setup was called
+}
+
+type Config struct {
+	API            string   `json:"api"`            // Base url of the upstream api, enables api mode
+	Timeout        string   `json:"timeout"`        // Timeout of api requests
+	Check          []string `json:"check"`          // Command checking the configuration
+	Reload         []string `json:"reload"`         // Command reloading nginx
+	CommandTimeout string   `json:"commandTimeout"` // Maximum runtime of check and reload
+}
+
+type ServiceConfig struct {
+	Upstream   string   `json:"upstream"`
+	WeightKey  string   `json:"weightKey"` // Metadata key of the server weight
+	Retry      string   `json:"retry"`     // Delay before retrying after errors
+	API        string   `json:"api"`       // Overrides global api
+	Stream     bool     `json:"stream"`    // Upstream of the stream module instead of http
+	Check      []string `json:"check"`     // Overrides global check
+	Reload     []string `json:"reload"`    // Overrides global reload
+	Zone       string   `json:"zone"`      // Size of the shared memory zone of the upstream, e.g. 64k
+	Directives []string `json:"directives"`
+	tmpl.ServiceConfig
+}
+
+func (r *NginxReactor) Setup(cfgData json.RawMessage) error {
+	conf := Config{
+		Timeout:        "10s",
+		Check:          []string{"nginx", "-t", "-q"},
+		Reload:         []string{"nginx", "-s", "reload"},
+		CommandTimeout: "30s",
+	}
+	err := json.Unmarshal(cfgData, &conf)
+	if err != nil {
+		return err
+	}
+	r.Timeout, err = time.ParseDuration(conf.Timeout)
+	if err != nil {
+		return fmt.Errorf("Invalid timeout: %s", err)
+	}
+	if r.Timeout <= 0 {
+		return errors.New("Invalid timeout: Must be positive")
+	}
+	r.CommandTimeout, err = time.ParseDuration(conf.CommandTimeout)
+	if err != nil {
+		return fmt.Errorf("Invalid command timeout: %s", err)
+	}
+	if r.CommandTimeout <= 0 {
+		return errors.New("Invalid command timeout: Must be positive")
+	}
+	r.API = conf.API
+	r.Check = conf.Check
+	r.Reload = conf.Reload
+	r.configured = true
+	return nil
+}
+
+func (r *NginxReactor) Accept(cfgData json.RawMessage) (pipe.Endpoint, error) {
+	cfg := ServiceConfig{
+		WeightKey: "weight",
+		Retry:     "5s",
+		API:       r.API,
+		Check:     r.Check,
+		Reload:    r.Reload,
+	}
+	timeout, commandTimeout := r.Timeout, r.CommandTimeout
+	if !r.configured {
+		timeout, commandTimeout = 10*time.Second, 30*time.Second
+		cfg.Check = []string{"nginx", "-t", "-q"}
+		cfg.Reload = []string{"nginx", "-s", "reload"}
+	}
+	err := json.Unmarshal(cfgData, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Upstream == "" || strings.ContainsAny(cfg.Upstream, " \t\n;{}") {
+		return nil, fmt.Errorf("Invalid upstream %q", cfg.Upstream)
+	}
+	retry, err := time.ParseDuration(cfg.Retry)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid retry delay: %s", err)
+	}
+
+	var update func(full pipe.Event) error
+	if cfg.API != "" {
+		u := &apiUpstream{
+			client:    NewAPIClient(cfg.API, timeout),
+			kind:      "http",
+			name:      cfg.Upstream,
+			weightKey: cfg.WeightKey,
+		}
+		if cfg.Stream {
+			u.kind = "stream"
+		}
+		update = u.sync
+	} else {
+		update, err = r.fileSync(&cfg, commandTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
+		book := pipe.NewBook()
+		var retryCh <-chan time.Time
+		for {
+			select {
+			case ev, ok := <-eventCh:
+				if !ok {
+					return
+				}
+				book.UpdateInc(ev)
+			case <-retryCh:
+			case <-closeCh:
+				return
+			}
+			retryCh = nil
+
+			err := update(book.Full())
+			if err != nil {
+				log.Printf("Upstream %s: Update failed: %s", cfg.Upstream, err)
+				retryCh = time.After(retry)
+			}
+		}
+	}), nil
+}
+
+// fileSync creates the renderer of the upstream block and returns a function
+// writing the block, checking the configuration and reloading nginx.
+func (r *NginxReactor) fileSync(cfg *ServiceConfig, timeout time.Duration) (func(full pipe.Event) error, error) {
+	if cfg.Template == "" && cfg.TemplateFile == "" {
+		cfg.Template = DefaultTemplate
+	}
+	directives := make([]string, len(cfg.Directives))
+	for i, directive := range cfg.Directives {
+		directives[i] = strings.TrimSuffix(strings.TrimSpace(directive), ";") + ";"
+	}
+	vars := map[string]string{
+		"upstream":   cfg.Upstream,
+		"zone":       cfg.Zone,
+		"weightKey":  cfg.WeightKey,
+		"directives": strings.Join(directives, "\n    "),
+	}
+	for key, value := range cfg.Vars {
+		vars[key] = value
+	}
+	tmplCfg := cfg.ServiceConfig
+	tmplCfg.Vars = vars
+	tmplCfg.Check = nil // The configuration is checked after the file is in place
+	renderer, err := tmpl.NewRenderer(&tmplCfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Reload) == 0 {
+		return nil, errors.New("No reload command configured")
+	}
+
+	reloadPending := false // File changed but nginx not reloaded yet
+	return func(full pipe.Event) error {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		old, err := ioutil.ReadFile(cfg.Dest)
+		existed := err == nil
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		changed, err := renderer.Update(full)
+		if err != nil {
+			return err
+		}
+		if !changed && !reloadPending {
+			return nil
+		}
+		if changed && len(cfg.Check) > 0 {
+			err = run(cfg.Check, timeout)
+			if err != nil {
+				// Restore the previous file, nginx would fail on the next reload otherwise
+				if existed {
+					_, restoreErr := tmpl.WriteFile(cfg.Dest, old, tmpl.FileOptions{UID: -1, GID: -1})
+					if restoreErr != nil {
+						log.Printf("Could not restore %s: %s", cfg.Dest, restoreErr)
+					}
+				} else {
+					os.Remove(cfg.Dest)
+				}
+				return err
+			}
+		}
+		reloadPending = true
+		err = run(cfg.Reload, timeout)
+		if err != nil {
+			return err
+		}
+		reloadPending = false
+		log.Printf("Upstream %s: Updated %s and reloaded nginx", cfg.Upstream, cfg.Dest)
+		return nil
+	}, nil
+}
+
+// run runs the command, the output is returned as part of the error.
+func run(command []string, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, command[0], command[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Command %q failed: %s: %s", command, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// apiUpstream synchronizes the servers of an upstream using the api.
+type apiUpstream struct {
+	client    *APIClient
+	kind      string
+	name      string
+	weightKey string
+}
+
+// sync updates the servers of the upstream to match exactly the nodes in full.
+func (u *apiUpstream) sync(full pipe.Event) error {
+	servers, err := u.client.Servers(u.kind, u.name)
+	if err != nil {
+		return err
+	}
+	wanted := make(map[string]int) // Address to weight
+	for _, node := range full {
+		wanted[net.JoinHostPort(node.Host, strconv.Itoa(int(node.Port)))] = weightOf(node, u.weightKey)
+	}
+	for _, srv := range servers {
+		weight, found := wanted[srv.Server]
+		if !found {
+			err := u.client.DeleteServer(u.kind, u.name, srv.ID)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if srv.Weight != weight {
+			err := u.client.SetWeight(u.kind, u.name, srv.ID, weight)
+			if err != nil {
+				return err
+			}
+		}
+		delete(wanted, srv.Server) // Further servers of the same address are deleted
+	}
+	var addrs []string
+	for addr := range wanted {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		err := u.client.AddServer(u.kind, u.name, APIServer{Server: addr, Weight: wanted[addr]})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// weightOf returns the weight of the node from its metadata, nginx defaults to 1.
+func weightOf(node pipe.NodeInfo, weightKey string) int {
+	if v, found := node.Meta[weightKey]; found {
+		if weight, err := strconv.Atoi(v); err == nil && weight > 0 {
+			return weight
+		}
+	}
+	return 1
+}
@@ -0,0 +1,222 @@
+package nginx
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dest := filepath.Join(tmpDir, "upstream-web.conf")
+	reloadLog := filepath.Join(tmpDir, "reload.log")
+	reloads := func() int {
+		b, _ := ioutil.ReadFile(reloadLog)
+		return strings.Count(string(b), "\n")
+	}
+
+	react := &NginxReactor{}
+	err = react.Setup(json.RawMessage(fmt.Sprintf(`{"check":["sh","-c","! grep -q broken %s"],"reload":["sh","-c","echo reload >> %s"]}`, dest, reloadLog)))
+	if err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	manHandle, eventCh := plugintest.StartReactor(t, react, fmt.Sprintf(`{"upstream":"web","dest":%q,"zone":"64k","directives":["least_conn","keepalive 16;"],"retry":"1s"}`, dest))
+
+	node1 := pipe.NewNodeInfo("web1", pipe.NodeUp, "10.0.0.1", 80)
+	node1.Meta = map[string]string{"weight": "5"}
+	ev := pipe.NewEvent()
+	ev.AddNode(node1)
+	ev.AddNewNode("web2", pipe.NodeUp, "fd00::2", 81)
+	eventCh <- ev
+	expected := `# Generated by receptor, do not edit
+upstream web {
+    zone web 64k;
+    least_conn;
+    keepalive 16;
+    server 10.0.0.1:80 weight=5;
+    server [fd00::2]:81;
+}
+`
+	plugintest.WaitFor(t, func() bool { return reloads() == 1 }, "Expected reload")
+	if b, _ := ioutil.ReadFile(dest); string(b) != expected {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", expected, b)
+	}
+
+	// Failed check restores the file and does not reload
+	broken := pipe.NewNodeInfo("web3", pipe.NodeUp, "10.0.0.3", 80)
+	broken.Meta = map[string]string{"weight": "broken"}
+	ev = pipe.NewEvent()
+	ev.AddNode(broken)
+	eventCh <- ev
+	time.Sleep(200 * time.Millisecond) // Check of the first update failed, retry is pending
+	if b, _ := ioutil.ReadFile(dest); string(b) != expected || reloads() != 1 {
+		t.Fatalf("Expected file to be restored without reload, got %d reloads:\n%s", reloads(), b)
+	}
+
+	eventCh <- pipe.NewEventWithNode("web3", pipe.NodeDown, "10.0.0.3", 80)
+	ev = pipe.NewEvent()
+	ev.AddNewNode("web1", pipe.NodeDown, "10.0.0.1", 80)
+	ev.AddNewNode("web2", pipe.NodeDown, "fd00::2", 81)
+	eventCh <- ev
+	plugintest.WaitFor(t, func() bool { return reloads() == 2 }, "Expected reload")
+	if b, _ := ioutil.ReadFile(dest); !strings.Contains(string(b), "server 127.0.0.1:65535 down;") {
+		t.Errorf("Expected down server without nodes, got:\n%s", b)
+	}
+
+	plugintest.Stop(t, manHandle)
+}
+
+func TestReloadRetry(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dest := filepath.Join(tmpDir, "upstream-web.conf")
+	failed := filepath.Join(tmpDir, "failed")
+	reloaded := filepath.Join(tmpDir, "reloaded")
+
+	react := &NginxReactor{}
+	// First reload fails
+	reload := fmt.Sprintf("if [ -e %s ]; then touch %s; else touch %s; exit 1; fi", failed, reloaded, failed)
+	err = react.Setup(json.RawMessage(fmt.Sprintf(`{"check":[],"reload":["sh","-c",%q]}`, reload)))
+	if err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	manHandle, eventCh := plugintest.StartReactor(t, react, fmt.Sprintf(`{"upstream":"web","dest":%q,"retry":"50ms"}`, dest))
+	eventCh <- pipe.NewEventWithNode("web1", pipe.NodeUp, "10.0.0.1", 80)
+	plugintest.WaitFor(t, func() bool {
+		_, err := os.Stat(reloaded)
+		return err == nil
+	}, "Expected reload to be retried")
+
+	plugintest.Stop(t, manHandle)
+}
+
+func TestSetup(t *testing.T) {
+	react := &NginxReactor{}
+	for _, cfg := range []string{`{"timeout":"0s"}`, `{"commandTimeout":"-1s"}`} {
+		if err := react.Setup(json.RawMessage(cfg)); err == nil {
+			t.Errorf("Expected %s to be rejected", cfg)
+		}
+	}
+}
+
+// fakeAPI serves the upstream servers api of nginx plus.
+type fakeAPI struct {
+	mutex   sync.Mutex
+	servers map[int]APIServer
+	nextID  int
+	ops     []string
+}
+
+func (a *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	const prefix = "/api/9/stream/upstreams/db/servers"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error":{"status":404,"text":"upstream not found","code":"UpstreamNotFound"}}`)
+		return
+	}
+	id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, prefix+"/"))
+	var srv APIServer
+	json.NewDecoder(r.Body).Decode(&srv)
+	switch r.Method {
+	case "GET":
+		list := []APIServer{}
+		for _, srv := range a.servers {
+			list = append(list, srv)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+		json.NewEncoder(w).Encode(list)
+		return
+	case "POST":
+		srv.ID = a.nextID
+		a.nextID++
+		if srv.Weight == 0 {
+			srv.Weight = 1
+		}
+		a.servers[srv.ID] = srv
+		a.ops = append(a.ops, "add "+srv.Server+" "+strconv.Itoa(srv.Weight))
+		w.WriteHeader(http.StatusCreated)
+	case "PATCH":
+		s := a.servers[id]
+		s.Weight = srv.Weight
+		a.servers[id] = s
+		a.ops = append(a.ops, "weight "+s.Server+" "+strconv.Itoa(srv.Weight))
+	case "DELETE":
+		a.ops = append(a.ops, "delete "+a.servers[id].Server)
+		delete(a.servers, id)
+	}
+	fmt.Fprint(w, "{}")
+}
+
+func (a *fakeAPI) takeOps() []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	ops := a.ops
+	a.ops = nil
+	return ops
+}
+
+func TestAPI(t *testing.T) {
+	api := &fakeAPI{
+		servers: map[int]APIServer{0: {ID: 0, Server: "10.0.1.9:5432", Weight: 1}}, // Stale server
+		nextID:  1,
+	}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	react := &NginxReactor{}
+	manHandle, eventCh := plugintest.StartReactor(t, react, fmt.Sprintf(`{"upstream":"db","api":"%s/api/9","stream":true}`, server.URL))
+
+	node1 := pipe.NewNodeInfo("db1", pipe.NodeUp, "10.0.1.1", 5432)
+	node1.Meta = map[string]string{"weight": "3"}
+	ev := pipe.NewEvent()
+	ev.AddNode(node1)
+	ev.AddNewNode("db2", pipe.NodeUp, "10.0.1.2", 5432)
+	eventCh <- ev
+	var ops []string
+	plugintest.WaitFor(t, func() bool { ops = append(ops, api.takeOps()...); return len(ops) >= 3 }, "Expected api operations")
+	expected := []string{"delete 10.0.1.9:5432", "add 10.0.1.1:5432 3", "add 10.0.1.2:5432 1"}
+	if !reflect.DeepEqual(ops, expected) {
+		t.Fatalf("Expected %v, got %v", expected, ops)
+	}
+
+	node1.Meta["weight"] = "7"
+	ev = pipe.NewEvent()
+	ev.AddNode(node1)
+	ev.AddNewNode("db2", pipe.NodeDown, "10.0.1.2", 5432)
+	eventCh <- ev
+	ops = nil
+	plugintest.WaitFor(t, func() bool { ops = append(ops, api.takeOps()...); return len(ops) >= 2 }, "Expected api operations")
+	expected = []string{"weight 10.0.1.1:5432 7", "delete 10.0.1.2:5432"}
+	if !reflect.DeepEqual(ops, expected) {
+		t.Fatalf("Expected %v, got %v", expected, ops)
+	}
+
+	plugintest.Stop(t, manHandle)
+
+	client := NewAPIClient(server.URL+"/api/9/", time.Second)
+	if _, err := client.Servers("http", "unknown"); err == nil || !strings.Contains(err.Error(), "upstream not found") {
+		t.Errorf("Expected api error, got %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"github.com/blang/receptor/plugin"
+	"github.com/blang/receptor/plugins/reactor/syslog/syslogreact"
+)
+
+func main() {
+	plugin.ServeReactor(&syslogreact.SyslogReactor{})
+}
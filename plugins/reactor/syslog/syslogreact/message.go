@@ -0,0 +1,106 @@
+package syslogreact
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Facilities by name
+var Facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// Severities by name
+var Severities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3, "error": 3, "warning": 4, "warn": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// Message is a RFC5424 syslog message.
+type Message struct {
+	Facility int
+	Severity int
+	Time     time.Time
+	Hostname string
+	AppName  string
+	ProcID   string
+	MsgID    string
+	SDID     string      // Id of the structured data element
+	SDParams [][2]string // Name and value of structured data parameters
+	Text     string
+}
+
+// Format returns the message in RFC5424 format, empty header fields are written as nil value "-".
+func (m *Message) Format() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %s %s ", m.Facility*8+m.Severity, m.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		nilValue(m.Hostname), nilValue(m.AppName), nilValue(m.ProcID), nilValue(m.MsgID))
+	if m.SDID == "" {
+		b.WriteString("-")
+	} else {
+		b.WriteString("[" + m.SDID)
+		for _, param := range m.SDParams {
+			b.WriteString(" " + param[0] + `="` + escapeParamValue(param[1]) + `"`)
+		}
+		b.WriteString("]")
+	}
+	if m.Text != "" {
+		b.WriteString(" " + m.Text)
+	}
+	return b.String()
+}
+
+func nilValue(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// escapeParamValue escapes '"', '\' and ']' in structured data parameter values.
+func escapeParamValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
+
+// validName checks a header field or structured data name: printable ascii without space,
+// structured data names may not contain '=', ']' and '"' either.
+func validName(s string, maxLen int, sdName bool) bool {
+	if len(s) == 0 || len(s) > maxLen {
+		return false
+	}
+	for _, c := range []byte(s) {
+		if c < 33 || c > 126 || (sdName && (c == '=' || c == ']' || c == '"')) {
+			return false
+		}
+	}
+	return true
+}
+
+// parsePriority returns the facility and severity by name.
+func parsePriority(facility string, severity string) (int, int, error) {
+	f, found := Facilities[facility]
+	if !found {
+		return 0, 0, fmt.Errorf("Invalid facility %q", facility)
+	}
+	s, found := Severities[severity]
+	if !found {
+		return 0, 0, fmt.Errorf("Invalid severity %q", severity)
+	}
+	return f, s, nil
+}
+
+// frame returns the message framed for the transport:
+// octet counting on tcp (RFC6587), newline terminated on unix streams, unchanged for datagrams.
+func frame(network string, msg string) []byte {
+	switch network {
+	case "tcp":
+		return []byte(strconv.Itoa(len(msg)) + " " + msg)
+	case "unix":
+		return []byte(msg + "\n")
+	default:
+		return []byte(msg)
+	}
+}
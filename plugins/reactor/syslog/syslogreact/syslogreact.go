@@ -0,0 +1,302 @@
+package syslogreact
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// SyslogReactor ships node changes as RFC5424 messages to syslog.
+type SyslogReactor struct {
+	Network    string
+	Address    string
+	Hostname   string
+	AppName    string
+	Timeout    time.Duration
+	configured bool // Setup was called
+}
+
+type Config struct {
+	Network  string `json:"network"` // unix, unixgram, udp or tcp, empty tries unixgram and unix
+	Address  string `json:"address"`
+	Hostname string `json:"hostname"`
+	AppName  string `json:"appName"`
+	Timeout  string `json:"timeout"`
+}
+
+type ServiceConfig struct {
+	Network      string `json:"network"` // Overrides global network, requires address
+	Address      string `json:"address"` // Overrides global address
+	Service      string `json:"service"`
+	Facility     string `json:"facility"`
+	UpSeverity   string `json:"upSeverity"`
+	DownSeverity string `json:"downSeverity"`
+	MsgID        string `json:"msgID"`
+	SDID         string `json:"sdID"`      // Id of the structured data element
+	QueueSize    int    `json:"queueSize"` // Messages kept while syslog is unreachable, the oldest are dropped
+	Retry        string `json:"retry"`     // Delay before sending again after errors
+}
+
+func (r *SyslogReactor) Setup(cfgData json.RawMessage) error {
+	conf := Config{
+		Address: "/dev/log",
+		AppName: "receptor",
+		Timeout: "5s",
+	}
+	err := json.Unmarshal(cfgData, &conf)
+	if err != nil {
+		return err
+	}
+	r.Timeout, err = time.ParseDuration(conf.Timeout)
+	if err != nil {
+		return fmt.Errorf("Invalid timeout: %s", err)
+	}
+	if r.Timeout <= 0 {
+		return errors.New("Invalid timeout: Must be positive")
+	}
+	if conf.AppName != "" && !validName(conf.AppName, 48, false) {
+		return fmt.Errorf("Invalid app name %q", conf.AppName)
+	}
+	if conf.Hostname != "" && !validName(conf.Hostname, 255, false) {
+		return fmt.Errorf("Invalid hostname %q", conf.Hostname)
+	}
+	r.Network = conf.Network
+	r.Address = conf.Address
+	r.Hostname = conf.Hostname
+	r.AppName = conf.AppName
+	r.configured = true
+	return nil
+}
+
+func (r *SyslogReactor) Accept(cfgData json.RawMessage) (pipe.Endpoint, error) {
+	cfg := ServiceConfig{
+		Facility:     "daemon",
+		UpSeverity:   "info",
+		DownSeverity: "warning",
+		MsgID:        "NODE",
+		SDID:         "receptor@32473",
+		QueueSize:    1000,
+		Retry:        "5s",
+	}
+	network, address, appName, timeout := r.Network, r.Address, r.AppName, r.Timeout
+	if !r.configured {
+		address, appName, timeout = "/dev/log", "receptor", 5*time.Second
+	}
+	err := json.Unmarshal(cfgData, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.Network {
+	case "", "unix", "unixgram", "udp", "tcp":
+	default:
+		return nil, fmt.Errorf("Invalid network %q", cfg.Network)
+	}
+	if cfg.Network != "" && cfg.Address == "" {
+		// The global address belongs to the global network, e.g. /dev/log is no udp address
+		return nil, fmt.Errorf("Network %q configured without address", cfg.Network)
+	}
+	if cfg.Network == "" {
+		cfg.Network = network
+	}
+	if cfg.Address == "" {
+		cfg.Address = address
+	}
+	facility, upSeverity, err := parsePriority(cfg.Facility, cfg.UpSeverity)
+	if err != nil {
+		return nil, err
+	}
+	_, downSeverity, err := parsePriority(cfg.Facility, cfg.DownSeverity)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MsgID != "" && !validName(cfg.MsgID, 32, false) {
+		return nil, fmt.Errorf("Invalid msgID %q", cfg.MsgID)
+	}
+	if cfg.SDID != "" && !validName(cfg.SDID, 32, true) {
+		return nil, fmt.Errorf("Invalid sdID %q", cfg.SDID)
+	}
+	if cfg.QueueSize < 1 {
+		return nil, errors.New("Invalid queue size")
+	}
+	retry, err := time.ParseDuration(cfg.Retry)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid retry delay: %s", err)
+	}
+	hostname := r.Hostname
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	procID := strconv.Itoa(os.Getpid())
+
+	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
+		w := &writer{
+			network: cfg.Network,
+			address: cfg.Address,
+			timeout: timeout,
+		}
+		defer w.close()
+		q := &queue{size: cfg.QueueSize}
+		defer func() {
+			if len(q.messages) > 0 {
+				log.Printf("Syslog %s: Discarding %d unsent messages", cfg.Address, len(q.messages))
+			}
+		}()
+		var retryCh <-chan time.Time
+		for {
+			select {
+			case ev, ok := <-eventCh:
+				if !ok {
+					return
+				}
+				now := time.Now()
+				for _, node := range sortedNodes(ev) {
+					status, severity := "up", upSeverity
+					if node.Status == pipe.NodeDown {
+						status, severity = "down", downSeverity
+					}
+					port := strconv.Itoa(int(node.Port))
+					text := fmt.Sprintf("Node %s (%s) is %s", node.Name, net.JoinHostPort(node.Host, port), status)
+					msg := &Message{
+						Facility: facility,
+						Severity: severity,
+						Time:     now,
+						Hostname: hostname,
+						AppName:  appName,
+						ProcID:   procID,
+						MsgID:    cfg.MsgID,
+						SDID:     cfg.SDID,
+						SDParams: [][2]string{
+							{"node", node.Name},
+							{"host", node.Host},
+							{"port", port},
+							{"status", status},
+						},
+						Text: text,
+					}
+					if cfg.Service != "" {
+						msg.SDParams = append([][2]string{{"service", cfg.Service}}, msg.SDParams...)
+						msg.Text = "Service " + cfg.Service + ": " + text
+					}
+					if q.push(msg.Format()) == 1 {
+						log.Printf("Syslog %s: Queue full, dropping oldest messages", cfg.Address)
+					}
+				}
+			case <-retryCh:
+				retryCh = nil
+			case <-closeCh:
+				return
+			}
+			if retryCh != nil {
+				continue // Don't block on an unreachable syslog before the retry delay passed
+			}
+			dropped := q.dropped
+			err := q.send(w)
+			if err != nil {
+				log.Printf("Could not send to syslog %s, %d messages queued: %s", cfg.Address, len(q.messages), err)
+				retryCh = time.After(retry)
+			} else if dropped > 0 {
+				log.Printf("Syslog %s: Sent queued messages, %d messages were dropped", cfg.Address, dropped)
+			}
+		}
+	}), nil
+}
+
+// queue holds the messages not sent yet, the oldest are dropped if it is full.
+type queue struct {
+	messages []string
+	size     int
+	dropped  int // Messages dropped since the last time the queue was sent
+}
+
+// push appends a message and returns the number of messages dropped.
+func (q *queue) push(msg string) int {
+	if len(q.messages) >= q.size {
+		q.messages = q.messages[1:]
+		q.dropped++
+	}
+	q.messages = append(q.messages, msg)
+	return q.dropped
+}
+
+// send sends the queued messages in order until an error occurs.
+func (q *queue) send(w *writer) error {
+	for len(q.messages) > 0 {
+		err := w.write(q.messages[0])
+		if err != nil {
+			return err
+		}
+		q.messages = q.messages[1:]
+	}
+	q.messages = nil
+	q.dropped = 0
+	return nil
+}
+
+// writer sends messages over a lazily established connection, reconnecting after errors.
+type writer struct {
+	network string
+	address string
+	timeout time.Duration
+	conn    net.Conn
+	netUsed string // Network of the established connection
+}
+
+func (w *writer) connect() error {
+	networks := []string{w.network}
+	if w.network == "" {
+		networks = []string{"unixgram", "unix"}
+	}
+	var err error
+	for _, network := range networks {
+		w.conn, err = net.DialTimeout(network, w.address, w.timeout)
+		if err == nil {
+			w.netUsed = network
+			return nil
+		}
+	}
+	return err
+}
+
+// write sends the message, it's retried once on a new connection if sending failed.
+func (w *writer) write(msg string) error {
+	var err error
+	for i := 0; i < 2; i++ {
+		if w.conn == nil {
+			err = w.connect()
+			if err != nil {
+				return err
+			}
+		}
+		w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+		_, err = w.conn.Write(frame(w.netUsed, msg))
+		if err == nil {
+			return nil
+		}
+		w.close()
+	}
+	return err
+}
+
+func (w *writer) close() {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+}
+
+// sortedNodes returns the nodes of the event sorted by name.
+func sortedNodes(ev pipe.Event) []pipe.NodeInfo {
+	nodes := make([]pipe.NodeInfo, 0, len(ev))
+	for _, node := range ev {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	return nodes
+}
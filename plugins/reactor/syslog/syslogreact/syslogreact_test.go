@@ -0,0 +1,217 @@
+package syslogreact
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readPacket reads a single datagram.
+func readPacket(t *testing.T, conn net.PacketConn) string {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("No message received: %s", err)
+	}
+	return string(buf[:n])
+}
+
+// readOctetCounted reads a single octet counted message.
+func readOctetCounted(t *testing.T, r *bufio.Reader) string {
+	length, err := r.ReadString(' ')
+	if err != nil {
+		t.Fatalf("No message received: %s", err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(length))
+	if err != nil {
+		t.Fatalf("Invalid length %q", length)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+var messageRegexp = regexp.MustCompile(`^<(\d+)>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}(Z|[+-]\d\d:\d\d) (\S+) (\S+) (\d+) (\S+) (\[.*\]) (.*)$`)
+
+// checkMessage checks priority, hostname, app name, msgid, structured data and text of a message.
+func checkMessage(t *testing.T, msg string, expected ...string) {
+	m := messageRegexp.FindStringSubmatch(msg)
+	if m == nil {
+		t.Fatalf("Invalid message %q", msg)
+	}
+	parts := []string{m[1], m[3], m[4], m[6], m[7], m[8]}
+	for i := range expected {
+		if parts[i] != expected[i] {
+			t.Errorf("Expected %q in %q, got %q", expected[i], msg, parts[i])
+		}
+	}
+}
+
+func TestUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	react := &SyslogReactor{}
+	err = react.Setup(json.RawMessage(fmt.Sprintf(`{"network":"udp","address":%q,"hostname":"host1"}`, conn.LocalAddr())))
+	if err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	manHandle, eventCh := plugintest.StartReactor(t, react, `{"service":"web","facility":"local3","downSeverity":"err"}`)
+
+	ev := pipe.NewEventWithNode("web1", pipe.NodeUp, "10.0.0.1", 80)
+	ev.AddNewNode("web2", pipe.NodeDown, "fd00::2", 80)
+	eventCh <- ev
+	checkMessage(t, readPacket(t, conn), "158", "host1", "receptor", "NODE",
+		`[receptor@32473 service="web" node="web1" host="10.0.0.1" port="80" status="up"]`, "Service web: Node web1 (10.0.0.1:80) is up")
+	checkMessage(t, readPacket(t, conn), "155", "host1", "receptor", "NODE",
+		`[receptor@32473 service="web" node="web2" host="fd00::2" port="80" status="down"]`, "Service web: Node web2 ([fd00::2]:80) is down")
+
+	plugintest.Stop(t, manHandle)
+}
+
+func TestTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	connCh := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			connCh <- conn
+		}
+	}()
+	accept := func() *bufio.Reader {
+		select {
+		case conn := <-connCh:
+			return bufio.NewReader(conn)
+		case <-time.After(5 * time.Second):
+			t.Fatal("No connection")
+		}
+		return nil
+	}
+
+	react := &SyslogReactor{}
+	manHandle, eventCh := plugintest.StartReactor(t, react, fmt.Sprintf(`{"network":"tcp","address":%q,"msgID":"AUDIT","sdID":"node@12345"}`, ln.Addr()))
+	eventCh <- pipe.NewEventWithNode("db1", pipe.NodeUp, "10.0.1.1", 5432)
+	r := accept()
+	hostname, _ := os.Hostname()
+	checkMessage(t, readOctetCounted(t, r), "30", hostname, "receptor", "AUDIT",
+		`[node@12345 node="db1" host="10.0.1.1" port="5432" status="up"]`, "Node db1 (10.0.1.1:5432) is up")
+	eventCh <- pipe.NewEventWithNode("db1", pipe.NodeDown, "10.0.1.1", 5432)
+	checkMessage(t, readOctetCounted(t, r), "28")
+
+	plugintest.Stop(t, manHandle)
+}
+
+func TestQueue(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close() // Syslog unreachable
+
+	react := &SyslogReactor{}
+	manHandle, eventCh := plugintest.StartReactor(t, react, fmt.Sprintf(`{"network":"tcp","address":%q,"queueSize":2,"retry":"50ms"}`, addr))
+	for _, name := range []string{"web1", "web2", "web3"} {
+		eventCh <- pipe.NewEventWithNode(name, pipe.NodeUp, "10.0.0.1", 80)
+	}
+
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("No connection: %s", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	// Oldest message dropped
+	for _, name := range []string{"web2", "web3"} {
+		if msg := readOctetCounted(t, r); !strings.Contains(msg, "Node "+name+" ") {
+			t.Errorf("Expected message of %s, got %q", name, msg)
+		}
+	}
+
+	plugintest.Stop(t, manHandle)
+}
+
+func TestUnixgram(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	socket := filepath.Join(tmpDir, "log")
+	conn, err := net.ListenPacket("unixgram", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	react := &SyslogReactor{}
+	if err := react.Setup(json.RawMessage(fmt.Sprintf(`{"address":%q}`, socket))); err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	manHandle, eventCh := plugintest.StartReactor(t, react, `{}`)
+	eventCh <- pipe.NewEventWithNode("web1", pipe.NodeUp, "10.0.0.1", 80)
+	checkMessage(t, readPacket(t, conn), "30")
+
+	plugintest.Stop(t, manHandle)
+}
+
+func TestAcceptInvalid(t *testing.T) {
+	for _, cfg := range []string{`{"facility":"nope"}`, `{"upSeverity":"loud"}`, `{"network":"http"}`, `{"network":"udp"}`, `{"sdID":"a b"}`, `{"msgID":"012345678901234567890123456789012"}`, `{"queueSize":0}`, `{"retry":"later"}`} {
+		if _, err := (&SyslogReactor{}).Accept(json.RawMessage(cfg)); err == nil {
+			t.Errorf("Expected %s to be rejected", cfg)
+		}
+	}
+}
+
+func TestSetupInvalid(t *testing.T) {
+	for _, cfg := range []string{`{"timeout":"0s"}`, `{"timeout":"-1s"}`, `{"appName":"a b"}`} {
+		if err := (&SyslogReactor{}).Setup(json.RawMessage(cfg)); err == nil {
+			t.Errorf("Expected %s to be rejected", cfg)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	msg := &Message{
+		Facility: 3,
+		Severity: 6,
+		Time:     time.Date(2016, 1, 2, 15, 4, 5, 123456000, time.UTC),
+		SDID:     "x@1",
+		SDParams: [][2]string{{"v", `a"b\c]d`}},
+	}
+	expected := `<30>1 2016-01-02T15:04:05.123456Z - - - - [x@1 v="a\"b\\c\]d"]`
+	if s := msg.Format(); s != expected {
+		t.Errorf("Expected %s, got %s", expected, s)
+	}
+}
@@ -0,0 +1,317 @@
+package tmpl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type TemplateReactor struct {
+}
+
+type ServiceConfig struct {
+	Template     string            `json:"template"`     // Inline template
+	TemplateFile string            `json:"templateFile"` // Template file, used if template is empty
+	Dest         string            `json:"dest"`
+	Mode         string            `json:"mode"`  // Octal file mode, defaults to mode of existing file or 0644
+	Owner        string            `json:"owner"` // user[:group], names or ids
+	Check        []string          `json:"check"` // Command to check the rendered file, $file is replaced by its path
+	CheckTimeout string            `json:"checkTimeout"`
+	Vars         map[string]string `json:"vars"` // Additional variables available in the template
+}
+
+// Funcs are available in all templates.
+var Funcs = template.FuncMap{
+	// hostPort joins host and port of a node, ipv6 addresses are enclosed in brackets
+	"hostPort": func(node pipe.NodeInfo) string {
+		return net.JoinHostPort(node.Host, strconv.Itoa(int(node.Port)))
+	},
+}
+
+// Data is passed to templates.
+type Data struct {
+	Nodes []pipe.NodeInfo // Nodes up sorted by name
+	Vars  map[string]string
+}
+
+// NewData creates template data of all nodes up.
+func NewData(ev pipe.Event, vars map[string]string) *Data {
+	data := &Data{
+		Vars: vars,
+	}
+	for _, node := range ev {
+		if node.Status == pipe.NodeUp {
+			data.Nodes = append(data.Nodes, node)
+		}
+	}
+	sort.Slice(data.Nodes, func(i, j int) bool { return data.Nodes[i].Name < data.Nodes[j].Name })
+	return data
+}
+
+// FileOptions configures how a file is written.
+type FileOptions struct {
+	Mode         os.FileMode // Zero keeps mode of existing file or uses 0644
+	UID, GID     int         // -1 to keep
+	Check        []string
+	CheckTimeout time.Duration
+}
+
+func (r *TemplateReactor) Setup(_ json.RawMessage) error {
+	return nil
+}
+
+func (r *TemplateReactor) Accept(cfgData json.RawMessage) (pipe.Endpoint, error) {
+	cfg := ServiceConfig{
+		CheckTimeout: "30s",
+	}
+	err := json.Unmarshal(cfgData, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	renderer, err := NewRenderer(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
+		book := pipe.NewBook()
+		for {
+			select {
+			case ev, ok := <-eventCh:
+				if !ok {
+					return
+				}
+				book.UpdateInc(ev)
+				changed, err := renderer.Update(book.Full())
+				if err != nil {
+					log.Printf("Could not update %s: %s", cfg.Dest, err)
+				} else if changed {
+					log.Printf("Updated %s", cfg.Dest)
+				}
+			case <-closeCh:
+				return
+			}
+		}
+	}), nil
+}
+
+// Renderer renders nodes to a file, it's used by other reactors falling back to configuration files.
+type Renderer struct {
+	dest     string
+	template *template.Template
+	vars     map[string]string
+	opts     FileOptions
+}
+
+// NewRenderer parses the template and file options of the config.
+func NewRenderer(cfg *ServiceConfig) (*Renderer, error) {
+	if cfg.Dest == "" {
+		return nil, errors.New("No destination configured")
+	}
+	text := cfg.Template
+	if text == "" {
+		if cfg.TemplateFile == "" {
+			return nil, errors.New("No template configured")
+		}
+		b, err := ioutil.ReadFile(cfg.TemplateFile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(b)
+	}
+	t, err := template.New(filepath.Base(cfg.Dest)).Option("missingkey=zero").Funcs(Funcs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid template: %s", err)
+	}
+	opts, err := parseFileOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Renderer{
+		dest:     cfg.Dest,
+		template: t,
+		vars:     cfg.Vars,
+		opts:     opts,
+	}, nil
+}
+
+// Update renders all nodes up in ev and writes the file if the content changed.
+// Returns true if the file was changed.
+func (r *Renderer) Update(ev pipe.Event) (bool, error) {
+	b, err := Render(r.template, NewData(ev, r.vars))
+	if err != nil {
+		return false, err
+	}
+	return WriteFile(r.dest, b, r.opts)
+}
+
+// parseFileOptions parses mode, owner and check of the config.
+func parseFileOptions(cfg *ServiceConfig) (FileOptions, error) {
+	opts := FileOptions{
+		UID:   -1,
+		GID:   -1,
+		Check: cfg.Check,
+	}
+	if cfg.Mode != "" {
+		mode, err := strconv.ParseUint(cfg.Mode, 8, 32)
+		if err != nil {
+			return opts, fmt.Errorf("Invalid mode: %s", err)
+		}
+		opts.Mode = os.FileMode(mode)
+	}
+	if cfg.Owner != "" {
+		var err error
+		opts.UID, opts.GID, err = lookupOwner(cfg.Owner)
+		if err != nil {
+			return opts, err
+		}
+	}
+	if cfg.CheckTimeout != "" {
+		var err error
+		opts.CheckTimeout, err = time.ParseDuration(cfg.CheckTimeout)
+		if err != nil {
+			return opts, fmt.Errorf("Invalid check timeout: %s", err)
+		}
+	}
+	return opts, nil
+}
+
+// lookupOwner resolves user[:group] to ids, the group is -1 if not given.
+func lookupOwner(owner string) (int, int, error) {
+	parts := strings.SplitN(owner, ":", 2)
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		u, err := user.Lookup(parts[0])
+		if err != nil {
+			return 0, 0, fmt.Errorf("Invalid owner: %s", err)
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	gid := -1
+	if len(parts) == 2 {
+		gid, err = strconv.Atoi(parts[1])
+		if err != nil {
+			g, err := user.LookupGroup(parts[1])
+			if err != nil {
+				return 0, 0, fmt.Errorf("Invalid group: %s", err)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
+
+// Render executes the template with the data.
+func Render(t *template.Template, data interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := t.Execute(&buf, data)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteFile atomically replaces the file with data if the content differs.
+// The data is written to a temporary file in the same directory,
+// checked by the check command and renamed to filename.
+// Returns true if the file was changed.
+func WriteFile(filename string, data []byte, opts FileOptions) (bool, error) {
+	mode := opts.Mode
+	current, err := ioutil.ReadFile(filename)
+	if err == nil {
+		if bytes.Equal(current, data) {
+			return false, nil
+		}
+		if mode == 0 {
+			if fi, err := os.Stat(filename); err == nil {
+				mode = fi.Mode().Perm()
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	if mode == 0 {
+		mode = 0644
+	}
+
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return false, err
+	}
+	tmpName := f.Name()
+	defer os.Remove(tmpName) // Fails after successful rename
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	err = os.Chmod(tmpName, mode)
+	if err != nil {
+		return false, err
+	}
+	if opts.UID != -1 || opts.GID != -1 {
+		err = os.Chown(tmpName, opts.UID, opts.GID)
+		if err != nil {
+			return false, err
+		}
+	}
+	if len(opts.Check) > 0 {
+		err = runCheck(opts.Check, tmpName, opts.CheckTimeout)
+		if err != nil {
+			return false, err
+		}
+	}
+	err = os.Rename(tmpName, filename)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// runCheck runs the check command, $file in arguments is replaced by filename.
+func runCheck(check []string, filename string, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	args := make([]string, len(check))
+	for i, arg := range check {
+		args[i] = os.Expand(arg, func(key string) string {
+			if key == "file" {
+				return filename
+			}
+			return os.Getenv(key)
+		})
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Check %q failed: %s: %s", args, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package tmpl
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFunc(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dest := filepath.Join(tmpDir, "backends.cfg")
+
+	react := pipe.Reactor(&TemplateReactor{})
+	cfg := fmt.Sprintf(`{
+  "template": "# {{.Vars.name}}\n{{range .Nodes}}server {{.Name}} {{.Host}}:{{.Port}}{{with index .Meta \"weight\"}} weight {{.}}{{end}}\n{{end}}",
+  "dest": %q,
+  "mode": "0600",
+  "vars": {"name": "web"}
+}`, dest)
+	manHandle, eventCh := plugintest.StartReactor(t, react, cfg)
+
+	node := pipe.NewNodeInfo("Node2", pipe.NodeUp, "127.0.0.2", 81)
+	node.Meta = map[string]string{"weight": "10"}
+	ev := pipe.NewEventWithNode("Node1", pipe.NodeUp, "127.0.0.1", 80)
+	ev.AddNode(node)
+	eventCh <- ev
+	plugintest.WaitContent(t, dest, "# web\nserver Node1 127.0.0.1:80\nserver Node2 127.0.0.2:81 weight 10\n")
+	if fi, err := os.Stat(dest); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %v", fi.Mode())
+	}
+
+	eventCh <- pipe.NewEventWithNode("Node1", pipe.NodeDown, "127.0.0.1", 80)
+	plugintest.WaitContent(t, dest, "# web\nserver Node2 127.0.0.2:81 weight 10\n")
+
+	close(eventCh)
+	plugintest.Stop(t, manHandle)
+}
+
+func TestWriteFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dest := filepath.Join(tmpDir, "test.cfg")
+	opts := FileOptions{UID: -1, GID: -1}
+
+	changed, err := WriteFile(dest, []byte("a\n"), opts)
+	if err != nil || !changed {
+		t.Fatalf("Expected file to be written, changed %t: %s", changed, err)
+	}
+	if fi, err := os.Stat(dest); err != nil || fi.Mode().Perm() != 0644 {
+		t.Errorf("Expected default mode 0644, got %v", fi.Mode())
+	}
+
+	// Same content is not written again
+	changed, err = WriteFile(dest, []byte("a\n"), opts)
+	if err != nil || changed {
+		t.Errorf("Expected unchanged file, changed %t: %s", changed, err)
+	}
+
+	// Existing mode is kept
+	if err := os.Chmod(dest, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteFile(dest, []byte("b\n"), opts); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(dest); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("Expected mode 0640 to be kept, got %v", fi.Mode())
+	}
+
+	// Check sees the new content, failed check keeps old file
+	opts.Check = []string{"grep", "-q", "valid", "$file"}
+	changed, err = WriteFile(dest, []byte("invalid\n"), opts)
+	if err != nil || !changed {
+		t.Errorf("Expected file to be written, changed %t: %s", changed, err)
+	}
+	changed, err = WriteFile(dest, []byte("broken\n"), opts)
+	if err == nil || changed {
+		t.Errorf("Expected check to fail, changed %t", changed)
+	}
+	if data, _ := ioutil.ReadFile(dest); string(data) != "invalid\n" {
+		t.Errorf("Expected old content, got %q", string(data))
+	}
+
+	// No temporary files left
+	files, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("Expected only destination file, got %d files", len(files))
+	}
+}
+
+func TestAcceptInvalid(t *testing.T) {
+	react := &TemplateReactor{}
+	for _, cfg := range []string{
+		`{"template":"test"}`,
+		`{"dest":"/tmp/test.cfg"}`,
+		`{"dest":"/tmp/test.cfg","template":"{{.Nodes"}`,
+		`{"dest":"/tmp/test.cfg","template":"test","mode":"999"}`,
+		`{"dest":"/tmp/test.cfg","template":"test","owner":"nonexistent-user-receptor"}`,
+	} {
+		if _, err := react.Accept(json.RawMessage(cfg)); err == nil {
+			t.Errorf("Expected error for config %s", cfg)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"github.com/blang/receptor/plugin"
+	"github.com/blang/receptor/plugins/reactor/webhook/webhook"
+)
+
+func main() {
+	plugin.ServeReactor(&webhook.WebhookReactor{})
+}
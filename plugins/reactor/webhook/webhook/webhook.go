@@ -0,0 +1,374 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Payload types
+const (
+	PayloadEvent = "event" // Nodes changed by the event
+	PayloadFull  = "full"  // All nodes up
+)
+
+var errQueueFull = errors.New("Queue full")
+
+type WebhookReactor struct {
+}
+
+type ServiceConfig struct {
+	URLs            []string          `json:"urls"`
+	Headers         map[string]string `json:"headers"`
+	Secret          string            `json:"secret"` // Signs the body using HMAC-SHA256
+	SignatureHeader string            `json:"signatureHeader"`
+	Payload         string            `json:"payload"` // event or full
+	Timeout         string            `json:"timeout"`
+	Retries         int               `json:"retries"`
+	Backoff         string            `json:"backoff"`         // Delay before the first retry, doubled on every retry
+	MaxBackoff      string            `json:"maxBackoff"`      // Maximum delay between retries
+	QueueSize       int               `json:"queueSize"`       // Deliveries waiting per url
+	DeadLetter      string            `json:"deadLetter"`      // File logging failed deliveries as json lines
+	ShutdownTimeout string            `json:"shutdownTimeout"` // Time to deliver queued messages after the service stopped
+}
+
+// Message is the body posted to the urls.
+type Message struct {
+	Time  time.Time `json:"time"`
+	Type  string    `json:"type"`
+	Nodes []Node    `json:"nodes"`
+}
+
+type Node struct {
+	Name   string            `json:"name"`
+	Status string            `json:"status"` // "up" or "down"
+	Host   string            `json:"host"`
+	Port   uint16            `json:"port"`
+	Meta   map[string]string `json:"meta,omitempty"`
+}
+
+// DeadLetter is a single line of the dead-letter log.
+type DeadLetter struct {
+	Time    time.Time       `json:"time"`
+	URL     string          `json:"url"`
+	Error   string          `json:"error"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+func (r *WebhookReactor) Setup(_ json.RawMessage) error {
+	return nil
+}
+
+func (r *WebhookReactor) Accept(cfgData json.RawMessage) (pipe.Endpoint, error) {
+	cfg := ServiceConfig{
+		SignatureHeader: "X-Receptor-Signature",
+		Payload:         PayloadEvent,
+		Timeout:         "10s",
+		Retries:         5,
+		Backoff:         "1s",
+		MaxBackoff:      "1m",
+		QueueSize:       100,
+		ShutdownTimeout: "10s",
+	}
+	err := json.Unmarshal(cfgData, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.URLs) == 0 {
+		return nil, errors.New("No urls configured")
+	}
+	if cfg.Payload != PayloadEvent && cfg.Payload != PayloadFull {
+		return nil, fmt.Errorf("Invalid payload %q", cfg.Payload)
+	}
+	if cfg.QueueSize < 1 {
+		return nil, errors.New("Queue size needs to be at least 1")
+	}
+	d := &deliverer{
+		headers:         cfg.Headers,
+		secret:          []byte(cfg.Secret),
+		signatureHeader: cfg.SignatureHeader,
+		retries:         cfg.Retries,
+	}
+	timeout, err := time.ParseDuration(cfg.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid timeout: %s", err)
+	}
+	d.client = &http.Client{Timeout: timeout}
+	d.backoff, err = time.ParseDuration(cfg.Backoff)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid backoff: %s", err)
+	}
+	d.maxBackoff, err = time.ParseDuration(cfg.MaxBackoff)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid max backoff: %s", err)
+	}
+	shutdownTimeout, err := time.ParseDuration(cfg.ShutdownTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid shutdown timeout: %s", err)
+	}
+
+	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
+		d.deadLetter = log.Writer()
+		if cfg.DeadLetter != "" {
+			f, err := os.OpenFile(cfg.DeadLetter, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				log.Printf("Could not open dead-letter log, using receptor log: %s", err)
+			} else {
+				defer f.Close()
+				d.deadLetter = f
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		drainCh := make(chan struct{})
+		var wg sync.WaitGroup
+		queues := make([]*queue, len(cfg.URLs))
+		for i, url := range cfg.URLs {
+			queues[i] = newQueue(cfg.QueueSize)
+			wg.Add(1)
+			go func(url string, q *queue) {
+				defer wg.Done()
+				d.worker(ctx, drainCh, url, q)
+			}(url, queues[i])
+		}
+		defer func() {
+			// Deliver queued messages, undelivered messages are written to the dead-letter log after the timeout
+			close(drainCh)
+			doneCh := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(doneCh)
+			}()
+			select {
+			case <-doneCh:
+			case <-time.After(shutdownTimeout):
+			}
+			cancel()
+			<-doneCh
+		}()
+
+		book := pipe.NewBook()
+		for {
+			select {
+			case ev, ok := <-eventCh:
+				if !ok {
+					return
+				}
+				changed := book.UpdateInc(ev)
+				if changed == nil {
+					continue
+				}
+				msg := Message{
+					Time:  time.Now().UTC(),
+					Type:  cfg.Payload,
+					Nodes: toNodes(changed),
+				}
+				if cfg.Payload == PayloadFull {
+					msg.Nodes = toNodes(book.Full())
+				}
+				b, err := json.Marshal(msg)
+				if err != nil {
+					log.Printf("Could not marshal message: %s", err)
+					continue
+				}
+				for i, q := range queues {
+					if dropped := q.push(b); dropped != nil {
+						d.writeDeadLetter(cfg.URLs[i], dropped, errQueueFull)
+					}
+				}
+			case <-closeCh:
+				return
+			}
+		}
+	}), nil
+}
+
+// toNodes converts the event to a list of nodes sorted by name.
+func toNodes(ev pipe.Event) []Node {
+	nodes := []Node{}
+	for _, node := range ev {
+		status := "up"
+		if node.Status == pipe.NodeDown {
+			status = "down"
+		}
+		nodes = append(nodes, Node{
+			Name:   node.Name,
+			Status: status,
+			Host:   node.Host,
+			Port:   node.Port,
+			Meta:   node.Meta,
+		})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	return nodes
+}
+
+// queue is a bounded fifo queue of messages, dropping the oldest message if full.
+type queue struct {
+	mutex  sync.Mutex
+	items  [][]byte
+	size   int
+	signal chan struct{} // Signals new items
+}
+
+func newQueue(size int) *queue {
+	return &queue{
+		size:   size,
+		signal: make(chan struct{}, 1),
+	}
+}
+
+// push appends the message and returns the dropped message if the queue was full.
+func (q *queue) push(b []byte) []byte {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	var dropped []byte
+	if len(q.items) >= q.size {
+		dropped = q.items[0]
+		q.items = q.items[1:]
+	}
+	q.items = append(q.items, b)
+	select {
+	case q.signal <- struct{}{}:
+	default: // Already signaled
+	}
+	return dropped
+}
+
+// pop removes the oldest message, returns nil if empty.
+func (q *queue) pop() []byte {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.items) == 0 {
+		return nil
+	}
+	b := q.items[0]
+	q.items = q.items[1:]
+	return b
+}
+
+// deliverer posts messages to urls.
+type deliverer struct {
+	client          *http.Client
+	headers         map[string]string
+	secret          []byte
+	signatureHeader string
+	retries         int
+	backoff         time.Duration
+	maxBackoff      time.Duration
+	deadLetterMutex sync.Mutex
+	deadLetter      io.Writer
+}
+
+// worker delivers messages of the queue in order until the queue is empty after drainCh was closed
+// or ctx is done. Remaining messages are written to the dead-letter log.
+func (d *deliverer) worker(ctx context.Context, drainCh chan struct{}, url string, q *queue) {
+	for {
+		b := q.pop()
+		if b == nil {
+			select {
+			case <-q.signal:
+				continue
+			case <-drainCh:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+		err := d.deliver(ctx, url, b)
+		if err != nil {
+			d.writeDeadLetter(url, b, err)
+		}
+		if ctx.Err() != nil {
+			for b := q.pop(); b != nil; b = q.pop() {
+				d.writeDeadLetter(url, b, ctx.Err())
+			}
+			return
+		}
+	}
+}
+
+// deliver posts the message, retrying with exponential backoff.
+func (d *deliverer) deliver(ctx context.Context, url string, b []byte) error {
+	backoff := d.backoff
+	var err error
+	for try := 0; ; try++ {
+		err = d.post(ctx, url, b)
+		if err == nil || try >= d.retries {
+			return err
+		}
+		log.Printf("Webhook %s failed, retrying in %s: %s", url, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+		if backoff > d.maxBackoff {
+			backoff = d.maxBackoff
+		}
+	}
+}
+
+// post sends a single request, non-2xx responses are errors.
+func (d *deliverer) post(ctx context.Context, url string, b []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range d.headers {
+		req.Header.Set(key, value)
+	}
+	if len(d.secret) > 0 {
+		req.Header.Set(d.signatureHeader, Sign(d.secret, b))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the signature of the body as "sha256=<hex hmac>".
+func Sign(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *deliverer) writeDeadLetter(url string, b []byte, err error) {
+	line, marshalErr := json.Marshal(DeadLetter{
+		Time:    time.Now().UTC(),
+		URL:     url,
+		Error:   err.Error(),
+		Payload: b,
+	})
+	if marshalErr != nil {
+		log.Printf("Could not marshal dead letter: %s", marshalErr)
+		return
+	}
+	d.deadLetterMutex.Lock()
+	defer d.deadLetterMutex.Unlock()
+	d.deadLetter.Write(append(line, '\n'))
+}
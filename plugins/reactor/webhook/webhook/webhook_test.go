@@ -0,0 +1,209 @@
+package webhook
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeReceiver records messages and fails the first requests.
+type fakeReceiver struct {
+	mutex    sync.Mutex
+	failures int
+	requests int
+	messages []Message
+	headers  []http.Header
+}
+
+func (f *fakeReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.requests++
+	if f.failures != 0 {
+		f.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	b, _ := ioutil.ReadAll(r.Body)
+	if r.Header.Get("X-Receptor-Signature") != Sign([]byte("secret"), b) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var msg Message
+	json.Unmarshal(b, &msg)
+	f.messages = append(f.messages, msg)
+	f.headers = append(f.headers, r.Header)
+}
+
+func (f *fakeReceiver) waitMessages(t *testing.T, n int) []Message {
+	for i := 0; i < 500; i++ {
+		f.mutex.Lock()
+		messages := f.messages
+		f.mutex.Unlock()
+		if len(messages) >= n {
+			return messages
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d messages", n)
+	return nil
+}
+
+func readDeadLetters(t *testing.T, filename string) []DeadLetter {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var letters []DeadLetter
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var letter DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			t.Fatalf("Invalid dead letter %q: %s", scanner.Text(), err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters
+}
+
+func TestFunc(t *testing.T) {
+	events := &fakeReceiver{failures: 2}
+	eventServer := httptest.NewServer(events)
+	defer eventServer.Close()
+	full := &fakeReceiver{}
+	fullServer := httptest.NewServer(full)
+	defer fullServer.Close()
+
+	manHandle, eventCh := plugintest.StartReactor(t, &WebhookReactor{}, fmt.Sprintf(`{"urls":[%q],"secret":"secret","headers":{"X-Test":"1"},"backoff":"10ms"}`, eventServer.URL))
+	fullHandle, fullCh := plugintest.StartReactor(t, &WebhookReactor{}, fmt.Sprintf(`{"urls":[%q],"secret":"secret","payload":"full"}`, fullServer.URL))
+
+	for _, ch := range []chan pipe.Event{eventCh, fullCh} {
+		ch <- pipe.NewEventWithNode("Node1", pipe.NodeUp, "127.0.0.1", 80)
+		ch <- pipe.NewEventWithNode("Node2", pipe.NodeUp, "127.0.0.2", 81)
+		ch <- pipe.NewEventWithNode("Node1", pipe.NodeDown, "127.0.0.1", 80)
+	}
+
+	// Delivered in order after retries
+	messages := events.waitMessages(t, 3)
+	if events.headers[0].Get("X-Test") != "1" {
+		t.Errorf("Expected custom header, got %v", events.headers[0])
+	}
+	if events.requests != 5 {
+		t.Errorf("Expected 5 requests including retries, got %d", events.requests)
+	}
+	expected := []string{"Node1 up", "Node2 up", "Node1 down"}
+	for i, msg := range messages {
+		if msg.Type != PayloadEvent || len(msg.Nodes) != 1 || msg.Nodes[0].Name+" "+msg.Nodes[0].Status != expected[i] {
+			t.Errorf("Message %d: Expected %s, got %v", i, expected[i], msg)
+		}
+	}
+
+	messages = full.waitMessages(t, 3)
+	if msg := messages[2]; msg.Type != PayloadFull || len(msg.Nodes) != 1 || msg.Nodes[0].Name != "Node2" || msg.Nodes[0].Status != "up" {
+		t.Errorf("Expected full list of Node2, got %v", msg)
+	}
+
+	for _, h := range []*pipe.ManagedEndpoint{manHandle, fullHandle} {
+		plugintest.Stop(t, h)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	deadLetter := filepath.Join(tmpDir, "deadletter.log")
+
+	receiver := &fakeReceiver{failures: -1} // Always fails
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	// First message fails permanently
+	manHandle, eventCh := plugintest.StartReactor(t, &WebhookReactor{}, fmt.Sprintf(`{"urls":[%q],"retries":1,"backoff":"10ms","deadLetter":%q}`, server.URL, deadLetter))
+	eventCh <- pipe.NewEventWithNode("Node1", pipe.NodeUp, "127.0.0.1", 80)
+	for i := 0; i < 500; i++ {
+		if data, _ := ioutil.ReadFile(deadLetter); len(data) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	plugintest.Stop(t, manHandle)
+	letters := readDeadLetters(t, deadLetter)
+	if len(letters) != 1 || letters[0].URL != server.URL || letters[0].Error == "" {
+		t.Fatalf("Expected one dead letter, got %v", letters)
+	}
+	var msg Message
+	if err := json.Unmarshal(letters[0].Payload, &msg); err != nil || msg.Nodes[0].Name != "Node1" {
+		t.Errorf("Expected payload of Node1, got %s", letters[0].Payload)
+	}
+	if receiver.requests != 2 {
+		t.Errorf("Expected 2 requests, got %d", receiver.requests)
+	}
+
+	// Full queue drops oldest message, remaining messages are dead after the shutdown timeout
+	os.Remove(deadLetter)
+	manHandle, eventCh = plugintest.StartReactor(t, &WebhookReactor{}, fmt.Sprintf(`{"urls":[%q],"backoff":"1h","queueSize":1,"deadLetter":%q,"shutdownTimeout":"100ms"}`, server.URL, deadLetter))
+	eventCh <- pipe.NewEventWithNode("Node1", pipe.NodeUp, "127.0.0.1", 80) // Retried
+	time.Sleep(50 * time.Millisecond)
+	eventCh <- pipe.NewEventWithNode("Node2", pipe.NodeUp, "127.0.0.2", 80) // Dropped
+	eventCh <- pipe.NewEventWithNode("Node3", pipe.NodeUp, "127.0.0.3", 80) // Queued
+	plugintest.Stop(t, manHandle)
+	letters = readDeadLetters(t, deadLetter)
+	if len(letters) != 3 {
+		t.Fatalf("Expected 3 dead letters, got %v", letters)
+	}
+	expected := []string{"Node2 Queue full", "Node1", "Node3"}
+	for i, letter := range letters {
+		json.Unmarshal(letter.Payload, &msg)
+		name := msg.Nodes[0].Name
+		if i == 0 {
+			name += " " + letter.Error
+		}
+		if name != expected[i] {
+			t.Errorf("Dead letter %d: Expected %s, got %s: %s", i, expected[i], name, letter.Error)
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	deadLetter := filepath.Join(tmpDir, "deadletter.log")
+
+	receiver := &fakeReceiver{failures: 2}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	manHandle, eventCh := plugintest.StartReactor(t, &WebhookReactor{}, fmt.Sprintf(`{"urls":[%q],"secret":"secret","backoff":"50ms","deadLetter":%q}`, server.URL, deadLetter))
+	eventCh <- pipe.NewEventWithNode("Node1", pipe.NodeUp, "127.0.0.1", 80)
+	eventCh <- pipe.NewEventWithNode("Node2", pipe.NodeUp, "127.0.0.2", 80)
+	eventCh <- pipe.NewEventWithNode("Node3", pipe.NodeUp, "127.0.0.3", 80)
+
+	// Queued messages are delivered before the endpoint returns
+	plugintest.Stop(t, manHandle)
+	receiver.mutex.Lock()
+	delivered := len(receiver.messages)
+	receiver.mutex.Unlock()
+	if delivered != 3 {
+		t.Errorf("Expected 3 messages delivered on shutdown, got %d", delivered)
+	}
+	if data, _ := ioutil.ReadFile(deadLetter); len(data) > 0 {
+		t.Errorf("Expected no dead letters, got %s", data)
+	}
+}
@@ -0,0 +1,201 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ConsulWatcher struct {
+	Config Config
+}
+
+type Config struct {
+	Address    string `json:"address"`
+	Datacenter string `json:"datacenter"`
+	Token      string `json:"token"`
+}
+
+type ServiceConfig struct {
+	Service    string   `json:"service"`
+	Tags       []string `json:"tags"`       // Only instances having all tags
+	Datacenter string   `json:"datacenter"` // Overrides global datacenter
+	Token      string   `json:"token"`      // Overrides global token
+	Wait       string   `json:"wait"`       // Maximum duration of a blocking query
+	Retry      string   `json:"retry"`      // Delay before retrying after errors
+	TagsKey    string   `json:"tagsKey"`    // Metadata key of the tags, empty disables
+}
+
+// ServiceEntry is an entry of the health service endpoint.
+type ServiceEntry struct {
+	Node struct {
+		Node    string `json:"Node"`
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		ID      string            `json:"ID"`
+		Service string            `json:"Service"`
+		Tags    []string          `json:"Tags"`
+		Address string            `json:"Address"`
+		Port    uint16            `json:"Port"`
+		Meta    map[string]string `json:"Meta"`
+	} `json:"Service"`
+}
+
+func (w *ConsulWatcher) Setup(cfgData json.RawMessage) error {
+	conf := Config{
+		Address: "http://127.0.0.1:8500",
+	}
+	err := json.Unmarshal(cfgData, &conf)
+	if err != nil {
+		return err
+	}
+	w.Config = conf
+	return nil
+}
+
+func (w *ConsulWatcher) Accept(cfgData json.RawMessage) (pipe.Endpoint, error) {
+	conf := ServiceConfig{
+		Datacenter: w.Config.Datacenter,
+		Token:      w.Config.Token,
+		Wait:       "5m",
+		Retry:      "5s",
+		TagsKey:    "tags",
+	}
+	err := json.Unmarshal(cfgData, &conf)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Service == "" {
+		return nil, errors.New("No service configured")
+	}
+	wait, err := time.ParseDuration(conf.Wait)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid wait duration: %s", err)
+	}
+	retry, err := time.ParseDuration(conf.Retry)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid retry delay: %s", err)
+	}
+	address := w.Config.Address
+	if address == "" {
+		address = "http://127.0.0.1:8500"
+	}
+
+	query := url.Values{}
+	query.Set("passing", "1")
+	query.Set("wait", fmt.Sprintf("%ds", int(wait.Seconds())))
+	if conf.Datacenter != "" {
+		query.Set("dc", conf.Datacenter)
+	}
+	for _, tag := range conf.Tags {
+		query.Add("tag", tag)
+	}
+	client := &http.Client{
+		Timeout: wait + wait/16 + 10*time.Second, // Consul adds up to wait/16 jitter
+	}
+
+	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
+		incCh, fullCh := pipe.Bookkeeper(eventCh)
+		defer close(incCh)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-closeCh
+			cancel()
+		}()
+
+		var index uint64
+		for {
+			query.Set("index", strconv.FormatUint(index, 10))
+			entries, newIndex, err := healthService(ctx, client, address+"/v1/health/service/"+url.PathEscape(conf.Service)+"?"+query.Encode(), conf.Token)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("Query of service %s failed: %s", conf.Service, err)
+				select {
+				case <-time.After(retry):
+				case <-closeCh:
+					return
+				}
+				continue
+			}
+
+			// Reset index if it went backwards, e.g. after a restore
+			if newIndex < index {
+				index = 0
+			} else if newIndex < 1 {
+				index = 1
+			} else {
+				index = newIndex
+			}
+
+			select {
+			case fullCh <- entriesToEvent(entries, conf.TagsKey):
+			case <-closeCh:
+				return
+			}
+		}
+	}), nil
+}
+
+// healthService runs a blocking query and returns the entries and the index of the response.
+func healthService(ctx context.Context, client *http.Client, u string, token string) ([]ServiceEntry, uint64, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("Consul returned status %d", resp.StatusCode)
+	}
+	index, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Invalid index: %s", err)
+	}
+	var entries []ServiceEntry
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	if err != nil {
+		return nil, 0, err
+	}
+	return entries, index, nil
+}
+
+// entriesToEvent creates a full update of all service instances.
+// Service metadata and tags are converted into node metadata, service metadata takes precedence.
+func entriesToEvent(entries []ServiceEntry, tagsKey string) pipe.Event {
+	ev := pipe.NewEvent()
+	for _, entry := range entries {
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		node := pipe.NewNodeInfo(entry.Node.Node+"/"+entry.Service.ID, pipe.NodeUp, host, entry.Service.Port)
+		node.Meta = make(map[string]string)
+		for key, val := range entry.Service.Meta {
+			node.Meta[key] = val
+		}
+		if _, found := node.Meta[tagsKey]; tagsKey != "" && !found && len(entry.Service.Tags) > 0 {
+			node.Meta[tagsKey] = strings.Join(entry.Service.Tags, ",")
+		}
+		ev.AddNode(node)
+	}
+	return ev
+}
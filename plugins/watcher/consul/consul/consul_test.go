@@ -0,0 +1,125 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul serves blocking queries on the health service endpoint.
+type fakeConsul struct {
+	mutex    sync.Mutex
+	index    uint64
+	entries  string
+	changeCh chan struct{}
+	queries  []string
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/health/service/web" || r.Header.Get("X-Consul-Token") != "secret" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	c.mutex.Lock()
+	c.queries = append(c.queries, r.URL.RawQuery)
+	index := c.index
+	c.mutex.Unlock()
+
+	reqIndex, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	if reqIndex == index {
+		select {
+		case <-c.changeCh:
+		case <-time.After(100 * time.Millisecond): // Wait timed out
+		case <-r.Context().Done():
+			return
+		}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	fmt.Fprint(w, c.entries)
+}
+
+func (c *fakeConsul) update(entries string) {
+	c.mutex.Lock()
+	c.index++
+	c.entries = entries
+	c.mutex.Unlock()
+	c.changeCh <- struct{}{}
+}
+
+func entryJSON(node string, address string, port int, tags string) string {
+	return fmt.Sprintf(`{"Node":{"Node":%q,"Address":%q},
+"Service":{"ID":"web","Service":"web","Tags":%s,"Address":"","Port":%d,"Meta":{"version":"2"}}}`, node, address, tags, port)
+}
+
+func TestFunc(t *testing.T) {
+	fake := &fakeConsul{
+		index:    10,
+		entries:  "[" + entryJSON("node1", "10.0.0.1", 80, `["primary","v2"]`) + "]",
+		changeCh: make(chan struct{}),
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	watcher := &ConsulWatcher{}
+	err := watcher.Setup(json.RawMessage(fmt.Sprintf(`{"address":%q,"datacenter":"dc1"}`, server.URL)))
+	if err != nil {
+		t.Fatalf("Watcher setup failed: %s", err)
+	}
+	manHandle, eventCh := plugintest.StartWatcher(t, watcher, `{"service":"web","tags":["primary"],"token":"secret","wait":"1s"}`)
+
+	ev := plugintest.ReceiveEvent(t, eventCh)
+	if node, found := ev["node1/web"]; len(ev) != 1 || !found {
+		t.Fatalf("Expected node1/web, got %s", ev)
+	} else {
+		if node.Host != "10.0.0.1" || node.Port != 80 || node.Status != pipe.NodeUp {
+			t.Errorf("Invalid node: %s", node)
+		}
+		if node.Meta["tags"] != "primary,v2" || node.Meta["version"] != "2" {
+			t.Errorf("Invalid node metadata: %v", node.Meta)
+		}
+	}
+
+	fake.update("[" + entryJSON("node2", "10.0.0.2", 81, `["primary"]`) + "]")
+	ev = plugintest.ReceiveEvent(t, eventCh)
+	if len(ev) != 2 || ev["node1/web"].Status != pipe.NodeDown || ev["node2/web"].Status != pipe.NodeUp {
+		t.Fatalf("Expected node1 down and node2 up, got %s", ev)
+	}
+
+	plugintest.Stop(t, manHandle)
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if expected := "dc=dc1&index=0&passing=1&tag=primary&wait=1s"; fake.queries[0] != expected {
+		t.Errorf("Expected query %s, got %s", expected, fake.queries[0])
+	}
+	if expected := "dc=dc1&index=10&passing=1&tag=primary&wait=1s"; fake.queries[1] != expected {
+		t.Errorf("Expected query %s, got %s", expected, fake.queries[1])
+	}
+}
+
+func TestEntriesToEvent(t *testing.T) {
+	var entries []ServiceEntry
+	err := json.Unmarshal([]byte("["+entryJSON("node1", "10.0.0.1", 80, `["primary"]`)+"]"), &entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta := entriesToEvent(entries, "labels")["node1/web"].Meta; meta["labels"] != "primary" || meta["tags"] != "" {
+		t.Errorf("Expected tags in labels, got %v", meta)
+	}
+	if meta := entriesToEvent(entries, "")["node1/web"].Meta; len(meta) != 1 {
+		t.Errorf("Expected only service metadata, got %v", meta)
+	}
+	// Service metadata is not overwritten
+	if meta := entriesToEvent(entries, "version")["node1/web"].Meta; meta["version"] != "2" {
+		t.Errorf("Expected service metadata version, got %v", meta)
+	}
+}
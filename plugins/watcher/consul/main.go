@@ -0,0 +1,10 @@
+package main
+
+import (
+	"github.com/blang/receptor/plugin"
+	"github.com/blang/receptor/plugins/watcher/consul/consul"
+)
+
+func main() {
+	plugin.ServeWatcher(&consul.ConsulWatcher{})
+}
@@ -0,0 +1,356 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultSocket = "/var/run/docker.sock"
+
+type DockerWatcher struct {
+	Socket string
+}
+
+type Config struct {
+	Socket string `json:"socket"`
+}
+
+type ServiceConfig struct {
+	Labels         []string `json:"labels"`         // Label selectors "key" or "key=value"
+	Port           uint16   `json:"port"`           // Container port of the service
+	Mode           string   `json:"mode"`           // "published" or "ip"
+	Host           string   `json:"host"`           // Host used for ports published on all interfaces
+	Network        string   `json:"network"`        // Network used in ip mode
+	RequireHealthy bool     `json:"requireHealthy"` // Only containers with passing healthcheck are up
+	Reconnect      string   `json:"reconnect"`      // Delay before reconnecting the event stream
+}
+
+func (w *DockerWatcher) Setup(cfgData json.RawMessage) error {
+	conf := Config{
+		Socket: DefaultSocket,
+	}
+	err := json.Unmarshal(cfgData, &conf)
+	if err != nil {
+		return err
+	}
+	w.Socket = conf.Socket
+	return nil
+}
+
+func (w *DockerWatcher) Accept(cfgData json.RawMessage) (pipe.Endpoint, error) {
+	conf := ServiceConfig{
+		Mode:      "published",
+		Host:      "127.0.0.1",
+		Reconnect: "5s",
+	}
+	err := json.Unmarshal(cfgData, &conf)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Port == 0 {
+		return nil, errors.New("No container port configured")
+	}
+	if conf.Mode != "published" && conf.Mode != "ip" {
+		return nil, fmt.Errorf("Invalid mode %q", conf.Mode)
+	}
+	reconnect, err := time.ParseDuration(conf.Reconnect)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid reconnect delay: %s", err)
+	}
+	socket := w.Socket
+	if socket == "" {
+		socket = DefaultSocket
+	}
+	client := NewClient(socket)
+
+	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
+		incCh, fullCh := pipe.Bookkeeper(eventCh)
+		defer close(incCh)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-closeCh
+			cancel()
+		}()
+
+		for {
+			err := watch(ctx, client, &conf, incCh, fullCh)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Watching docker failed: %s", err)
+			select {
+			case <-time.After(reconnect):
+			case <-closeCh:
+				return
+			}
+		}
+	}), nil
+}
+
+// watch subscribes to container events, sends a full update of all matching containers
+// and sends incremental updates on changes until the event stream ends.
+func watch(ctx context.Context, client *Client, conf *ServiceConfig, incCh chan pipe.Event, fullCh chan pipe.Event) error {
+	// Subscribe first, changes between listing and subscribing would be lost otherwise
+	events, err := client.Events(ctx, conf.Labels)
+	if err != nil {
+		return err
+	}
+	defer events.Close()
+
+	containers, err := client.List(ctx, conf.Labels)
+	if err != nil {
+		return err
+	}
+	fullEv := pipe.NewEvent()
+	for _, container := range containers {
+		info, err := client.Inspect(ctx, container.ID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("Could not inspect container %s: %s", container.ID, err)
+			continue
+		}
+		if node, ok := containerNode(info, conf); ok && node.Status == pipe.NodeUp {
+			fullEv.AddNode(node)
+		}
+	}
+	select {
+	case fullCh <- fullEv:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	dec := json.NewDecoder(events)
+	for {
+		var msg EventMessage
+		err := dec.Decode(&msg)
+		if err != nil {
+			return err
+		}
+		var node pipe.NodeInfo
+		switch {
+		case msg.Action == "die":
+			node = pipe.NewNodeInfo(strings.TrimPrefix(msg.Actor.Attributes["name"], "/"), pipe.NodeDown, "", 0)
+		case msg.Action == "start" || strings.HasPrefix(msg.Action, "health_status"):
+			info, err := client.Inspect(ctx, msg.Actor.ID)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				// Container may be gone already, keep watching the others
+				log.Printf("Could not inspect container %s: %s", msg.Actor.ID, err)
+				continue
+			}
+			var ok bool
+			node, ok = containerNode(info, conf)
+			if !ok {
+				continue
+			}
+		default:
+			continue
+		}
+		ev := pipe.NewEvent()
+		ev.AddNode(node)
+		select {
+		case incCh <- ev:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// containerNode maps a container to a node.
+// Returns false if the container does not expose the configured port.
+func containerNode(info *ContainerInfo, conf *ServiceConfig) (pipe.NodeInfo, bool) {
+	name := strings.TrimPrefix(info.Name, "/")
+	var host string
+	var port uint16
+	switch conf.Mode {
+	case "published":
+		bindings := info.NetworkSettings.Ports[fmt.Sprintf("%d/tcp", conf.Port)]
+		if len(bindings) == 0 {
+			return pipe.NodeInfo{}, false
+		}
+		p, err := strconv.ParseUint(bindings[0].HostPort, 10, 16)
+		if err != nil {
+			return pipe.NodeInfo{}, false
+		}
+		host, port = bindings[0].HostIP, uint16(p)
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = conf.Host
+		}
+	case "ip":
+		host = info.NetworkSettings.IPAddress
+		if conf.Network != "" {
+			network, found := info.NetworkSettings.Networks[conf.Network]
+			if !found {
+				return pipe.NodeInfo{}, false
+			}
+			host = network.IPAddress
+		} else if host == "" {
+			// Map order is random, use the first network by name
+			var names []string
+			for name := range info.NetworkSettings.Networks {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if len(names) > 0 {
+				host = info.NetworkSettings.Networks[names[0]].IPAddress
+			}
+		}
+		if host == "" {
+			return pipe.NodeInfo{}, false
+		}
+		port = conf.Port
+	}
+
+	status := pipe.NodeDown
+	if info.State.Running {
+		status = pipe.NodeUp
+		if conf.RequireHealthy && info.State.Health != nil && info.State.Health.Status != "healthy" {
+			status = pipe.NodeDown
+		}
+	}
+	return pipe.NewNodeInfo(name, status, host, port), true
+}
+
+// Client is a minimal docker engine api client.
+type Client struct {
+	http *http.Client
+}
+
+// NewClient creates a client connecting to the docker api on the unix socket.
+func NewClient(socket string) *Client {
+	dialer := &net.Dialer{}
+	return &Client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+type Container struct {
+	ID string `json:"Id"`
+}
+
+type ContainerInfo struct {
+	ID    string `json:"Id"`
+	Name  string `json:"Name"`
+	State struct {
+		Running bool `json:"Running"`
+		Health  *struct {
+			Status string `json:"Status"`
+		} `json:"Health"`
+	} `json:"State"`
+	NetworkSettings struct {
+		IPAddress string `json:"IPAddress"`
+		Ports     map[string][]struct {
+			HostIP   string `json:"HostIp"`
+			HostPort string `json:"HostPort"`
+		} `json:"Ports"`
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+type EventMessage struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		ID         string            `json:"ID"`
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+}
+
+// List lists all running containers matching the labels.
+func (c *Client) List(ctx context.Context, labels []string) ([]Container, error) {
+	filters := map[string][]string{
+		"status": {"running"},
+	}
+	if len(labels) > 0 {
+		filters["label"] = labels
+	}
+	var containers []Container
+	err := c.getJSON(ctx, "/containers/json", filters, &containers)
+	return containers, err
+}
+
+// Inspect returns detailed information about a container.
+func (c *Client) Inspect(ctx context.Context, id string) (*ContainerInfo, error) {
+	var info ContainerInfo
+	err := c.getJSON(ctx, "/containers/"+url.PathEscape(id)+"/json", nil, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Events subscribes to start, die and health_status events of containers matching the labels.
+// The returned stream contains concatenated json event messages.
+func (c *Client) Events(ctx context.Context, labels []string) (io.ReadCloser, error) {
+	filters := map[string][]string{
+		"type":  {"container"},
+		"event": {"start", "die", "health_status"},
+	}
+	if len(labels) > 0 {
+		filters["label"] = labels
+	}
+	resp, err := c.get(ctx, "/events", filters)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, filters map[string][]string) (*http.Response, error) {
+	u := "http://docker" + path
+	if filters != nil {
+		b, err := json.Marshal(filters)
+		if err != nil {
+			return nil, err
+		}
+		u += "?filters=" + url.QueryEscape(string(b))
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Docker api %s returned status %d", path, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, filters map[string][]string, v interface{}) error {
+	resp, err := c.get(ctx, path, filters)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
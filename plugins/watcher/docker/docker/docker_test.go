@@ -0,0 +1,165 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDocker mimics the docker engine api on a unix socket.
+type fakeDocker struct {
+	mutex      sync.Mutex
+	containers map[string]string // id to inspect json, empty if removed after listing
+	eventsCh   chan string
+	filters    string
+}
+
+func (d *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	switch {
+	case r.URL.Path == "/containers/json":
+		d.filters = r.URL.Query().Get("filters")
+		var parts []string
+		for id := range d.containers {
+			parts = append(parts, fmt.Sprintf(`{"Id":%q}`, id))
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(parts, ","))
+	case r.URL.Path == "/events":
+		d.mutex.Unlock()
+		defer d.mutex.Lock()
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case ev := <-d.eventsCh:
+				fmt.Fprintln(w, ev)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	case strings.HasPrefix(r.URL.Path, "/containers/"):
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/containers/"), "/json")
+		info, found := d.containers[id]
+		if !found || info == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, info)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (d *fakeDocker) setContainer(id, info string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.containers[id] = info
+}
+
+func containerJSON(name string, running bool, health string, hostPort string) string {
+	healthJSON := "null"
+	if health != "" {
+		healthJSON = fmt.Sprintf(`{"Status":%q}`, health)
+	}
+	return fmt.Sprintf(`{"Id":"id-%s","Name":"/%s","State":{"Running":%t,"Health":%s},
+"NetworkSettings":{"IPAddress":"","Ports":{"80/tcp":[{"HostIp":"0.0.0.0","HostPort":%q}]},
+"Networks":{"backend":{"IPAddress":"172.18.0.2"}}}}`, name, name, running, healthJSON, hostPort)
+}
+
+func TestFunc(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	socket := filepath.Join(tmpDir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeDocker{
+		containers: map[string]string{
+			"id-web1": containerJSON("web1", true, "", "32768"),
+			"id-web2": containerJSON("web2", true, "starting", "32769"),
+			"id-gone": "", // Removed before inspection
+		},
+		eventsCh: make(chan string),
+	}
+	server := &http.Server{Handler: fake}
+	go server.Serve(listener)
+	defer server.Close()
+
+	watcher := &DockerWatcher{}
+	err = watcher.Setup(json.RawMessage(fmt.Sprintf(`{"socket":%q}`, socket)))
+	if err != nil {
+		t.Fatalf("Watcher setup failed: %s", err)
+	}
+	manHandle, eventCh := plugintest.StartWatcher(t, watcher, `{"labels":["app=web"],"port":80,"requireHealthy":true}`)
+
+	// Initial list, web2 is not healthy yet
+	ev := plugintest.ReceiveEvent(t, eventCh)
+	if node, found := ev["web1"]; len(ev) != 1 || !found {
+		t.Fatalf("Expected only web1, got %s", ev)
+	} else if node.Host != "127.0.0.1" || node.Port != 32768 || node.Status != pipe.NodeUp {
+		t.Errorf("Invalid node: %s", node)
+	}
+	if !strings.Contains(fake.filters, `"app=web"`) {
+		t.Errorf("Label filter not sent: %s", fake.filters)
+	}
+
+	// Removed container can't be inspected, the event is skipped
+	fake.eventsCh <- `{"Type":"container","Action":"start","Actor":{"ID":"id-gone","Attributes":{"name":"gone"}}}`
+	fake.setContainer("id-web2", containerJSON("web2", true, "healthy", "32769"))
+	fake.eventsCh <- `{"Type":"container","Action":"health_status: healthy","Actor":{"ID":"id-web2","Attributes":{"name":"web2"}}}`
+	ev = plugintest.ReceiveEvent(t, eventCh)
+	if node, found := ev["web2"]; len(ev) != 1 || !found || node.Status != pipe.NodeUp || node.Port != 32769 {
+		t.Fatalf("Expected web2 up, got %s", ev)
+	}
+
+	fake.eventsCh <- `{"Type":"container","Action":"die","Actor":{"ID":"id-web1","Attributes":{"name":"web1"}}}`
+	ev = plugintest.ReceiveEvent(t, eventCh)
+	if node, found := ev["web1"]; len(ev) != 1 || !found || node.Status != pipe.NodeDown {
+		t.Fatalf("Expected web1 down, got %s", ev)
+	}
+
+	plugintest.Stop(t, manHandle)
+}
+
+func TestContainerNodeIPMode(t *testing.T) {
+	var info ContainerInfo
+	err := json.Unmarshal([]byte(containerJSON("web1", true, "", "32768")), &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, ok := containerNode(&info, &ServiceConfig{Mode: "ip", Port: 8080, Network: "backend"})
+	if !ok {
+		t.Fatal("Container not mapped")
+	}
+	if node.Name != "web1" || node.Host != "172.18.0.2" || node.Port != 8080 || node.Status != pipe.NodeUp {
+		t.Errorf("Invalid node: %s", node)
+	}
+	if _, ok := containerNode(&info, &ServiceConfig{Mode: "ip", Port: 8080, Network: "frontend"}); ok {
+		t.Error("Container not in network should not be mapped")
+	}
+
+	// Without network the first network by name is used
+	backend := info.NetworkSettings.Networks["backend"]
+	info.NetworkSettings.Networks["a-frontend"] = backend
+	backend.IPAddress = "172.19.0.2"
+	info.NetworkSettings.Networks["backend"] = backend
+	for i := 0; i < 10; i++ {
+		if node, _ := containerNode(&info, &ServiceConfig{Mode: "ip", Port: 8080}); node.Host != "172.18.0.2" {
+			t.Fatalf("Expected address of first network, got %s", node.Host)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"github.com/blang/receptor/plugin"
+	"github.com/blang/receptor/plugins/watcher/docker/docker"
+)
+
+func main() {
+	plugin.ServeWatcher(&docker.DockerWatcher{})
+}
@@ -2,17 +2,68 @@ package dummy
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/blang/receptor/pipe"
+	"math/rand"
 	"time"
 )
 
 type DummyWatcher struct {
 }
 
+// DummyServiceCfg configures a scenario of timed steps.
+// Without steps a single node given by name, host and port toggles every 2 seconds.
 type DummyServiceCfg struct {
-	Name string `json:"name"`
-	Host string `json:"host"`
-	Port uint16 `json:"port"`
+	Name  string `json:"name"`
+	Host  string `json:"host"`
+	Port  uint16 `json:"port"`
+	Nodes []Node `json:"nodes"` // Nodes referenced by steps
+	Steps []Step `json:"steps"`
+	Loop  bool   `json:"loop"` // Restart scenario after the last step
+	Seed  int64  `json:"seed"` // Seed of random flaps, same seed results in same scenario
+}
+
+type Node struct {
+	Name string            `json:"name"`
+	Host string            `json:"host"`
+	Port uint16            `json:"port"`
+	Meta map[string]string `json:"meta"`
+}
+
+// Step waits and sends the nodes up and down as one event.
+// Steps without nodes only pause, nested steps are repeated.
+type Step struct {
+	Wait   string   `json:"wait"` // Delay before the step
+	Up     []string `json:"up"`
+	Down   []string `json:"down"`
+	Repeat int      `json:"repeat"` // Run nested steps n times (default: 1), -1 forever
+	Steps  []Step   `json:"steps"`
+	Flap   *Flap    `json:"flap"`
+}
+
+// Flap toggles randomly chosen nodes after a random delay between min and max.
+type Flap struct {
+	Nodes []string `json:"nodes"`
+	Count int      `json:"count"`
+	Min   string   `json:"min"`
+	Max   string   `json:"max"`
+}
+
+// step is a parsed and validated Step
+type step struct {
+	wait   time.Duration
+	up     []string
+	down   []string
+	repeat int
+	steps  []step
+	flap   *flap
+}
+
+type flap struct {
+	nodes    []string
+	count    int
+	min, max time.Duration
 }
 
 func (w *DummyWatcher) Setup(_ json.RawMessage) error {
@@ -29,23 +80,223 @@ func (w *DummyWatcher) Accept(cfg json.RawMessage) (pipe.Endpoint, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(serviceCfg.Steps) == 0 {
+		serviceCfg.Nodes = []Node{{Name: serviceCfg.Name, Host: serviceCfg.Host, Port: serviceCfg.Port}}
+		serviceCfg.Steps = []Step{
+			{Wait: "2s", Up: []string{serviceCfg.Name}},
+			{Wait: "2s", Down: []string{serviceCfg.Name}},
+		}
+		serviceCfg.Loop = true
+	}
+	nodes := make(map[string]Node)
+	for _, node := range serviceCfg.Nodes {
+		if node.Name == "" {
+			return nil, errors.New("Node without name")
+		}
+		nodes[node.Name] = node
+	}
+	steps, err := parseSteps(serviceCfg.Steps, nodes)
+	if err != nil {
+		return nil, err
+	}
+	if serviceCfg.Loop {
+		if totalWait(steps) <= 0 {
+			return nil, errors.New("Loop without wait")
+		}
+		steps = []step{{repeat: -1, steps: steps}}
+	}
+
 	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
-		status := true
-		upEv := pipe.NewEventWithNode(serviceCfg.Name, pipe.NodeUp, serviceCfg.Host, serviceCfg.Port)
-		downEv := pipe.NewEventWithNode(serviceCfg.Name, pipe.NodeDown, serviceCfg.Host, serviceCfg.Port)
-		for {
-			select {
-			case <-time.After(2 * time.Second):
-				if status {
-					eventCh <- upEv
-				} else {
-					eventCh <- downEv
+		defer close(eventCh)
+		r := &runner{
+			eventCh: eventCh,
+			closeCh: closeCh,
+			nodes:   nodes,
+			status:  make(map[string]pipe.NodeStatus),
+			rand:    rand.New(rand.NewSource(serviceCfg.Seed)),
+		}
+		if r.run(steps) {
+			<-closeCh // Scenario finished
+		}
+	}), nil
+}
+
+// parseSteps parses durations and checks all referenced nodes are known.
+func parseSteps(steps []Step, nodes map[string]Node) ([]step, error) {
+	var parsed []step
+	for i, s := range steps {
+		p := step{
+			up:     s.Up,
+			down:   s.Down,
+			repeat: s.Repeat,
+		}
+		var err error
+		if s.Wait != "" {
+			p.wait, err = time.ParseDuration(s.Wait)
+			if err != nil {
+				return nil, fmt.Errorf("Step %d: Invalid wait: %s", i, err)
+			}
+		}
+		names := append(append([]string{}, s.Up...), s.Down...)
+		if s.Flap != nil {
+			if len(s.Flap.Nodes) == 0 {
+				return nil, fmt.Errorf("Step %d: No nodes to flap", i)
+			}
+			p.flap = &flap{
+				nodes: s.Flap.Nodes,
+				count: s.Flap.Count,
+			}
+			p.flap.min, err = time.ParseDuration(s.Flap.Min)
+			if err != nil {
+				return nil, fmt.Errorf("Step %d: Invalid flap min: %s", i, err)
+			}
+			p.flap.max, err = time.ParseDuration(s.Flap.Max)
+			if err != nil {
+				return nil, fmt.Errorf("Step %d: Invalid flap max: %s", i, err)
+			}
+			if p.flap.max < p.flap.min {
+				return nil, fmt.Errorf("Step %d: Flap max smaller than min", i)
+			}
+			names = append(names, s.Flap.Nodes...)
+		}
+		for _, name := range names {
+			if _, found := nodes[name]; !found {
+				return nil, fmt.Errorf("Step %d: Unknown node %q", i, name)
+			}
+		}
+		if len(s.Steps) > 0 {
+			p.steps, err = parseSteps(s.Steps, nodes)
+			if err != nil {
+				return nil, fmt.Errorf("Step %d: %s", i, err)
+			}
+		}
+		if p.repeat < 0 && totalWait(p.steps) <= 0 {
+			return nil, fmt.Errorf("Step %d: Repeat forever without wait", i)
+		}
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
+
+// totalWait returns the minimum time a single run of the steps waits.
+func totalWait(steps []step) time.Duration {
+	var total time.Duration
+	for _, s := range steps {
+		total += s.wait
+		if s.flap != nil && s.flap.count > 0 {
+			total += s.flap.min * time.Duration(s.flap.count)
+		}
+		if s.repeat > 0 {
+			total += totalWait(s.steps) * time.Duration(s.repeat)
+		} else {
+			total += totalWait(s.steps)
+		}
+	}
+	return total
+}
+
+// runner plays a scenario.
+type runner struct {
+	eventCh chan pipe.Event
+	closeCh chan struct{}
+	nodes   map[string]Node
+	status  map[string]pipe.NodeStatus // Last status sent
+	rand    *rand.Rand
+}
+
+// run plays the steps, returns false if closed meanwhile.
+func (r *runner) run(steps []step) bool {
+	for _, s := range steps {
+		if !r.wait(s.wait) {
+			return false
+		}
+		if len(s.up) > 0 || len(s.down) > 0 {
+			ev := pipe.NewEvent()
+			for _, name := range s.up {
+				ev.AddNode(r.node(name, pipe.NodeUp))
+			}
+			for _, name := range s.down {
+				ev.AddNode(r.node(name, pipe.NodeDown))
+			}
+			if !r.send(ev) {
+				return false
+			}
+		}
+		if s.flap != nil && !r.flap(s.flap) {
+			return false
+		}
+		if len(s.steps) > 0 {
+			times := s.repeat
+			if times == 0 {
+				times = 1
+			}
+			for i := 0; times < 0 || i < times; i++ {
+				if !r.run(s.steps) {
+					return false
 				}
-				status = !status
-			case <-closeCh:
-				close(eventCh)
-				return
 			}
 		}
-	}), nil
+	}
+	return true
+}
+
+// flap toggles random nodes.
+func (r *runner) flap(f *flap) bool {
+	for i := 0; i < f.count; i++ {
+		delay := f.min
+		if f.max > f.min {
+			delay += time.Duration(r.rand.Int63n(int64(f.max - f.min)))
+		}
+		if !r.wait(delay) {
+			return false
+		}
+		name := f.nodes[r.rand.Intn(len(f.nodes))]
+		status := pipe.NodeUp
+		if r.status[name] == pipe.NodeUp {
+			status = pipe.NodeDown
+		}
+		ev := pipe.NewEvent()
+		ev.AddNode(r.node(name, status))
+		if !r.send(ev) {
+			return false
+		}
+	}
+	return true
+}
+
+// node creates the info of a known node and remembers its status.
+func (r *runner) node(name string, status pipe.NodeStatus) pipe.NodeInfo {
+	node := r.nodes[name]
+	info := pipe.NewNodeInfo(name, status, node.Host, node.Port)
+	if len(node.Meta) > 0 {
+		info.Meta = node.Meta
+	}
+	r.status[name] = status
+	return info
+}
+
+func (r *runner) wait(d time.Duration) bool {
+	if d <= 0 {
+		select {
+		case <-r.closeCh:
+			return false
+		default:
+			return true
+		}
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-r.closeCh:
+		return false
+	}
+}
+
+func (r *runner) send(ev pipe.Event) bool {
+	select {
+	case r.eventCh <- ev:
+		return true
+	case <-r.closeCh:
+		return false
+	}
 }
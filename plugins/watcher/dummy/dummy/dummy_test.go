@@ -0,0 +1,104 @@
+package dummy
+
+import (
+	"encoding/json"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
+	"testing"
+)
+
+const testScenario = `{
+  "nodes": [
+    {"name": "Node1", "host": "127.0.0.1", "port": 80},
+    {"name": "Node2", "host": "127.0.0.2", "port": 81, "meta": {"zone": "a"}}
+  ],
+  "seed": 42,
+  "steps": [
+    {"up": ["Node1", "Node2"]},
+    {"wait": "10ms"},
+    {"repeat": 2, "steps": [
+      {"wait": "1ms", "down": ["Node1"]},
+      {"wait": "1ms", "up": ["Node1"]}
+    ]},
+    {"flap": {"nodes": ["Node1", "Node2"], "count": 6, "min": "1ms", "max": "5ms"}}
+  ]
+}`
+
+// runScenario collects all events of the scenario.
+func runScenario(t *testing.T, cfg string, count int) []pipe.Event {
+	watcher := &DummyWatcher{}
+	manHandle, eventCh := plugintest.StartWatcher(t, watcher, cfg)
+
+	var events []pipe.Event
+	for i := 0; i < count; i++ {
+		events = append(events, plugintest.ReceiveEvent(t, eventCh))
+	}
+	plugintest.Stop(t, manHandle)
+	return events
+}
+
+func TestScenario(t *testing.T) {
+	events := runScenario(t, testScenario, 11)
+
+	if ev := events[0]; len(ev) != 2 || ev["Node1"].Status != pipe.NodeUp || ev["Node2"].Meta["zone"] != "a" {
+		t.Fatalf("Expected batch of Node1 and Node2 up, got %s", ev)
+	}
+	for i, status := range []pipe.NodeStatus{pipe.NodeDown, pipe.NodeUp, pipe.NodeDown, pipe.NodeUp} {
+		if node, found := events[i+1]["Node1"]; !found || node.Status != status {
+			t.Errorf("Event %d: Expected Node1 %s, got %s", i+1, status, events[i+1])
+		}
+	}
+
+	// Flaps toggle the last status
+	status := map[string]pipe.NodeStatus{"Node1": pipe.NodeUp, "Node2": pipe.NodeUp}
+	for _, ev := range events[5:] {
+		if len(ev) != 1 {
+			t.Fatalf("Expected single node flap, got %s", ev)
+		}
+		for name, node := range ev {
+			if node.Status == status[name] {
+				t.Errorf("Expected %s to toggle, got %s", name, node)
+			}
+			status[name] = node.Status
+		}
+	}
+
+	// Same seed, same scenario
+	again := runScenario(t, testScenario, 11)
+	for i := range events {
+		for name, node := range events[i] {
+			if !again[i][name].Equal(node) {
+				t.Errorf("Event %d differs with same seed: %s, %s", i, events[i], again[i])
+			}
+		}
+	}
+}
+
+func TestLoop(t *testing.T) {
+	events := runScenario(t, `{"nodes":[{"name":"Node1"}],"loop":true,"steps":[{"wait":"1ms","up":["Node1"]},{"wait":"1ms","down":["Node1"]}]}`, 5)
+	for i, ev := range events {
+		expected := pipe.NodeUp
+		if i%2 == 1 {
+			expected = pipe.NodeDown
+		}
+		if ev["Node1"].Status != expected {
+			t.Errorf("Event %d: Expected %s, got %s", i, expected, ev)
+		}
+	}
+}
+
+func TestAcceptInvalid(t *testing.T) {
+	watcher := &DummyWatcher{}
+	for _, cfg := range []string{
+		`{"steps":[{"up":["Unknown"]}]}`,
+		`{"nodes":[{"name":"Node1"}],"steps":[{"wait":"invalid","up":["Node1"]}]}`,
+		`{"nodes":[{"name":"Node1"}],"steps":[{"steps":[{"down":["Node2"]}]}]}`,
+		`{"nodes":[{"name":"Node1"}],"steps":[{"flap":{"nodes":["Node1"],"min":"2s","max":"1s"}}]}`,
+		`{"nodes":[{"name":"Node1"}],"loop":true,"steps":[{"up":["Node1"]},{"down":["Node1"]}]}`,
+		`{"nodes":[{"name":"Node1"}],"steps":[{"repeat":-1,"steps":[{"up":["Node1"]}]}]}`,
+	} {
+		if _, err := watcher.Accept(json.RawMessage(cfg)); err == nil {
+			t.Errorf("Expected error for config %s", cfg)
+		}
+	}
+}
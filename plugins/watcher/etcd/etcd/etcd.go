@@ -0,0 +1,276 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errCompacted = errors.New("Watched revision compacted")
+
+type EtcdWatcher struct {
+	Endpoint string
+}
+
+type Config struct {
+	Endpoint string `json:"endpoint"`
+}
+
+type ServiceConfig struct {
+	Prefix string `json:"prefix"`
+	Retry  string `json:"retry"` // Delay before retrying after errors
+}
+
+// Node is the json value of a key describing a node.
+type Node struct {
+	Name string            `json:"name"` // Defaults to the key without prefix
+	Host string            `json:"host"`
+	Port uint16            `json:"port"`
+	Meta map[string]string `json:"meta"`
+}
+
+// KeyValue is a key of the json gateway, all bytes are base64 encoded.
+type KeyValue struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value"`
+	ModRevision string `json:"mod_revision"`
+}
+
+type ResponseHeader struct {
+	Revision string `json:"revision"`
+}
+
+type RangeResponse struct {
+	Header ResponseHeader `json:"header"`
+	Kvs    []KeyValue     `json:"kvs"`
+}
+
+type WatchResponse struct {
+	Result *struct {
+		Header          ResponseHeader `json:"header"`
+		Created         bool           `json:"created"`
+		Canceled        bool           `json:"canceled"`
+		CompactRevision string         `json:"compact_revision"`
+		Events          []struct {
+			Type string   `json:"type"` // "PUT" is omitted as default value
+			Kv   KeyValue `json:"kv"`
+		} `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (w *EtcdWatcher) Setup(cfgData json.RawMessage) error {
+	conf := Config{
+		Endpoint: "http://127.0.0.1:2379",
+	}
+	err := json.Unmarshal(cfgData, &conf)
+	if err != nil {
+		return err
+	}
+	w.Endpoint = strings.TrimSuffix(conf.Endpoint, "/")
+	return nil
+}
+
+func (w *EtcdWatcher) Accept(cfgData json.RawMessage) (pipe.Endpoint, error) {
+	conf := ServiceConfig{
+		Retry: "5s",
+	}
+	err := json.Unmarshal(cfgData, &conf)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Prefix == "" {
+		return nil, errors.New("No prefix configured")
+	}
+	retry, err := time.ParseDuration(conf.Retry)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid retry delay: %s", err)
+	}
+	endpoint := w.Endpoint
+	if endpoint == "" {
+		endpoint = "http://127.0.0.1:2379"
+	}
+
+	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
+		incCh, fullCh := pipe.Bookkeeper(eventCh)
+		defer close(incCh)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-closeCh
+			cancel()
+		}()
+
+		for {
+			err := watch(ctx, endpoint, conf.Prefix, incCh, fullCh)
+			if ctx.Err() != nil {
+				return
+			}
+			if err == errCompacted {
+				continue // List again
+			}
+			log.Printf("Watching prefix %s failed: %s", conf.Prefix, err)
+			select {
+			case <-time.After(retry):
+			case <-closeCh:
+				return
+			}
+		}
+	}), nil
+}
+
+// watch reads all keys under the prefix and follows changes until an error occurs.
+func watch(ctx context.Context, endpoint string, prefix string, incCh chan pipe.Event, fullCh chan pipe.Event) error {
+	rangeEnd := prefixEnd([]byte(prefix))
+	var rangeResp RangeResponse
+	err := post(ctx, endpoint+"/v3/kv/range", map[string]interface{}{
+		"key":       []byte(prefix),
+		"range_end": rangeEnd,
+	}, func(resp *http.Response) error {
+		return json.NewDecoder(resp.Body).Decode(&rangeResp)
+	})
+	if err != nil {
+		return err
+	}
+	revision, err := strconv.ParseInt(rangeResp.Header.Revision, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid revision: %s", err)
+	}
+
+	nodes := make(map[string]pipe.NodeInfo) // Key to node
+	fullEv := pipe.NewEvent()
+	for _, kv := range rangeResp.Kvs {
+		node, err := parseNode(prefix, kv)
+		if err != nil {
+			log.Printf("Ignoring key %s: %s", kv.Key, err)
+			continue
+		}
+		nodes[string(kv.Key)] = node
+		fullEv.AddNode(node)
+	}
+	select {
+	case fullCh <- fullEv:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return post(ctx, endpoint+"/v3/watch", map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            []byte(prefix),
+			"range_end":      rangeEnd,
+			"start_revision": strconv.FormatInt(revision+1, 10),
+		},
+	}, func(resp *http.Response) error {
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var watchResp WatchResponse
+			err := dec.Decode(&watchResp)
+			if err != nil {
+				return err
+			}
+			if watchResp.Error != nil {
+				return fmt.Errorf("Watch error: %s", watchResp.Error.Message)
+			}
+			result := watchResp.Result
+			if result == nil {
+				continue
+			}
+			if result.CompactRevision != "" && result.CompactRevision != "0" {
+				return errCompacted
+			}
+			if result.Canceled {
+				return errors.New("Watch canceled")
+			}
+
+			ev := pipe.NewEvent()
+			for _, watchEv := range result.Events {
+				key := string(watchEv.Kv.Key)
+				old, found := nodes[key]
+				if found {
+					delete(nodes, key)
+					old.Status = pipe.NodeDown
+					ev.AddNode(old)
+				}
+				if watchEv.Type == "DELETE" {
+					continue
+				}
+				node, err := parseNode(prefix, watchEv.Kv)
+				if err != nil {
+					log.Printf("Ignoring key %s: %s", key, err)
+					continue
+				}
+				nodes[key] = node
+				ev.AddNode(node) // Replaces down node of same name
+			}
+			if len(ev) == 0 {
+				continue
+			}
+			select {
+			case incCh <- ev:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+}
+
+// parseNode parses the json value of a key.
+func parseNode(prefix string, kv KeyValue) (pipe.NodeInfo, error) {
+	var n Node
+	err := json.Unmarshal(kv.Value, &n)
+	if err != nil {
+		return pipe.NodeInfo{}, err
+	}
+	if n.Name == "" {
+		n.Name = strings.TrimPrefix(string(kv.Key), prefix)
+	}
+	node := pipe.NewNodeInfo(n.Name, pipe.NodeUp, n.Host, n.Port)
+	node.Meta = n.Meta
+	return node, nil
+}
+
+// prefixEnd returns the range end matching all keys with the prefix.
+func prefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0} // All keys
+}
+
+// post sends the json encoded body and calls fn with the response if the request succeeded.
+func post(ctx context.Context, u string, body interface{}, fn func(resp *http.Response) error) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Request %s returned status %d", u, resp.StatusCode)
+	}
+	return fn(resp)
+}
@@ -0,0 +1,147 @@
+package etcd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGateway mimics the range and watch endpoints of the etcd json gateway.
+type fakeGateway struct {
+	mutex     sync.Mutex
+	revision  int
+	kvs       map[string]string
+	watchCh   chan string
+	watchReqs []string // start revisions
+}
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func (g *fakeGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Key           []byte `json:"key"`
+		RangeEnd      []byte `json:"range_end"`
+		CreateRequest *struct {
+			Key           []byte `json:"key"`
+			RangeEnd      []byte `json:"range_end"`
+			StartRevision string `json:"start_revision"`
+		} `json:"create_request"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		if string(req.Key) != "/services/web/" || string(req.RangeEnd) != "/services/web0" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		g.mutex.Lock()
+		var parts []string
+		for key, val := range g.kvs {
+			parts = append(parts, fmt.Sprintf(`{"key":%q,"value":%q}`, b64(key), b64(val)))
+		}
+		fmt.Fprintf(w, `{"header":{"revision":"%d"},"kvs":[%s]}`, g.revision, strings.Join(parts, ","))
+		g.mutex.Unlock()
+	case "/v3/watch":
+		g.mutex.Lock()
+		g.watchReqs = append(g.watchReqs, req.CreateRequest.StartRevision)
+		g.mutex.Unlock()
+		fmt.Fprintln(w, `{"result":{"header":{},"created":true}}`)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case msg := <-g.watchCh:
+				fmt.Fprintln(w, msg)
+				w.(http.Flusher).Flush()
+				if strings.Contains(msg, "canceled") {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestFunc(t *testing.T) {
+	fake := &fakeGateway{
+		revision: 5,
+		kvs: map[string]string{
+			"/services/web/node1": `{"host":"10.0.0.1","port":80,"meta":{"zone":"a"}}`,
+			"/services/web/node2": `{"name":"web2","host":"10.0.0.2","port":81}`,
+			"/services/web/bad":   `not json`,
+		},
+		watchCh: make(chan string),
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	watcher := &EtcdWatcher{}
+	err := watcher.Setup(json.RawMessage(fmt.Sprintf(`{"endpoint":%q}`, server.URL)))
+	if err != nil {
+		t.Fatalf("Watcher setup failed: %s", err)
+	}
+	manHandle, eventCh := plugintest.StartWatcher(t, watcher, `{"prefix":"/services/web/","retry":"10ms"}`)
+
+	ev := plugintest.ReceiveEvent(t, eventCh)
+	if len(ev) != 2 {
+		t.Fatalf("Expected 2 nodes, got %s", ev)
+	}
+	if node := ev["node1"]; node.Host != "10.0.0.1" || node.Port != 80 || node.Meta["zone"] != "a" {
+		t.Errorf("Invalid node: %s", node)
+	}
+	if node := ev["web2"]; node.Host != "10.0.0.2" || node.Port != 81 {
+		t.Errorf("Invalid node: %s", node)
+	}
+
+	fake.watchCh <- fmt.Sprintf(`{"result":{"header":{"revision":"7"},"events":[
+{"kv":{"key":%q,"value":%q}},{"type":"DELETE","kv":{"key":%q}}]}}`,
+		b64("/services/web/node3"), b64(`{"host":"10.0.0.3","port":82}`), b64("/services/web/node2"))
+	ev = plugintest.ReceiveEvent(t, eventCh)
+	if len(ev) != 2 || ev["node3"].Status != pipe.NodeUp || ev["web2"].Status != pipe.NodeDown {
+		t.Fatalf("Expected node3 up and web2 down, got %s", ev)
+	}
+
+	// Compaction results in a new list
+	fake.mutex.Lock()
+	fake.revision = 20
+	fake.kvs = map[string]string{
+		"/services/web/node3": `{"host":"10.0.0.3","port":82}`,
+	}
+	fake.mutex.Unlock()
+	fake.watchCh <- `{"result":{"header":{},"canceled":true,"compact_revision":"15"}}`
+	ev = plugintest.ReceiveEvent(t, eventCh)
+	if len(ev) != 1 || ev["node1"].Status != pipe.NodeDown {
+		t.Fatalf("Expected node1 down, got %s", ev)
+	}
+
+	plugintest.Stop(t, manHandle)
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if len(fake.watchReqs) < 1 || fake.watchReqs[0] != "6" {
+		t.Errorf("Expected watch to start at revision 6, got %v", fake.watchReqs)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	if end := string(prefixEnd([]byte("/a/"))); end != "/a0" {
+		t.Errorf("Expected /a0, got %q", end)
+	}
+	if end := prefixEnd([]byte{'a', 0xff}); string(end) != "b" {
+		t.Errorf("Expected b, got %q", end)
+	}
+	if end := prefixEnd([]byte{0xff}); len(end) != 1 || end[0] != 0 {
+		t.Errorf("Expected null byte, got %q", end)
+	}
+}
@@ -0,0 +1,216 @@
+package execwatch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"log"
+	"os/exec"
+	"time"
+)
+
+// MaxLineSize is the maximum size of a single message in stream mode.
+const MaxLineSize = 16 * 1024 * 1024
+
+type ExecWatcher struct {
+}
+
+type ServiceConfig struct {
+	Command  []string `json:"command"`
+	Interval string   `json:"interval"` // Interval between runs, restart delay in stream mode
+	Timeout  string   `json:"timeout"`  // Timeout of a single run, defaults to interval
+	Stream   bool     `json:"stream"`   // Keep command running and read line-delimited messages
+}
+
+// Node is the description of a single node printed by the command.
+type Node struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // "up" or "down", defaults to "up"
+	Host   string `json:"host"`
+	Port   uint16 `json:"port"`
+}
+
+// Message is a single line printed by a command in stream mode.
+type Message struct {
+	Type  string `json:"type"` // "full" or "inc"
+	Nodes []Node `json:"nodes"`
+}
+
+func (w *ExecWatcher) Setup(_ json.RawMessage) error {
+	return nil
+}
+
+func (w *ExecWatcher) Accept(cfgData json.RawMessage) (pipe.Endpoint, error) {
+	cfg := ServiceConfig{
+		Interval: "30s",
+	}
+	err := json.Unmarshal(cfgData, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Command) == 0 {
+		return nil, errors.New("No command configured")
+	}
+	interval, err := time.ParseDuration(cfg.Interval)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid interval: %s", err)
+	}
+	if interval <= 0 {
+		return nil, errors.New("Invalid interval: Must be positive")
+	}
+	timeout := interval
+	if cfg.Timeout != "" {
+		timeout, err = time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid timeout: %s", err)
+		}
+		if timeout <= 0 {
+			return nil, errors.New("Invalid timeout: Must be positive")
+		}
+	}
+
+	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
+		incCh, fullCh := pipe.Bookkeeper(eventCh)
+		defer close(incCh)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-closeCh
+			cancel() // Kills running command
+		}()
+
+		for {
+			if cfg.Stream {
+				err := runStream(ctx, cfg.Command, incCh, fullCh)
+				if err != nil && ctx.Err() == nil {
+					log.Printf("Command %q failed: %s", cfg.Command, err)
+				}
+			} else {
+				ev, err := runOnce(ctx, cfg.Command, timeout)
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("Command %q failed: %s", cfg.Command, err)
+					}
+				} else {
+					select {
+					case fullCh <- ev:
+					case <-closeCh:
+						return
+					}
+				}
+			}
+			select {
+			case <-time.After(interval):
+			case <-closeCh:
+				return
+			}
+		}
+	}), nil
+}
+
+// runOnce runs the command and parses its output as a full list of nodes.
+func runOnce(ctx context.Context, command []string, timeout time.Duration) (pipe.Event, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.WaitDelay = time.Second // Don't wait for children holding stdout
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	var nodes []Node
+	err = json.Unmarshal(bytes.TrimSpace(out), &nodes)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid output: %s", err)
+	}
+	return nodesToEvent(nodes)
+}
+
+// runStream runs the command and forwards every line of its output as event until the command exits.
+func runStream(ctx context.Context, command []string, incCh chan pipe.Event, fullCh chan pipe.Event) error {
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.WaitDelay = time.Second // Don't wait for children holding stdout
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stdout.Close() // Unblock reading if children keep stdout open
+		case <-stopCh:
+		}
+	}()
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), MaxLineSize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var msg Message
+		err := json.Unmarshal(line, &msg)
+		if err != nil {
+			log.Printf("Command %q printed invalid message: %s", command, err)
+			continue
+		}
+		ev, err := nodesToEvent(msg.Nodes)
+		if err != nil {
+			log.Printf("Command %q printed invalid message: %s", command, err)
+			continue
+		}
+		var outCh chan pipe.Event
+		switch msg.Type {
+		case "full":
+			outCh = fullCh
+		case "inc":
+			outCh = incCh
+		default:
+			log.Printf("Command %q printed invalid message type: %q", command, msg.Type)
+			continue
+		}
+		select {
+		case outCh <- ev:
+		case <-ctx.Done():
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		// The command would block writing to the pipe
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("Could not read output: %s", err)
+	}
+	return cmd.Wait()
+}
+
+func nodesToEvent(nodes []Node) (pipe.Event, error) {
+	ev := pipe.NewEvent()
+	for _, node := range nodes {
+		if node.Name == "" {
+			return nil, errors.New("Node without name")
+		}
+		var status pipe.NodeStatus
+		switch node.Status {
+		case "up", "":
+			status = pipe.NodeUp
+		case "down":
+			status = pipe.NodeDown
+		default:
+			return nil, fmt.Errorf("Invalid status %q of node %s", node.Status, node.Name)
+		}
+		ev.AddNewNode(node.Name, status, node.Host, node.Port)
+	}
+	return ev, nil
+}
@@ -0,0 +1,99 @@
+package execwatch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
+	"testing"
+	"time"
+)
+
+func TestAcceptInvalid(t *testing.T) {
+	watcher := &ExecWatcher{}
+	if _, err := watcher.Accept(json.RawMessage(`{}`)); err == nil {
+		t.Error("Expected error, no command given")
+	}
+	if _, err := watcher.Accept(json.RawMessage(`{"command":["true"],"interval":"x"}`)); err == nil {
+		t.Error("Expected error, invalid interval")
+	}
+	for _, cfg := range []string{`{"command":["true"],"interval":"0s"}`, `{"command":["true"],"timeout":"-1s"}`} {
+		if _, err := watcher.Accept(json.RawMessage(cfg)); err == nil {
+			t.Errorf("Expected %s to be rejected", cfg)
+		}
+	}
+}
+
+func TestInterval(t *testing.T) {
+	script := `echo '[{"name":"Node1","host":"127.0.0.1","port":80},{"name":"Node2","host":"127.0.0.2","port":81}]'`
+	manHandle, eventCh := plugintest.StartWatcher(t, &ExecWatcher{}, fmt.Sprintf(`{"command":["sh","-c",%q],"interval":"50ms"}`, script))
+
+	ev := plugintest.ReceiveEvent(t, eventCh)
+	if len(ev) != 2 {
+		t.Fatalf("Expected 2 nodes, got %d: %s", len(ev), ev)
+	}
+	if node := ev["Node2"]; node.Status != pipe.NodeUp || node.Host != "127.0.0.2" || node.Port != 81 {
+		t.Errorf("Invalid node: %s", node)
+	}
+
+	// Same output again must not produce further events
+	select {
+	case ev := <-eventCh:
+		t.Fatalf("Unexpected event: %s", ev)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	plugintest.Stop(t, manHandle)
+}
+
+func TestStream(t *testing.T) {
+	script := `echo '{"type":"full","nodes":[{"name":"Node1","host":"127.0.0.1","port":80},{"name":"Node2","host":"127.0.0.2","port":81}]}'
+sleep 0.1
+echo 'invalid'
+echo '{"type":"inc","nodes":[{"name":"Node1","status":"down"}]}'
+sleep 0.1
+echo '{"type":"full","nodes":[{"name":"Node3","host":"127.0.0.3","port":82}]}'
+sleep 1000`
+	manHandle, eventCh := plugintest.StartWatcher(t, &ExecWatcher{}, fmt.Sprintf(`{"command":["sh","-c",%q],"interval":"1s","stream":true}`, script))
+
+	ev := plugintest.ReceiveEvent(t, eventCh)
+	if len(ev) != 2 {
+		t.Fatalf("Expected 2 nodes, got %d: %s", len(ev), ev)
+	}
+
+	ev = plugintest.ReceiveEvent(t, eventCh)
+	if node, found := ev["Node1"]; len(ev) != 1 || !found || node.Status != pipe.NodeDown {
+		t.Fatalf("Expected Node1 down, got %s", ev)
+	}
+
+	ev = plugintest.ReceiveEvent(t, eventCh)
+	if len(ev) != 2 || ev["Node2"].Status != pipe.NodeDown || ev["Node3"].Status != pipe.NodeUp {
+		t.Fatalf("Expected Node2 down and Node3 up, got %s", ev)
+	}
+
+	// Command is still running and needs to be killed
+	plugintest.Stop(t, manHandle)
+	if _, ok := <-eventCh; ok {
+		t.Error("Event channel should be closed")
+	}
+}
+
+func TestStreamLongLine(t *testing.T) {
+	// Line exceeding MaxLineSize, the command keeps stdout open afterwards
+	script := `head -c 17000000 /dev/zero | tr '\0' a
+echo
+sleep 2`
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- runStream(context.Background(), []string{"sh", "-c", script}, make(chan pipe.Event), make(chan pipe.Event))
+	}()
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Error("Expected error reading long line")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timeout: Stream did not return")
+	}
+}
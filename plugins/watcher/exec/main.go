@@ -0,0 +1,10 @@
+package main
+
+import (
+	"github.com/blang/receptor/plugin"
+	"github.com/blang/receptor/plugins/watcher/exec/execwatch"
+)
+
+func main() {
+	plugin.ServeWatcher(&execwatch.ExecWatcher{})
+}
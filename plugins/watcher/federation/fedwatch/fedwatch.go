@@ -0,0 +1,419 @@
+package fedwatch
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/sharedserver"
+	"github.com/ugorji/go/codec"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FederationWatcher accepts streams of remote receptors forwarding their services.
+// Streams of all services are accepted on a shared server, started with the first running endpoint
+// and stopped after the last one closed.
+type FederationWatcher struct {
+	mutex     sync.Mutex
+	listen    string
+	tlsConfig *tls.Config
+	tokens    map[string][]string // Token to allowed services, nil if no tokens required
+	timeout   time.Duration       // Connections without messages are closed
+	services  map[string]*service // Running services by name
+	accepted  map[string]struct{} // Service names in use
+	server    sharedserver.Server
+}
+
+type Config struct {
+	Listen  string              `json:"listen"`
+	TLS     *TLSConfig          `json:"tls"`
+	Tokens  map[string][]string `json:"tokens"` // Token to allowed services, "*" allows all
+	Timeout string              `json:"timeout"`
+}
+
+type TLSConfig struct {
+	Cert              string `json:"cert"`
+	Key               string `json:"key"`
+	ClientCA          string `json:"clientCA"`          // Verify client certificates
+	RequireClientCert bool   `json:"requireClientCert"` // Reject clients without valid certificate
+}
+
+type ServiceConfig struct {
+	Service   string   `json:"service"`
+	Sites     []string `json:"sites"`     // Accepted sites, all if empty
+	SiteKey   string   `json:"siteKey"`   // Metadata key of the site
+	Separator string   `json:"separator"` // Separates site and node name
+	Grace     string   `json:"grace"`     // Time nodes of disconnected sites are kept
+}
+
+// service aggregates the nodes of all sites streaming the service.
+type service struct {
+	mutex     sync.Mutex
+	name      string
+	sites     map[string]struct{} // Accepted sites, nil accepts all
+	siteKey   string
+	separator string
+	grace     time.Duration
+	fullCh    chan pipe.Event
+	closeCh   chan struct{}
+	closed    bool
+	nodes     map[string]map[string]pipe.NodeInfo // Site to nodes up by name
+	conns     map[string]net.Conn                 // Connected sites
+}
+
+func (w *FederationWatcher) Setup(cfgData json.RawMessage) error {
+	conf := Config{
+		Listen:  "127.0.0.1:7900",
+		Timeout: "30s",
+	}
+	err := json.Unmarshal(cfgData, &conf)
+	if err != nil {
+		return err
+	}
+	timeout, err := time.ParseDuration(conf.Timeout)
+	if err != nil {
+		return fmt.Errorf("Invalid timeout: %s", err)
+	}
+	if timeout <= 0 {
+		return errors.New("Invalid timeout: Must be positive")
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.init()
+	w.listen = conf.Listen
+	w.timeout = timeout
+	w.tokens = nil
+	if len(conf.Tokens) > 0 {
+		w.tokens = conf.Tokens
+	}
+	w.tlsConfig = nil
+	if conf.TLS != nil {
+		w.tlsConfig, err = newTLSConfig(conf.TLS)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// init sets defaults, the watcher may be used without global config. Needs to hold the mutex.
+func (w *FederationWatcher) init() {
+	if w.services != nil {
+		return
+	}
+	w.listen = "127.0.0.1:7900"
+	w.timeout = 30 * time.Second
+	w.services = make(map[string]*service)
+	w.accepted = make(map[string]struct{})
+}
+
+func newTLSConfig(conf *TLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load certificate: %s", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if conf.ClientCA != "" {
+		b, err := ioutil.ReadFile(conf.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load client ca: %s", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(b) {
+			return nil, errors.New("No valid certificates found in client ca")
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if conf.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if conf.RequireClientCert {
+		return nil, errors.New("Client ca required to verify client certificates")
+	}
+	return tlsConfig, nil
+}
+
+func (w *FederationWatcher) Accept(cfgData json.RawMessage) (pipe.Endpoint, error) {
+	cfg := ServiceConfig{
+		SiteKey:   "site",
+		Separator: "/",
+		Grace:     "30s",
+	}
+	err := json.Unmarshal(cfgData, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Service == "" {
+		return nil, errors.New("No service configured")
+	}
+	if cfg.Separator == "" {
+		return nil, errors.New("No separator configured")
+	}
+	grace, err := time.ParseDuration(cfg.Grace)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid grace: %s", err)
+	}
+	var sites map[string]struct{}
+	if len(cfg.Sites) > 0 {
+		sites = make(map[string]struct{})
+		for _, site := range cfg.Sites {
+			sites[site] = struct{}{}
+		}
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.init()
+	if _, found := w.accepted[cfg.Service]; found {
+		return nil, fmt.Errorf("Service %q already in use", cfg.Service)
+	}
+	w.accepted[cfg.Service] = struct{}{}
+
+	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
+		incCh, fullCh := pipe.Bookkeeper(eventCh)
+		defer close(incCh)
+		svc := &service{
+			name:      cfg.Service,
+			sites:     sites,
+			siteKey:   cfg.SiteKey,
+			separator: cfg.Separator,
+			grace:     grace,
+			fullCh:    fullCh,
+			closeCh:   closeCh,
+			nodes:     make(map[string]map[string]pipe.NodeInfo),
+			conns:     make(map[string]net.Conn),
+		}
+		err := w.register(svc)
+		if err != nil {
+			log.Printf("Could not start federation server: %s", err)
+			return
+		}
+		defer w.unregister(svc)
+		<-closeCh
+	}), nil
+}
+
+// Addr returns the address the server listens on or nil if not running.
+func (w *FederationWatcher) Addr() net.Addr {
+	return w.server.Addr()
+}
+
+// register adds the service and starts the server if needed.
+func (w *FederationWatcher) register(svc *service) error {
+	w.mutex.Lock()
+	w.services[svc.name] = svc
+	start := sharedserver.TCP(w.listen, w.tlsConfig, w.handle)
+	w.mutex.Unlock()
+	err := w.server.Acquire(start)
+	if err != nil {
+		w.remove(svc)
+	}
+	return err
+}
+
+// unregister removes the service and stops the server if it was the last one.
+func (w *FederationWatcher) unregister(svc *service) {
+	w.remove(svc)
+	w.server.Release()
+}
+
+// remove closes the connections of the service and releases its name.
+func (w *FederationWatcher) remove(svc *service) {
+	svc.close()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.services[svc.name] == svc {
+		delete(w.services, svc.name)
+	}
+	delete(w.accepted, svc.name)
+}
+
+// handle authenticates the stream and applies its updates to the service.
+func (w *FederationWatcher) handle(conn net.Conn) {
+	w.mutex.Lock()
+	timeout := w.timeout
+	w.mutex.Unlock()
+
+	var mh codec.MsgpackHandle
+	dec := codec.NewDecoder(conn, &mh)
+	enc := codec.NewEncoder(conn, &mh)
+	conn.SetDeadline(time.Now().Add(timeout))
+	var hello Hello
+	err := dec.Decode(&hello)
+	if err != nil {
+		log.Printf("Invalid hello from %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+	svc, err := w.authorize(&hello)
+	if err != nil {
+		log.Printf("Rejected stream of %s from %s: %s", hello.Site, conn.RemoteAddr(), err)
+		enc.Encode(HelloReply{Error: err.Error()})
+		return
+	}
+	err = enc.Encode(HelloReply{})
+	if err != nil {
+		return
+	}
+	if !svc.attach(hello.Site, conn) {
+		return // Service closed
+	}
+	log.Printf("Service %s: Site %s connected from %s", svc.name, hello.Site, conn.RemoteAddr())
+	defer svc.detach(hello.Site, conn)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		var msg Message
+		err := dec.Decode(&msg)
+		if err != nil {
+			log.Printf("Service %s: Site %s disconnected: %s", svc.name, hello.Site, err)
+			return
+		}
+		switch msg.Type {
+		case MessageFull:
+			svc.update(hello.Site, msg.Nodes, true)
+		case MessageInc:
+			svc.update(hello.Site, msg.Nodes, false)
+		case MessagePing:
+		default:
+			log.Printf("Service %s: Site %s sent unknown message %q", svc.name, hello.Site, msg.Type)
+			return
+		}
+	}
+}
+
+// authorize checks the hello and returns the requested service.
+func (w *FederationWatcher) authorize(hello *Hello) (*service, error) {
+	if hello.Version != ProtocolVersion {
+		return nil, fmt.Errorf("Unsupported protocol version %d", hello.Version)
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.tokens != nil {
+		allowed, found := w.tokens[hello.Token]
+		if !found {
+			return nil, errors.New("Invalid token")
+		}
+		permitted := false
+		for _, s := range allowed {
+			if s == "*" || s == hello.Service {
+				permitted = true
+			}
+		}
+		if !permitted {
+			return nil, fmt.Errorf("Token not allowed for service %q", hello.Service)
+		}
+	}
+	svc, found := w.services[hello.Service]
+	if !found {
+		return nil, fmt.Errorf("Unknown service %q", hello.Service)
+	}
+	if hello.Site == "" || strings.Contains(hello.Site, svc.separator) {
+		return nil, fmt.Errorf("Invalid site %q", hello.Site)
+	}
+	if svc.sites != nil {
+		if _, found := svc.sites[hello.Site]; !found {
+			return nil, fmt.Errorf("Site %q not allowed", hello.Site)
+		}
+	}
+	return svc, nil
+}
+
+// attach sets the connection of the site, an existing connection of the site is replaced.
+// Returns false if the service is closed.
+func (s *service) attach(site string, conn net.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	if old, found := s.conns[site]; found {
+		old.Close()
+	}
+	s.conns[site] = conn
+	return true
+}
+
+// detach removes the connection and the nodes of the site after the grace period,
+// unless the site reconnected meanwhile.
+func (s *service) detach(site string, conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conns[site] != conn {
+		return // Replaced
+	}
+	delete(s.conns, site)
+	time.AfterFunc(s.grace, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if _, found := s.conns[site]; found || s.closed {
+			return
+		}
+		if _, found := s.nodes[site]; found {
+			log.Printf("Service %s: Removing nodes of site %s", s.name, site)
+			delete(s.nodes, site)
+			s.push()
+		}
+	})
+}
+
+// update applies a full or incremental update of the site and sends the nodes of all sites.
+func (s *service) update(site string, nodes []pipe.NodeInfo, full bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	siteNodes := s.nodes[site]
+	if full || siteNodes == nil {
+		siteNodes = make(map[string]pipe.NodeInfo)
+		s.nodes[site] = siteNodes
+	}
+	for _, node := range nodes {
+		if node.Status == pipe.NodeUp {
+			siteNodes[node.Name] = node
+		} else {
+			delete(siteNodes, node.Name)
+		}
+	}
+	s.push()
+}
+
+// push sends the nodes of all sites as full update, names are prefixed by their site.
+// Needs to hold the mutex.
+func (s *service) push() {
+	ev := pipe.NewEvent()
+	for site, nodes := range s.nodes {
+		for _, node := range nodes {
+			meta := make(map[string]string)
+			for key, value := range node.Meta {
+				meta[key] = value
+			}
+			meta[s.siteKey] = site
+			node.Name = site + s.separator + node.Name
+			node.Meta = meta
+			ev.AddNode(node)
+		}
+	}
+	select {
+	case s.fullCh <- ev:
+	case <-s.closeCh:
+	}
+}
+
+// close disconnects all sites, updates are ignored afterwards.
+func (s *service) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,157 @@
+package fedwatch
+
+import (
+	"encoding/json"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
+	"github.com/ugorji/go/codec"
+	"net"
+	"testing"
+	"time"
+)
+
+// waitServer waits until the server is running and returns its address.
+func waitServer(t *testing.T, watcher *FederationWatcher) string {
+	for i := 0; i < 500; i++ {
+		if addr := watcher.Addr(); addr != nil {
+			return addr.String()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Server not started")
+	return ""
+}
+
+type client struct {
+	conn net.Conn
+	enc  *codec.Encoder
+	dec  *codec.Decoder
+}
+
+// connect sends the hello and returns the reply.
+func connect(t *testing.T, addr string, hello Hello) (*client, HelloReply) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mh codec.MsgpackHandle
+	c := &client{
+		conn: conn,
+		enc:  codec.NewEncoder(conn, &mh),
+		dec:  codec.NewDecoder(conn, &mh),
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := c.enc.Encode(hello); err != nil {
+		t.Fatal(err)
+	}
+	var reply HelloReply
+	if err := c.dec.Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	return c, reply
+}
+
+func (c *client) send(t *testing.T, msgType string, nodes ...pipe.NodeInfo) {
+	if err := c.enc.Encode(Message{Type: msgType, Nodes: nodes}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFunc(t *testing.T) {
+	watcher := &FederationWatcher{}
+	err := watcher.Setup(json.RawMessage(`{"listen":"127.0.0.1:0","tokens":{"secret":["web"],"other":["db"]},"timeout":"5s"}`))
+	if err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	handle, err := watcher.Accept(json.RawMessage(`{"service":"web","sites":["dc1","dc2"],"grace":"200ms"}`))
+	if err != nil {
+		t.Fatalf("Accept failed: %s", err)
+	}
+	if _, err := watcher.Accept(json.RawMessage(`{"service":"web"}`)); err == nil {
+		t.Error("Expected service to be used only once")
+	}
+	eventCh := make(chan pipe.Event)
+	manHandle := plugintest.Handle(handle, eventCh)
+	addr := waitServer(t, watcher)
+
+	// Rejected streams
+	for _, hello := range []Hello{
+		{Version: 2, Site: "dc1", Service: "web", Token: "secret"},
+		{Version: ProtocolVersion, Site: "dc1", Service: "web", Token: "invalid"},
+		{Version: ProtocolVersion, Site: "dc1", Service: "web", Token: "other"},
+		{Version: ProtocolVersion, Site: "dc3", Service: "web", Token: "secret"},
+		{Version: ProtocolVersion, Site: "dc1/a", Service: "web", Token: "secret"},
+	} {
+		c, reply := connect(t, addr, hello)
+		c.conn.Close()
+		if reply.Error == "" {
+			t.Errorf("Expected %+v to be rejected", hello)
+		}
+	}
+
+	dc1, reply := connect(t, addr, Hello{Version: ProtocolVersion, Site: "dc1", Service: "web", Token: "secret"})
+	if reply.Error != "" {
+		t.Fatalf("Rejected: %s", reply.Error)
+	}
+	node := pipe.NewNodeInfo("web1", pipe.NodeUp, "10.0.0.1", 80)
+	node.Meta = map[string]string{"zone": "a"}
+	dc1.send(t, MessageFull, node)
+	ev := plugintest.ReceiveEvent(t, eventCh)
+	if n, found := ev["dc1/web1"]; len(ev) != 1 || !found || n.Status != pipe.NodeUp || n.Host != "10.0.0.1" ||
+		n.Meta["site"] != "dc1" || n.Meta["zone"] != "a" {
+		t.Fatalf("Expected dc1/web1 up with site, got %s", ev)
+	}
+
+	dc2, _ := connect(t, addr, Hello{Version: ProtocolVersion, Site: "dc2", Service: "web", Token: "secret"})
+	dc2.send(t, MessageFull, pipe.NewNodeInfo("web1", pipe.NodeUp, "10.1.0.1", 80))
+	ev = plugintest.ReceiveEvent(t, eventCh)
+	if _, found := ev["dc2/web1"]; len(ev) != 1 || !found {
+		t.Fatalf("Expected dc2/web1, got %s", ev)
+	}
+
+	dc1.send(t, MessagePing)
+	dc1.send(t, MessageInc, pipe.NewNodeInfo("web1", pipe.NodeDown, "10.0.0.1", 80))
+	ev = plugintest.ReceiveEvent(t, eventCh)
+	if n, found := ev["dc1/web1"]; len(ev) != 1 || !found || n.Status != pipe.NodeDown {
+		t.Fatalf("Expected dc1/web1 down, got %s", ev)
+	}
+
+	// Reconnect of dc2 replaces the old stream
+	dc2new, _ := connect(t, addr, Hello{Version: ProtocolVersion, Site: "dc2", Service: "web", Token: "secret"})
+	dc2new.send(t, MessageFull, pipe.NewNodeInfo("web2", pipe.NodeUp, "10.1.0.2", 80))
+	ev = plugintest.ReceiveEvent(t, eventCh)
+	if len(ev) != 2 || ev["dc2/web1"].Status != pipe.NodeDown || ev["dc2/web2"].Status != pipe.NodeUp {
+		t.Fatalf("Expected dc2/web1 down and dc2/web2 up, got %s", ev)
+	}
+	var msg Message
+	if err := dc2.dec.Decode(&msg); err == nil {
+		t.Error("Expected old stream to be closed")
+	}
+
+	// Nodes are removed after grace
+	start := time.Now()
+	dc2new.conn.Close()
+	ev = plugintest.ReceiveEvent(t, eventCh)
+	if n, found := ev["dc2/web2"]; len(ev) != 1 || !found || n.Status != pipe.NodeDown {
+		t.Fatalf("Expected dc2/web2 down, got %s", ev)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("Expected nodes to be kept for grace, removed after %s", d)
+	}
+
+	plugintest.Stop(t, manHandle)
+	if err := dc1.dec.Decode(&msg); err == nil {
+		t.Error("Expected stream to be closed on shutdown")
+	}
+	if watcher.Addr() != nil {
+		t.Error("Expected server to be stopped")
+	}
+}
+
+func TestSetupInvalid(t *testing.T) {
+	for _, cfg := range []string{`{"timeout":"0s"}`, `{"timeout":"-1s"}`} {
+		if err := (&FederationWatcher{}).Setup(json.RawMessage(cfg)); err == nil {
+			t.Errorf("Expected %s to be rejected", cfg)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package fedwatch
+
+import (
+	"github.com/blang/receptor/pipe"
+)
+
+// The federation protocol streams msgpack encoded values over a tcp connection, optionally using tls.
+// The client sends a Hello and receives a HelloReply. If accepted, it sends a full update
+// followed by incremental updates and pings. Full updates are sent again after reconnects.
+
+// ProtocolVersion is the version of the protocol, sent with the Hello.
+const ProtocolVersion = 1
+
+// Message types
+const (
+	MessageFull = "full" // All nodes up of the site
+	MessageInc  = "inc"  // Changed nodes
+	MessagePing = "ping" // Keeps the connection alive, no nodes
+)
+
+type Hello struct {
+	Version int
+	Site    string
+	Service string // Name of the service at the receiving receptor
+	Token   string
+}
+
+type HelloReply struct {
+	Error string // Empty if accepted
+}
+
+type Message struct {
+	Type  string
+	Nodes []pipe.NodeInfo
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"github.com/blang/receptor/plugin"
+	"github.com/blang/receptor/plugins/watcher/federation/fedwatch"
+)
+
+func main() {
+	plugin.ServeWatcher(&fedwatch.FederationWatcher{})
+}
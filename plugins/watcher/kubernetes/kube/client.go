@@ -0,0 +1,262 @@
+package kube
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Client is a minimal kubernetes api client.
+type Client struct {
+	server    string
+	tokenFile string // Read on every request, bound service account tokens are rotated
+	mutex     sync.Mutex
+	token     string
+	http      *http.Client
+}
+
+// NewClient creates a client for the api server authenticating with the bearer token if not empty.
+func NewClient(server string, token string, tlsConfig *tls.Config) *Client {
+	return &Client{
+		server: strings.TrimSuffix(server, "/"),
+		token:  token,
+		http: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+	}
+}
+
+// NewInClusterClient creates a client using the service account of the pod.
+func NewInClusterClient() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("Not running inside a kubernetes cluster, configure api server")
+	}
+	pool, err := loadCertPool(InClusterCAFile, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := NewClient("https://"+net.JoinHostPort(host, port), "", &tls.Config{RootCAs: pool})
+	err = client.SetTokenFile(InClusterTokenFile)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// SetTokenFile reads the bearer token from the file.
+// The file is read again on every request, the last token is kept if reading fails.
+func (c *Client) SetTokenFile(filename string) error {
+	token, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.tokenFile = filename
+	c.token = strings.TrimSpace(string(token))
+	return nil
+}
+
+// bearerToken returns the current token, read from the token file if configured.
+func (c *Client) bearerToken() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.tokenFile != "" {
+		token, err := ioutil.ReadFile(c.tokenFile)
+		if err == nil {
+			c.token = strings.TrimSpace(string(token))
+		}
+	}
+	return c.token
+}
+
+// Kubeconfig is the subset of a kubeconfig file needed to connect to a cluster.
+type Kubeconfig struct {
+	CurrentContext string `json:"current-context"`
+	Contexts       []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster string `json:"cluster"`
+			User    string `json:"user"`
+		} `json:"context"`
+	} `json:"contexts"`
+	Clusters []struct {
+		Name    string `json:"name"`
+		Cluster struct {
+			Server                   string `json:"server"`
+			CertificateAuthority     string `json:"certificate-authority"`
+			CertificateAuthorityData string `json:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+		} `json:"cluster"`
+	} `json:"clusters"`
+	Users []struct {
+		Name string `json:"name"`
+		User struct {
+			Token                 string `json:"token"`
+			TokenFile             string `json:"tokenFile"`
+			ClientCertificate     string `json:"client-certificate"`
+			ClientCertificateData string `json:"client-certificate-data"`
+			ClientKey             string `json:"client-key"`
+			ClientKeyData         string `json:"client-key-data"`
+		} `json:"user"`
+	} `json:"users"`
+}
+
+// NewClientFromKubeconfig creates a client using the current context of the kubeconfig file.
+// The file needs to be in json format, see `kubectl config view --raw -o json`.
+func NewClientFromKubeconfig(filename string) (*Client, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var kc Kubeconfig
+	err = json.Unmarshal(b, &kc)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid kubeconfig, json format required: %s", err)
+	}
+
+	var clusterName, userName string
+	found := false
+	for _, c := range kc.Contexts {
+		if c.Name == kc.CurrentContext {
+			clusterName, userName, found = c.Context.Cluster, c.Context.User, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Context %q not found in kubeconfig", kc.CurrentContext)
+	}
+
+	var client *Client
+	for _, c := range kc.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		tlsConfig := &tls.Config{InsecureSkipVerify: c.Cluster.InsecureSkipTLSVerify}
+		if c.Cluster.CertificateAuthority != "" || c.Cluster.CertificateAuthorityData != "" {
+			data, err := base64.StdEncoding.DecodeString(c.Cluster.CertificateAuthorityData)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs, err = loadCertPool(c.Cluster.CertificateAuthority, data)
+			if err != nil {
+				return nil, err
+			}
+		}
+		client = NewClient(c.Cluster.Server, "", tlsConfig)
+	}
+	if client == nil {
+		return nil, fmt.Errorf("Cluster %q not found in kubeconfig", clusterName)
+	}
+
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		client.token = u.User.Token
+		if u.User.TokenFile != "" {
+			err = client.SetTokenFile(u.User.TokenFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		certPEM, keyPEM := []byte(u.User.ClientCertificateData), []byte(u.User.ClientKeyData)
+		if u.User.ClientCertificateData != "" {
+			certPEM, err = base64.StdEncoding.DecodeString(u.User.ClientCertificateData)
+			if err != nil {
+				return nil, err
+			}
+		} else if u.User.ClientCertificate != "" {
+			certPEM, err = ioutil.ReadFile(u.User.ClientCertificate)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if u.User.ClientKeyData != "" {
+			keyPEM, err = base64.StdEncoding.DecodeString(u.User.ClientKeyData)
+			if err != nil {
+				return nil, err
+			}
+		} else if u.User.ClientKey != "" {
+			keyPEM, err = ioutil.ReadFile(u.User.ClientKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(certPEM) > 0 {
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig := client.http.Transport.(*http.Transport).TLSClientConfig
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+	return client, nil
+}
+
+// loadCertPool creates a pool from pem encoded certificates in data or the file if data is empty.
+func loadCertPool(filename string, data []byte) (*x509.CertPool, error) {
+	if len(data) == 0 {
+		var err error
+		data, err = ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("No valid certificates found")
+	}
+	return pool, nil
+}
+
+// Get requests a resource path, non-200 responses are returned as error.
+func (c *Client) Get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("GET", c.server+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if token := c.bearerToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var status Status
+		json.NewDecoder(resp.Body).Decode(&status)
+		if resp.StatusCode == http.StatusGone {
+			return nil, errExpired
+		}
+		return nil, fmt.Errorf("Api request %s failed with status %d: %s", path, resp.StatusCode, status.Message)
+	}
+	return resp, nil
+}
+
+// GetJSON requests a resource path and decodes the response into v.
+func (c *Client) GetJSON(ctx context.Context, path string, query url.Values, v interface{}) error {
+	resp, err := c.Get(ctx, path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
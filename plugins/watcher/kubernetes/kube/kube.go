@@ -0,0 +1,310 @@
+package kube
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Paths of the service account mounted into every pod
+const (
+	InClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	InClusterCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+var errExpired = errors.New("Resource version expired")
+
+type KubernetesWatcher struct {
+	mutex  sync.Mutex
+	Client *Client
+}
+
+type Config struct {
+	Server     string `json:"server"`
+	Token      string `json:"token"`
+	TokenFile  string `json:"tokenFile"`
+	CAFile     string `json:"caFile"`
+	Insecure   bool   `json:"insecure"`
+	Kubeconfig string `json:"kubeconfig"` // Kubeconfig in json format
+}
+
+type ServiceConfig struct {
+	Namespace string `json:"namespace"`
+	Service   string `json:"service"`
+	Port      string `json:"port"`  // Name of the port, may be empty if the service has only one port
+	Retry     string `json:"retry"` // Delay before retrying after errors
+}
+
+func (w *KubernetesWatcher) Setup(cfgData json.RawMessage) error {
+	var conf Config
+	err := json.Unmarshal(cfgData, &conf)
+	if err != nil {
+		return err
+	}
+	client, err := newClient(&conf)
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.Client = client
+	return nil
+}
+
+// newClient creates the client from the kubeconfig, the server config or the service account.
+func newClient(conf *Config) (*Client, error) {
+	if conf.Kubeconfig != "" {
+		return NewClientFromKubeconfig(conf.Kubeconfig)
+	}
+	if conf.Server == "" {
+		return NewInClusterClient()
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: conf.Insecure}
+	if conf.CAFile != "" {
+		var err error
+		tlsConfig.RootCAs, err = loadCertPool(conf.CAFile, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	client := NewClient(conf.Server, conf.Token, tlsConfig)
+	if conf.TokenFile != "" {
+		err := client.SetTokenFile(conf.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+func (w *KubernetesWatcher) Accept(cfgData json.RawMessage) (pipe.Endpoint, error) {
+	conf := ServiceConfig{
+		Namespace: "default",
+		Retry:     "5s",
+	}
+	err := json.Unmarshal(cfgData, &conf)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Service == "" {
+		return nil, errors.New("No service configured")
+	}
+	retry, err := time.ParseDuration(conf.Retry)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid retry delay: %s", err)
+	}
+	w.mutex.Lock()
+	if w.Client == nil { // No global configuration
+		w.Client, err = NewInClusterClient()
+	}
+	client := w.Client
+	w.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
+		incCh, fullCh := pipe.Bookkeeper(eventCh)
+		defer close(incCh)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-closeCh
+			cancel()
+		}()
+
+		for {
+			err := watch(ctx, client, &conf, fullCh)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != errExpired {
+				log.Printf("Watching service %s/%s failed: %s", conf.Namespace, conf.Service, err)
+				select {
+				case <-time.After(retry):
+				case <-closeCh:
+					return
+				}
+			}
+		}
+	}), nil
+}
+
+// watch lists all endpointslices of the service and follows changes until an error occurs.
+// Every change results in a full update of all ready endpoints.
+func watch(ctx context.Context, client *Client, conf *ServiceConfig, fullCh chan pipe.Event) error {
+	path := "/apis/discovery.k8s.io/v1/namespaces/" + url.PathEscape(conf.Namespace) + "/endpointslices"
+	query := url.Values{}
+	query.Set("labelSelector", "kubernetes.io/service-name="+conf.Service)
+
+	var list EndpointSliceList
+	err := client.GetJSON(ctx, path, query, &list)
+	if err != nil {
+		return err
+	}
+	slices := make(map[string]*EndpointSlice)
+	for i := range list.Items {
+		slices[list.Items[i].Metadata.Name] = &list.Items[i]
+	}
+	sendFull := func() error {
+		select {
+		case fullCh <- slicesToEvent(slices, conf.Port):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	err = sendFull()
+	if err != nil {
+		return err
+	}
+
+	resourceVersion := list.Metadata.ResourceVersion
+	for {
+		query.Set("watch", "1")
+		query.Set("allowWatchBookmarks", "true")
+		query.Set("resourceVersion", resourceVersion)
+		query.Set("timeoutSeconds", "300")
+		resp, err := client.Get(ctx, path, query)
+		if err != nil {
+			return err
+		}
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var ev WatchEvent
+			err = dec.Decode(&ev)
+			if err != nil {
+				break
+			}
+			if ev.Type == "ERROR" {
+				var status Status
+				json.Unmarshal(ev.Object, &status)
+				if status.Code == http.StatusGone {
+					err = errExpired
+				} else {
+					err = fmt.Errorf("Watch error: %s", status.Message)
+				}
+				break
+			}
+			var slice EndpointSlice
+			err = json.Unmarshal(ev.Object, &slice)
+			if err != nil {
+				break
+			}
+			resourceVersion = slice.Metadata.ResourceVersion
+			switch ev.Type {
+			case "ADDED", "MODIFIED":
+				slices[slice.Metadata.Name] = &slice
+			case "DELETED":
+				delete(slices, slice.Metadata.Name)
+			default: // BOOKMARK
+				continue
+			}
+			err = sendFull()
+			if err != nil {
+				break
+			}
+		}
+		resp.Body.Close()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		// Watch timed out on server side, continue at last resource version
+	}
+}
+
+// slicesToEvent creates a full update of all ready endpoints of the slices.
+func slicesToEvent(slices map[string]*EndpointSlice, portName string) pipe.Event {
+	ev := pipe.NewEvent()
+	for _, slice := range slices {
+		port, found := slice.port(portName)
+		if !found {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			if len(endpoint.Addresses) == 0 || !endpoint.ready() {
+				continue
+			}
+			host := endpoint.Addresses[0]
+			name := host
+			if endpoint.TargetRef != nil && endpoint.TargetRef.Name != "" {
+				name = endpoint.TargetRef.Name
+			}
+			ev.AddNewNode(name, pipe.NodeUp, host, port)
+		}
+	}
+	return ev
+}
+
+type ObjectMeta struct {
+	Name            string `json:"name"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+type EndpointSliceList struct {
+	Metadata ObjectMeta      `json:"metadata"`
+	Items    []EndpointSlice `json:"items"`
+}
+
+type EndpointSlice struct {
+	Metadata  ObjectMeta `json:"metadata"`
+	Endpoints []Endpoint `json:"endpoints"`
+	Ports     []struct {
+		Name *string `json:"name"`
+		Port *int32  `json:"port"`
+	} `json:"ports"`
+}
+
+// port returns the port with the given name.
+// An empty name matches the only port of the slice.
+func (s *EndpointSlice) port(name string) (uint16, bool) {
+	for _, port := range s.Ports {
+		if port.Port == nil {
+			continue
+		}
+		if (port.Name != nil && *port.Name == name) || (name == "" && len(s.Ports) == 1) {
+			return uint16(*port.Port), true
+		}
+	}
+	return 0, false
+}
+
+type Endpoint struct {
+	Addresses  []string `json:"addresses"`
+	Conditions struct {
+		Ready *bool `json:"ready"`
+	} `json:"conditions"`
+	TargetRef *struct {
+		Kind string `json:"kind"`
+		Name string `json:"name"`
+	} `json:"targetRef"`
+}
+
+// ready reports if the endpoint is ready, an unknown state is interpreted as ready.
+func (e *Endpoint) ready() bool {
+	return e.Conditions.Ready == nil || *e.Conditions.Ready
+}
+
+type WatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type Status struct {
+	Code    int    `json:"code"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
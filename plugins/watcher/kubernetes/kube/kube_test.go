@@ -0,0 +1,190 @@
+package kube
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAPIServer serves list and watch requests of endpointslices.
+type fakeAPIServer struct {
+	mutex    sync.Mutex
+	list     string
+	watchCh  chan string // Watch events, empty string ends the watch
+	requests []string
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/prod/endpointslices" ||
+		r.URL.Query().Get("labelSelector") != "kubernetes.io/service-name=web" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	s.mutex.Lock()
+	s.requests = append(s.requests, r.URL.Query().Get("watch")+"@"+r.URL.Query().Get("resourceVersion"))
+	list := s.list
+	s.mutex.Unlock()
+
+	if r.URL.Query().Get("watch") == "" {
+		fmt.Fprint(w, list)
+		return
+	}
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case ev := <-s.watchCh:
+			if ev == "" {
+				return
+			}
+			fmt.Fprintln(w, ev)
+			w.(http.Flusher).Flush()
+			if strings.Contains(ev, `"ERROR"`) {
+				return // Watch ends after errors
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *fakeAPIServer) setList(list string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.list = list
+}
+
+func sliceJSON(name string, rv string, ready2 bool) string {
+	return fmt.Sprintf(`{"metadata":{"name":%q,"resourceVersion":%q},"addressType":"IPv4",
+"endpoints":[
+  {"addresses":["10.0.0.1"],"conditions":{"ready":true},"targetRef":{"kind":"Pod","name":"web-1"}},
+  {"addresses":["10.0.0.2"],"conditions":{"ready":%t},"targetRef":{"kind":"Pod","name":"web-2"}}
+],
+"ports":[{"name":"metrics","port":9100},{"name":"http","port":8080}]}`, name, rv, ready2)
+}
+
+func TestFunc(t *testing.T) {
+	fake := &fakeAPIServer{
+		list:    `{"metadata":{"resourceVersion":"10"},"items":[` + sliceJSON("web-abc", "9", false) + `]}`,
+		watchCh: make(chan string),
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	watcher := &KubernetesWatcher{}
+	err := watcher.Setup(json.RawMessage(fmt.Sprintf(`{"server":%q,"token":"secret"}`, server.URL)))
+	if err != nil {
+		t.Fatalf("Watcher setup failed: %s", err)
+	}
+	manHandle, eventCh := plugintest.StartWatcher(t, watcher, `{"namespace":"prod","service":"web","port":"http","retry":"10ms"}`)
+
+	ev := plugintest.ReceiveEvent(t, eventCh)
+	if node, found := ev["web-1"]; len(ev) != 1 || !found {
+		t.Fatalf("Expected only web-1, got %s", ev)
+	} else if node.Host != "10.0.0.1" || node.Port != 8080 || node.Status != pipe.NodeUp {
+		t.Errorf("Invalid node: %s", node)
+	}
+
+	fake.watchCh <- `{"type":"MODIFIED","object":` + sliceJSON("web-abc", "11", true) + `}`
+	ev = plugintest.ReceiveEvent(t, eventCh)
+	if node, found := ev["web-2"]; len(ev) != 1 || !found || node.Status != pipe.NodeUp {
+		t.Fatalf("Expected web-2 up, got %s", ev)
+	}
+
+	// Server closes watch, watch is resumed at last resource version
+	fake.watchCh <- ""
+	fake.watchCh <- `{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"12"}}}`
+
+	// Resource version expired, relist
+	fake.setList(`{"metadata":{"resourceVersion":"20"},"items":[]}`)
+	fake.watchCh <- `{"type":"ERROR","object":{"kind":"Status","code":410,"reason":"Expired"}}`
+	ev = plugintest.ReceiveEvent(t, eventCh)
+	if len(ev) != 2 || ev["web-1"].Status != pipe.NodeDown || ev["web-2"].Status != pipe.NodeDown {
+		t.Fatalf("Expected all nodes down, got %s", ev)
+	}
+
+	fake.watchCh <- `{"type":"ADDED","object":` + sliceJSON("web-def", "21", false) + `}`
+	ev = plugintest.ReceiveEvent(t, eventCh)
+	if node, found := ev["web-1"]; len(ev) != 1 || !found || node.Status != pipe.NodeUp {
+		t.Fatalf("Expected web-1 up, got %s", ev)
+	}
+
+	plugintest.Stop(t, manHandle)
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	expected := []string{"@", "1@10", "1@11", "@", "1@20"}
+	if len(fake.requests) != len(expected) {
+		t.Fatalf("Expected requests %v, got %v", expected, fake.requests)
+	}
+	for i := range expected {
+		if fake.requests[i] != expected[i] {
+			t.Errorf("Expected requests %v, got %v", expected, fake.requests)
+		}
+	}
+}
+
+func TestTokenFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tokenFile := filepath.Join(tmpDir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("expired\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeAPIServer{
+		list:    `{"metadata":{"resourceVersion":"10"},"items":[` + sliceJSON("web-abc", "9", false) + `]}`,
+		watchCh: make(chan string),
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	watcher := &KubernetesWatcher{}
+	err = watcher.Setup(json.RawMessage(fmt.Sprintf(`{"server":%q,"tokenFile":%q}`, server.URL, tokenFile)))
+	if err != nil {
+		t.Fatalf("Watcher setup failed: %s", err)
+	}
+	manHandle, eventCh := plugintest.StartWatcher(t, watcher, `{"namespace":"prod","service":"web","port":"http","retry":"10ms"}`)
+
+	// Rotated token is used by the next request
+	time.Sleep(50 * time.Millisecond)
+	if err := ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if ev := plugintest.ReceiveEvent(t, eventCh); len(ev) != 1 {
+		t.Fatalf("Expected web-1, got %s", ev)
+	}
+
+	plugintest.Stop(t, manHandle)
+}
+
+func TestSlicesToEventSinglePort(t *testing.T) {
+	var slice EndpointSlice
+	err := json.Unmarshal([]byte(`{"metadata":{"name":"web-abc"},
+"endpoints":[{"addresses":["10.0.0.3"]}],"ports":[{"port":80}]}`), &slice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := slicesToEvent(map[string]*EndpointSlice{"web-abc": &slice}, "")
+	if node, found := ev["10.0.0.3"]; !found || node.Port != 80 {
+		t.Errorf("Expected node named by address with only port, got %s", ev)
+	}
+	if ev := slicesToEvent(map[string]*EndpointSlice{"web-abc": &slice}, "http"); len(ev) != 0 {
+		t.Errorf("Expected no nodes, port not found: %s", ev)
+	}
+}
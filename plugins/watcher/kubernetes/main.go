@@ -0,0 +1,10 @@
+package main
+
+import (
+	"github.com/blang/receptor/plugin"
+	"github.com/blang/receptor/plugins/watcher/kubernetes/kube"
+)
+
+func main() {
+	plugin.ServeWatcher(&kube.KubernetesWatcher{})
+}
@@ -1,26 +1,52 @@
 package restapi
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/sharedserver"
+	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+// RestAPIServerWatcher serves the api of all services on a shared http server.
+// The server is started with the first running endpoint and shut down after the last one closed.
 type RestAPIServerWatcher struct {
-	Listen string
-	Server *http.Server
-	Router *http.ServeMux
-	//TODO: Add Mutex
-	IsRunning bool
+	mutex     sync.Mutex
+	listen    string
+	tlsConfig *tls.Config
+	handler   http.Handler               // Routes to services, includes authorization
+	services  map[string]*serviceHandler // Running service endpoints
+	accepted  map[string]struct{}        // Service names in use
+	server    sharedserver.Server
 }
 
 type Config struct {
-	Listen string `json:"listen"`
+	Listen string              `json:"listen"`
+	TLS    *TLSConfig          `json:"tls"`
+	Tokens map[string][]string `json:"tokens"` // Bearer token to allowed services, "*" allows all
+}
+
+type TLSConfig struct {
+	Cert              string `json:"cert"`
+	Key               string `json:"key"`
+	ClientCA          string `json:"clientCA"`          // Verify client certificates
+	RequireClientCert bool   `json:"requireClientCert"` // Reject clients without valid certificate
 }
 
 type ServiceConfig struct {
 	Service string `json:"service"`
+	TTL     string `json:"ttl"` // Default lease of registered nodes, empty for no expiry
 }
 
 func (w *RestAPIServerWatcher) Setup(cfgData json.RawMessage) error {
@@ -31,16 +57,149 @@ func (w *RestAPIServerWatcher) Setup(cfgData json.RawMessage) error {
 	if err != nil {
 		return err
 	}
-	w.Router = http.NewServeMux()
-	w.Server = &http.Server{Addr: conf.Listen, Handler: w.Router}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.init()
+	w.listen = conf.Listen
+	w.tlsConfig = nil
+	if conf.TLS != nil {
+		w.tlsConfig, err = newTLSConfig(conf.TLS)
+		if err != nil {
+			return err
+		}
+	}
+	w.handler = http.HandlerFunc(w.route)
+	if len(conf.Tokens) > 0 {
+		w.handler = authorize(conf.Tokens, w.handler)
+	}
 	return nil
 }
 
+// init sets defaults, the watcher may be used without global config. Needs to hold the mutex.
+func (w *RestAPIServerWatcher) init() {
+	if w.services != nil {
+		return
+	}
+	w.listen = "127.0.0.1:8080"
+	w.handler = http.HandlerFunc(w.route)
+	w.services = make(map[string]*serviceHandler)
+	w.accepted = make(map[string]struct{})
+}
+
+// Addr returns the address the server listens on or nil if not running.
+func (w *RestAPIServerWatcher) Addr() net.Addr {
+	return w.server.Addr()
+}
+
+// route passes requests to the handler of the service.
+func (w *RestAPIServerWatcher) route(rw http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/service/") {
+		writeError(rw, http.StatusNotFound, "Not found")
+		return
+	}
+	service := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/service/"), "/", 2)[0]
+	w.mutex.Lock()
+	handler, found := w.services[service]
+	w.mutex.Unlock()
+	if !found {
+		writeError(rw, http.StatusNotFound, fmt.Sprintf("Service %q not found", service))
+		return
+	}
+	handler.ServeHTTP(rw, r)
+}
+
+// register adds the handler of a service and starts the server if needed.
+func (w *RestAPIServerWatcher) register(service string, handler *serviceHandler) error {
+	w.mutex.Lock()
+	w.services[service] = handler
+	start := sharedserver.HTTP(w.listen, w.tlsConfig, w.handler)
+	w.mutex.Unlock()
+	err := w.server.Acquire(start)
+	if err != nil {
+		w.remove(service)
+	}
+	return err
+}
+
+// unregister removes the handler of a service and shuts down the server if it was the last one.
+func (w *RestAPIServerWatcher) unregister(service string) {
+	w.remove(service)
+	w.server.Release()
+}
+
+// remove removes the handler of a service and releases its name.
+func (w *RestAPIServerWatcher) remove(service string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	delete(w.services, service)
+	delete(w.accepted, service)
+}
+
+// newTLSConfig loads the server certificate and client ca.
+func newTLSConfig(conf *TLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load certificate: %s", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if conf.ClientCA != "" {
+		b, err := ioutil.ReadFile(conf.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load client ca: %s", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(b) {
+			return nil, errors.New("No valid certificates found in client ca")
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if conf.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if conf.RequireClientCert {
+		return nil, errors.New("Client ca required to verify client certificates")
+	}
+	return tlsConfig, nil
+}
+
+// authorize only passes requests with a bearer token allowed to access the requested service.
+func authorize(tokens map[string][]string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "Unauthorized: Bearer token required")
+			return
+		}
+		services, found := tokens[strings.TrimPrefix(auth, "Bearer ")]
+		if !found {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, "Unauthorized: Invalid token")
+			return
+		}
+		service := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/service/"), "/", 2)[0]
+		for _, allowed := range services {
+			if allowed == "*" || allowed == service {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		writeError(w, http.StatusForbidden, fmt.Sprintf("Forbidden: Access to service %q denied", service))
+	})
+}
+
 type RestEvent struct {
 	Name string `json:"name"`
 	Type string `json:"type"`
 	Host string `json:"host"`
 	Port uint16 `json:"port"`
+	TTL  string `json:"ttl,omitempty"` // Overrides the lease of the service
+}
+
+// ErrorResponse is the body of all failed requests.
+type ErrorResponse struct {
+	Error string `json:"error"`
 }
 
 func (w *RestAPIServerWatcher) Accept(cfgData json.RawMessage) (pipe.Endpoint, error) {
@@ -51,43 +210,402 @@ func (w *RestAPIServerWatcher) Accept(cfgData json.RawMessage) (pipe.Endpoint, e
 	if err != nil {
 		return nil, err
 	}
+	if conf.Service == "" || strings.Contains(conf.Service, "/") {
+		return nil, fmt.Errorf("Invalid service name %q", conf.Service)
+	}
+	var ttl time.Duration
+	if conf.TTL != "" {
+		ttl, err = time.ParseDuration(conf.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ttl: %s", err)
+		}
+	}
+
+	w.mutex.Lock()
+	w.init()
+	if _, found := w.accepted[conf.Service]; found {
+		w.mutex.Unlock()
+		return nil, fmt.Errorf("Service %q already in use", conf.Service)
+	}
+	w.accepted[conf.Service] = struct{}{}
+	w.mutex.Unlock()
 
 	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
+		defer close(eventCh)
+		handler := &serviceHandler{
+			path:    "/service/" + conf.Service,
+			book:    pipe.NewBook(),
+			eventCh: eventCh,
+			closeCh: closeCh,
+			ttl:     ttl,
+			leases:  make(map[string]lease),
+			leaseCh: make(chan struct{}, 1),
+		}
+		err := w.register(conf.Service, handler)
+		if err != nil {
+			log.Printf("Could not start server: %s", err)
+			return
+		}
+		defer w.unregister(conf.Service)
 
-		w.Router.HandleFunc("/service/"+conf.Service, func(w http.ResponseWriter, r *http.Request) {
-			var restEvent RestEvent
-			err := json.NewDecoder(r.Body).Decode(&restEvent)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				fmt.Fprintf(w, "Bad request: %s", err)
-				return
-			}
+		handler.expireLeases(closeCh) // Returns on close
 
-			var nodeStatus pipe.NodeStatus
-			switch restEvent.Type {
-			case "nodeup":
-				nodeStatus = pipe.NodeUp
-			case "nodedown":
-				nodeStatus = pipe.NodeDown
-			default:
-				w.WriteHeader(http.StatusBadRequest)
-				fmt.Fprintln(w, "Bad request: Invalid event type")
-				return
-			}
+		// Requests still in progress respond with 503, no more events are sent
+		handler.mutex.Lock()
+		handler.closed = true
+		handler.mutex.Unlock()
+	}), nil
+}
+
+// serviceHandler serves the api of a single service.
+// It keeps track of all nodes registered through the api
+// and sends redundant-free incremental events.
+// Nodes registered with a ttl go down if their lease is not renewed in time.
+type serviceHandler struct {
+	path    string
+	mutex   sync.Mutex // Serializes updates to keep events in order, guards leases
+	book    *pipe.Book
+	eventCh chan pipe.Event
+	ttl     time.Duration
+	closeCh chan struct{}
+	closed  bool
+	leases  map[string]lease // Node name to lease
+	leaseCh chan struct{}    // Signals changed leases
+}
+
+type lease struct {
+	ttl    time.Duration
+	expiry time.Time
+}
 
-			eventCh <- pipe.NewEventWithNode(restEvent.Name, nodeStatus, restEvent.Host, restEvent.Port)
+func (h *serviceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == h.path {
+		switch r.Method {
+		case "GET":
+			h.list(w, r)
+		case "POST":
+			h.update(w, r)
+		case "PUT":
+			h.replace(w, r)
+		default:
+			w.Header().Set("Allow", "GET, POST, PUT")
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, h.path+"/")
+	if strings.HasSuffix(name, "/heartbeat") {
+		name = strings.TrimSuffix(name, "/heartbeat")
+		if name == "" || strings.Contains(name, "/") {
+			writeError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		h.heartbeat(w, r, name)
+		return
+	}
+	if name == "" || strings.Contains(name, "/") {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	switch r.Method {
+	case "DELETE":
+		h.remove(w, r, name)
+	default:
+		w.Header().Set("Allow", "DELETE")
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
 
-			fmt.Fprintln(w, "OK")
+// list responds with all nodes currently up.
+func (h *serviceHandler) list(w http.ResponseWriter, r *http.Request) {
+	var nodes []RestEvent
+	for _, node := range h.book.Full() {
+		nodes = append(nodes, RestEvent{
+			Name: node.Name,
+			Type: "nodeup",
+			Host: node.Host,
+			Port: node.Port,
 		})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	if nodes == nil {
+		nodes = []RestEvent{}
+	}
+	writeJSON(w, http.StatusOK, nodes)
+}
+
+// update applies a single or a batch of incremental updates.
+func (h *serviceHandler) update(w http.ResponseWriter, r *http.Request) {
+	restEvents, err := decodeEvents(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Bad request: %s", err))
+		return
+	}
+	ev := pipe.NewEvent()
+	ttls := make(map[string]time.Duration)
+	for _, restEvent := range restEvents {
+		var nodeStatus pipe.NodeStatus
+		switch restEvent.Type {
+		case "nodeup":
+			nodeStatus = pipe.NodeUp
+		case "nodedown":
+			nodeStatus = pipe.NodeDown
+		default:
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Bad request: Invalid event type %q of node %q", restEvent.Type, restEvent.Name))
+			return
+		}
+		if restEvent.Name == "" {
+			writeError(w, http.StatusBadRequest, "Bad request: Node without name")
+			return
+		}
+		ttl, err := h.parseTTL(restEvent)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Bad request: %s", err))
+			return
+		}
+		ev.AddNewNode(restEvent.Name, nodeStatus, restEvent.Host, restEvent.Port)
+		ttls[restEvent.Name] = ttl
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		writeUnavailable(w)
+		return
+	}
+	if outEv := h.book.UpdateInc(ev); outEv != nil {
+		if !h.send(outEv) {
+			writeUnavailable(w)
+			return
+		}
+	}
+	for _, node := range ev {
+		if node.Status == pipe.NodeUp {
+			h.setLease(node.Name, ttls[node.Name])
+		} else {
+			delete(h.leases, node.Name)
+		}
+	}
+	writeOK(w)
+}
 
-		if !w.IsRunning {
-			w.IsRunning = true
-			go func() {
-				w.Server.ListenAndServe() // Log error
-			}()
+// replace replaces all nodes by the list of nodes up.
+func (h *serviceHandler) replace(w http.ResponseWriter, r *http.Request) {
+	restEvents, err := decodeEvents(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Bad request: %s", err))
+		return
+	}
+	ev := pipe.NewEvent()
+	ttls := make(map[string]time.Duration)
+	for _, restEvent := range restEvents {
+		if restEvent.Type != "" && restEvent.Type != "nodeup" {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Bad request: Invalid event type %q of node %q, full updates only contain nodes up", restEvent.Type, restEvent.Name))
+			return
+		}
+		if restEvent.Name == "" {
+			writeError(w, http.StatusBadRequest, "Bad request: Node without name")
+			return
 		}
-		<-closeCh
-		close(eventCh)
+		ttl, err := h.parseTTL(restEvent)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Bad request: %s", err))
+			return
+		}
+		ev.AddNewNode(restEvent.Name, pipe.NodeUp, restEvent.Host, restEvent.Port)
+		ttls[restEvent.Name] = ttl
+	}
 
-	}), nil
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		writeUnavailable(w)
+		return
+	}
+	if outEv := h.book.UpdateFull(ev); outEv != nil {
+		if !h.send(outEv) {
+			writeUnavailable(w)
+			return
+		}
+	}
+	h.leases = make(map[string]lease)
+	for name, ttl := range ttls {
+		h.setLease(name, ttl)
+	}
+	writeOK(w)
+}
+
+// remove brings a single node down.
+func (h *serviceHandler) remove(w http.ResponseWriter, r *http.Request, name string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		writeUnavailable(w)
+		return
+	}
+	node, found := h.book.Full()[name]
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Node %q not found", name))
+		return
+	}
+	node.Status = pipe.NodeDown
+	ev := pipe.NewEvent()
+	ev.AddNode(node)
+	if outEv := h.book.UpdateInc(ev); outEv != nil {
+		if !h.send(outEv) {
+			writeUnavailable(w)
+			return
+		}
+	}
+	delete(h.leases, name)
+	writeOK(w)
+}
+
+// heartbeat renews the lease of a node.
+func (h *serviceHandler) heartbeat(w http.ResponseWriter, r *http.Request, name string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		writeUnavailable(w)
+		return
+	}
+	if _, found := h.book.Full()[name]; !found {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Node %q not found", name))
+		return
+	}
+	l, found := h.leases[name]
+	if !found {
+		writeError(w, http.StatusConflict, fmt.Sprintf("Node %q has no lease", name))
+		return
+	}
+	h.setLease(name, l.ttl)
+	writeOK(w)
+}
+
+// send passes an event downstream, returns false if the service was closed meanwhile. Needs to hold the mutex.
+func (h *serviceHandler) send(ev pipe.Event) bool {
+	select {
+	case h.eventCh <- ev:
+		return true
+	case <-h.closeCh:
+		return false
+	}
+}
+
+// parseTTL returns the lease duration of a registration, zero for no expiry.
+func (h *serviceHandler) parseTTL(restEvent RestEvent) (time.Duration, error) {
+	if restEvent.TTL == "" {
+		return h.ttl, nil
+	}
+	ttl, err := time.ParseDuration(restEvent.TTL)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid ttl of node %q: %s", restEvent.Name, err)
+	}
+	return ttl, nil
+}
+
+// setLease sets or removes the lease of a node. Needs to hold the mutex.
+func (h *serviceHandler) setLease(name string, ttl time.Duration) {
+	if ttl <= 0 {
+		delete(h.leases, name)
+		return
+	}
+	h.leases[name] = lease{
+		ttl:    ttl,
+		expiry: time.Now().Add(ttl),
+	}
+	select {
+	case h.leaseCh <- struct{}{}:
+	default: // Already signaled
+	}
+}
+
+// expireLeases brings nodes down whose lease expired until closeCh is closed.
+func (h *serviceHandler) expireLeases(closeCh chan struct{}) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		h.mutex.Lock()
+		now := time.Now()
+		var next time.Time
+		ev := pipe.NewEvent()
+		for name, l := range h.leases {
+			if !l.expiry.After(now) {
+				delete(h.leases, name)
+				if node, found := h.book.Full()[name]; found {
+					node.Status = pipe.NodeDown
+					ev.AddNode(node)
+				}
+			} else if next.IsZero() || l.expiry.Before(next) {
+				next = l.expiry
+			}
+		}
+		if outEv := h.book.UpdateInc(ev); outEv != nil && !h.send(outEv) {
+			h.mutex.Unlock()
+			return
+		}
+		h.mutex.Unlock()
+
+		var timerCh <-chan time.Time
+		if !next.IsZero() {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(next.Sub(now))
+			timerCh = timer.C
+		}
+		select {
+		case <-timerCh:
+		case <-h.leaseCh:
+		case <-closeCh:
+			return
+		}
+	}
+}
+
+// decodeEvents decodes a single event or a list of events.
+func decodeEvents(r *http.Request) ([]RestEvent, error) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	var restEvents []RestEvent
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &restEvents)
+	} else {
+		var restEvent RestEvent
+		err = json.Unmarshal(b, &restEvent)
+		restEvents = append(restEvents, restEvent)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return restEvents, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, ErrorResponse{Error: msg})
+}
+
+func writeUnavailable(w http.ResponseWriter) {
+	writeError(w, http.StatusServiceUnavailable, "Service unavailable: Shutting down")
+}
+
+func writeOK(w http.ResponseWriter) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
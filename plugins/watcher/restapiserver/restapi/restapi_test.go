@@ -2,10 +2,25 @@ package restapi
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
-	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -13,7 +28,7 @@ import (
 func TestFunc(t *testing.T) {
 	watcher := &RestAPIServerWatcher{}
 	cfg := &Config{
-		Listen: "127.0.0.1:9991",
+		Listen: "127.0.0.1:0",
 	}
 	b, err := json.Marshal(cfg)
 	if err != nil {
@@ -40,11 +55,8 @@ func TestFunc(t *testing.T) {
 	}
 
 	eventCh := make(chan pipe.Event, 1)
-
-	watcher.IsRunning = true // Fake Running server
-	testserver := httptest.NewServer(watcher.Router)
-	defer testserver.Close()
 	go manHandle.Handle(eventCh)
+	serverURL := waitServer(t, watcher, "http")
 
 	restEvent := &RestEvent{
 		Name: "testservice",
@@ -57,7 +69,7 @@ func TestFunc(t *testing.T) {
 		t.Fatalf("Could not marshal test restevent: %s", string(b))
 	}
 	br := bytes.NewReader(b)
-	resp, err := http.Post(testserver.URL+"/service/testservice", "application/json", br)
+	resp, err := http.Post(serverURL+"/service/testservice", "application/json", br)
 	if err != nil {
 		t.Fatalf("Error while Post: %s", err)
 	}
@@ -103,3 +115,448 @@ func TestFunc(t *testing.T) {
 	}
 
 }
+
+// waitServer waits until the server of the watcher is running and returns its url.
+func waitServer(t *testing.T, watcher *RestAPIServerWatcher, scheme string) string {
+	for i := 0; i < 500; i++ {
+		if addr := watcher.Addr(); addr != nil {
+			return scheme + "://" + addr.String()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Timeout: Server not started")
+	return ""
+}
+
+// startTestService starts a watcher endpoint for the service and returns the url of the service.
+func startTestService(t *testing.T, service string) (*pipe.ManagedEndpoint, chan pipe.Event, string) {
+	watcher := &RestAPIServerWatcher{}
+	err := watcher.Setup(json.RawMessage(`{"listen":"127.0.0.1:0"}`))
+	if err != nil {
+		t.Fatalf("Watcher setup failed: %s", err)
+	}
+	handle, err := watcher.Accept(json.RawMessage(`{"service":"` + service + `"}`))
+	if err != nil {
+		t.Fatalf("Watcher accept failed: %s", err)
+	}
+	manHandle := pipe.NewManagedEndpoint(handle)
+	eventCh := make(chan pipe.Event, 10)
+	go manHandle.Handle(eventCh)
+	return manHandle, eventCh, waitServer(t, watcher, "http") + "/service/" + service
+}
+
+func doRequest(t *testing.T, method string, url string, body string) (int, string) {
+	status, respBody, err := sendRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, respBody
+}
+
+// sendRequest is doRequest returning errors, safe to use in goroutines.
+func sendRequest(method string, url string, body string) (int, string, error) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, "", fmt.Errorf("Error while %s: %s", method, err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(b), nil
+}
+
+func TestFullUpdate(t *testing.T) {
+	manHandle, eventCh, url := startTestService(t, "testservice")
+
+	status, body := doRequest(t, "PUT", url, `[{"name":"Node1","host":"127.0.0.1","port":80},{"name":"Node2","host":"127.0.0.2","port":81}]`)
+	if status != 200 {
+		t.Fatalf("RestAPI send wrong statuscode: %d: %s", status, body)
+	}
+	ev := plugintest.ReceiveEvent(t, eventCh)
+	if len(ev) != 2 || ev["Node1"].Status != pipe.NodeUp || ev["Node2"].Status != pipe.NodeUp {
+		t.Fatalf("Expected Node1 and Node2 up, got %s", ev)
+	}
+
+	// Node1 missing in full update
+	status, _ = doRequest(t, "PUT", url, `[{"name":"Node2","host":"127.0.0.2","port":81}]`)
+	if status != 200 {
+		t.Fatalf("RestAPI send wrong statuscode: %d", status)
+	}
+	ev = plugintest.ReceiveEvent(t, eventCh)
+	if node, found := ev["Node1"]; len(ev) != 1 || !found || node.Status != pipe.NodeDown {
+		t.Fatalf("Expected Node1 down, got %s", ev)
+	}
+
+	// Full updates only contain nodes up
+	status, body = doRequest(t, "PUT", url, `[{"name":"Node2","type":"nodedown"}]`)
+	if status != 400 {
+		t.Errorf("Expected statuscode 400, got %d", status)
+	}
+	var errResp ErrorResponse
+	if err := json.Unmarshal([]byte(body), &errResp); err != nil || errResp.Error == "" {
+		t.Errorf("Expected json error body, got %q", body)
+	}
+
+	plugintest.Stop(t, manHandle)
+}
+
+func TestBatchDeleteList(t *testing.T) {
+	manHandle, eventCh, url := startTestService(t, "testservice")
+
+	status, body := doRequest(t, "POST", url, `[{"name":"Node1","type":"nodeup","host":"127.0.0.1","port":80},{"name":"Node2","type":"nodeup","host":"127.0.0.2","port":81}]`)
+	if status != 200 {
+		t.Fatalf("RestAPI send wrong statuscode: %d: %s", status, body)
+	}
+	if ev := plugintest.ReceiveEvent(t, eventCh); len(ev) != 2 {
+		t.Fatalf("Expected 2 nodes, got %s", ev)
+	}
+
+	status, body = doRequest(t, "DELETE", url+"/Node1", "")
+	if status != 200 {
+		t.Fatalf("RestAPI send wrong statuscode: %d: %s", status, body)
+	}
+	ev := plugintest.ReceiveEvent(t, eventCh)
+	if node, found := ev["Node1"]; len(ev) != 1 || !found || node.Status != pipe.NodeDown || node.Host != "127.0.0.1" {
+		t.Fatalf("Expected Node1 down, got %s", ev)
+	}
+
+	status, _ = doRequest(t, "DELETE", url+"/Node1", "")
+	if status != 404 {
+		t.Errorf("Expected statuscode 404 for unknown node, got %d", status)
+	}
+
+	status, body = doRequest(t, "GET", url, "")
+	if status != 200 {
+		t.Fatalf("RestAPI send wrong statuscode: %d", status)
+	}
+	var nodes []RestEvent
+	if err := json.Unmarshal([]byte(body), &nodes); err != nil {
+		t.Fatalf("Invalid response %q: %s", body, err)
+	}
+	if len(nodes) != 1 || nodes[0].Name != "Node2" || nodes[0].Host != "127.0.0.2" || nodes[0].Port != 81 {
+		t.Errorf("Expected only Node2, got %v", nodes)
+	}
+
+	status, _ = doRequest(t, "POST", url, `[{"name":"Node3","type":"invalid"}]`)
+	if status != 400 {
+		t.Errorf("Expected statuscode 400, got %d", status)
+	}
+
+	plugintest.Stop(t, manHandle)
+}
+
+// generateCert creates a certificate signed by parent or self-signed if parent is nil.
+func generateCert(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return cert, key, certPEM, keyPEM
+}
+
+func writeTempFile(t *testing.T, dir string, name string, data []byte) string {
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestAuth(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ca, caKey, caPEM, _ := generateCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	_, _, serverPEM, serverKeyPEM := generateCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	_, _, clientPEM, clientKeyPEM := generateCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "client"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	cfg := Config{
+		Listen: "127.0.0.1:0",
+		TLS: &TLSConfig{
+			Cert:              writeTempFile(t, tmpDir, "server.crt", serverPEM),
+			Key:               writeTempFile(t, tmpDir, "server.key", serverKeyPEM),
+			ClientCA:          writeTempFile(t, tmpDir, "ca.crt", caPEM),
+			RequireClientCert: true,
+		},
+		Tokens: map[string][]string{
+			"token1": {"service1"},
+			"admin":  {"*"},
+		},
+	}
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher := &RestAPIServerWatcher{}
+	if err := watcher.Setup(json.RawMessage(b)); err != nil {
+		t.Fatalf("Watcher setup failed: %s", err)
+	}
+	for _, service := range []string{"service1", "service2"} {
+		handle, err := watcher.Accept(json.RawMessage(`{"service":"` + service + `"}`))
+		if err != nil {
+			t.Fatalf("Watcher accept failed: %s", err)
+		}
+		manHandle := pipe.NewManagedEndpoint(handle)
+		go manHandle.Handle(make(chan pipe.Event, 10))
+		defer manHandle.Stop()
+	}
+
+	serverURL := waitServer(t, watcher, "https")
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+	clientCert, err := tls.X509KeyPair(clientPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{clientCert},
+	}}}
+	get := func(client *http.Client, service string, token string) (int, error) {
+		req, err := http.NewRequest("GET", serverURL+"/service/"+service, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	// Wait for services to register
+	for _, service := range []string{"service1", "service2"} {
+		for i := 0; i < 500; i++ {
+			if status, _ := get(client, service, "admin"); status == 200 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	tests := []struct {
+		service  string
+		token    string
+		expected int
+	}{
+		{"service1", "", http.StatusUnauthorized},
+		{"service1", "invalid", http.StatusUnauthorized},
+		{"service1", "token1", http.StatusOK},
+		{"service2", "token1", http.StatusForbidden},
+		{"service2", "admin", http.StatusOK},
+	}
+	for _, test := range tests {
+		status, err := get(client, test.service, test.token)
+		if err != nil {
+			t.Fatalf("Request failed: %s", err)
+		}
+		if status != test.expected {
+			t.Errorf("Service %s with token %q: Expected status %d, got %d", test.service, test.token, test.expected, status)
+		}
+	}
+
+	// Client without certificate is rejected
+	noCertClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	if _, err := get(noCertClient, "service1", "token1"); err == nil {
+		t.Error("Expected request without client certificate to fail")
+	}
+}
+
+func TestLeases(t *testing.T) {
+	manHandle, eventCh, url := startTestService(t, "testservice")
+
+	status, body := doRequest(t, "POST", url, `[{"name":"Node1","type":"nodeup","host":"127.0.0.1","port":80,"ttl":"200ms"},{"name":"Node2","type":"nodeup","host":"127.0.0.2","port":81}]`)
+	if status != 200 {
+		t.Fatalf("RestAPI send wrong statuscode: %d: %s", status, body)
+	}
+	if ev := plugintest.ReceiveEvent(t, eventCh); len(ev) != 2 {
+		t.Fatalf("Expected 2 nodes, got %s", ev)
+	}
+
+	// Renew lease using heartbeats and re-registration
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if i%2 == 0 {
+			status, body = doRequest(t, "POST", url+"/Node1/heartbeat", "")
+		} else {
+			status, body = doRequest(t, "POST", url, `{"name":"Node1","type":"nodeup","host":"127.0.0.1","port":80,"ttl":"200ms"}`)
+		}
+		if status != 200 {
+			t.Fatalf("RestAPI send wrong statuscode: %d: %s", status, body)
+		}
+	}
+	select {
+	case ev := <-eventCh:
+		t.Fatalf("Unexpected event, lease was renewed: %s", ev)
+	default:
+	}
+
+	if status, _ := doRequest(t, "POST", url+"/Node2/heartbeat", ""); status != 409 {
+		t.Errorf("Expected statuscode 409 for node without lease, got %d", status)
+	}
+	if status, _ := doRequest(t, "POST", url+"/Node3/heartbeat", ""); status != 404 {
+		t.Errorf("Expected statuscode 404 for unknown node, got %d", status)
+	}
+
+	// Lease expires
+	ev := plugintest.ReceiveEvent(t, eventCh)
+	if node, found := ev["Node1"]; len(ev) != 1 || !found || node.Status != pipe.NodeDown {
+		t.Fatalf("Expected Node1 down, got %s", ev)
+	}
+
+	plugintest.Stop(t, manHandle)
+}
+
+func TestConcurrentServices(t *testing.T) {
+	watcher := &RestAPIServerWatcher{}
+	if err := watcher.Setup(json.RawMessage(`{"listen":"127.0.0.1:0"}`)); err != nil {
+		t.Fatalf("Watcher setup failed: %s", err)
+	}
+	var manHandles []*pipe.ManagedEndpoint
+	var eventChs []chan pipe.Event
+	for _, service := range []string{"service1", "service2"} {
+		handle, err := watcher.Accept(json.RawMessage(`{"service":"` + service + `"}`))
+		if err != nil {
+			t.Fatalf("Watcher accept failed: %s", err)
+		}
+		manHandle := pipe.NewManagedEndpoint(handle)
+		eventCh := make(chan pipe.Event) // Unbuffered, blocks until received
+		go manHandle.Handle(eventCh)
+		manHandles = append(manHandles, manHandle)
+		eventChs = append(eventChs, eventCh)
+	}
+	if _, err := watcher.Accept(json.RawMessage(`{"service":"service1"}`)); err == nil {
+		t.Error("Expected error, service name already in use")
+	}
+	serverURL := waitServer(t, watcher, "http")
+
+	// Wait for services to register
+	for _, service := range []string{"service1", "service2"} {
+		for i := 0; i < 500; i++ {
+			if status, _ := doRequest(t, "GET", serverURL+"/service/"+service, ""); status == 200 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if status, _ := doRequest(t, "GET", serverURL+"/service/unknown", ""); status != 404 {
+		t.Errorf("Expected statuscode 404 for unknown service, got %d", status)
+	}
+
+	// Updates of different services in parallel
+	var wg sync.WaitGroup
+	for i, service := range []string{"service1", "service2"} {
+		wg.Add(2)
+		go func(service string) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				_, _, err := sendRequest("POST", serverURL+"/service/"+service, fmt.Sprintf(`{"name":"Node%d","type":"nodeup","host":"127.0.0.1","port":80}`, j))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(service)
+		go func(eventCh chan pipe.Event) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if _, err := plugintest.WaitEvent(eventCh); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(eventChs[i])
+	}
+	wg.Wait()
+
+	// Nobody receives events of service1, request is blocked until the service is closed
+	statusCh := make(chan int)
+	go func() {
+		status, _, err := sendRequest("POST", serverURL+"/service/service1", `{"name":"NodeX","type":"nodeup","host":"127.0.0.1","port":80}`)
+		if err != nil {
+			t.Error(err)
+		}
+		statusCh <- status
+	}()
+	time.Sleep(50 * time.Millisecond)
+	manHandles[0].Stop()
+	select {
+	case status := <-statusCh:
+		if status != http.StatusServiceUnavailable {
+			t.Errorf("Expected statuscode 503, got %d", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout: Request blocked after close")
+	}
+	if err := manHandles[0].WaitTimeout(5 * time.Second); err != nil {
+		t.Errorf("Stop handle timeout: %s", err)
+	}
+
+	// Service1 is gone and may be accepted again, service2 still served
+	if status, _ := doRequest(t, "GET", serverURL+"/service/service1", ""); status != 404 {
+		t.Errorf("Expected statuscode 404 for closed service, got %d", status)
+	}
+	if status, _ := doRequest(t, "GET", serverURL+"/service/service2", ""); status != 200 {
+		t.Errorf("Expected statuscode 200, got %d", status)
+	}
+	if _, err := watcher.Accept(json.RawMessage(`{"service":"service1"}`)); err != nil {
+		t.Errorf("Expected closed service name to be available, got %s", err)
+	}
+
+	// Server shuts down with the last service
+	manHandles[1].Stop()
+	if err := manHandles[1].WaitTimeout(5 * time.Second); err != nil {
+		t.Errorf("Stop handle timeout: %s", err)
+	}
+	if watcher.Addr() != nil {
+		t.Error("Expected server to be stopped")
+	}
+	if _, err := http.Get(serverURL + "/service/service2"); err == nil {
+		t.Error("Expected request to fail, server stopped")
+	}
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"github.com/blang/receptor/plugin"
+	"github.com/blang/receptor/plugins/watcher/sse/sse"
+)
+
+func main() {
+	plugin.ServeWatcher(&sse.SSEWatcher{})
+}
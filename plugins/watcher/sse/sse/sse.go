@@ -0,0 +1,410 @@
+package sse
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SSEWatcher struct {
+}
+
+type ServiceConfig struct {
+	List      Request                `json:"list"`
+	Stream    Request                `json:"stream"`
+	Fields    Fields                 `json:"fields"`
+	Events    map[string]EventConfig `json:"events"` // Event type to mapping
+	Reconnect string                 `json:"reconnect"`
+	Resume    bool                   `json:"resume"` // Don't list again after reconnect, rely on Last-Event-ID
+}
+
+type Request struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Items   string            `json:"items"` // Path to the list of nodes in the response
+}
+
+// Fields are paths to node fields inside an item.
+type Fields struct {
+	Name string            `json:"name"`
+	Host string            `json:"host"`
+	Port string            `json:"port"`
+	Meta map[string]string `json:"meta"` // Metadata key to path
+}
+
+type EventConfig struct {
+	Action string            `json:"action"` // "up", "down", "status", "full" or "resync"
+	Items  string            `json:"items"`  // Path to node or list of nodes in payload, defaults to payload
+	Fields *Fields           `json:"fields"` // Overrides service fields
+	Status string            `json:"status"` // Path to status used by action "status"
+	Up     []string          `json:"up"`     // Status values of nodes up
+	Filter map[string]string `json:"filter"` // Path to expected value, other events are ignored
+}
+
+// Message is a single server-sent event.
+type Message struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+func (w *SSEWatcher) Setup(_ json.RawMessage) error {
+	return nil
+}
+
+func (w *SSEWatcher) Accept(cfgData json.RawMessage) (pipe.Endpoint, error) {
+	conf := ServiceConfig{
+		Reconnect: "5s",
+	}
+	err := json.Unmarshal(cfgData, &conf)
+	if err != nil {
+		return nil, err
+	}
+	if conf.List.URL == "" || conf.Stream.URL == "" {
+		return nil, errors.New("List and stream url required")
+	}
+	if conf.Fields.Name == "" {
+		return nil, errors.New("Name field required")
+	}
+	for eventType, evConf := range conf.Events {
+		if evConf.Fields != nil && evConf.Fields.Name == "" {
+			return nil, fmt.Errorf("Event %s: Name field required", eventType)
+		}
+		switch evConf.Action {
+		case "up", "down", "full", "resync":
+		case "status":
+			if evConf.Status == "" {
+				return nil, fmt.Errorf("Event %s: Status path required", eventType)
+			}
+		default:
+			return nil, fmt.Errorf("Event %s: Invalid action %q", eventType, evConf.Action)
+		}
+	}
+	reconnect, err := time.ParseDuration(conf.Reconnect)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid reconnect delay: %s", err)
+	}
+
+	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
+		incCh, fullCh := pipe.Bookkeeper(eventCh)
+		defer close(incCh)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-closeCh
+			cancel()
+		}()
+
+		s := &session{
+			conf:      &conf,
+			incCh:     incCh,
+			fullCh:    fullCh,
+			reconnect: reconnect,
+		}
+		for {
+			err := s.run(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Event stream %s failed: %s", conf.Stream.URL, err)
+			select {
+			case <-time.After(s.reconnect):
+			case <-closeCh:
+				return
+			}
+		}
+	}), nil
+}
+
+// session holds the state kept between reconnects.
+type session struct {
+	conf        *ServiceConfig
+	incCh       chan pipe.Event
+	fullCh      chan pipe.Event
+	reconnect   time.Duration // Updated by the server using retry
+	lastEventID string
+	listed      bool
+}
+
+// run connects to the stream, lists the nodes if needed and applies events until the stream ends.
+func (s *session) run(ctx context.Context) error {
+	resp, err := s.get(ctx, s.conf.Stream, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if !s.listed || !s.conf.Resume {
+		err = s.list(ctx)
+		if err != nil {
+			return err
+		}
+		s.listed = true
+	}
+
+	return readMessages(resp, func(msg Message, retry time.Duration) error {
+		if retry > 0 {
+			s.reconnect = retry
+		}
+		if msg.ID != "" {
+			s.lastEventID = msg.ID
+		}
+		if msg.Data == "" {
+			return nil
+		}
+		return s.apply(ctx, msg)
+	})
+}
+
+// list fetches the full list of nodes.
+func (s *session) list(ctx context.Context) error {
+	resp, err := s.get(ctx, s.conf.List, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var payload interface{}
+	err = json.NewDecoder(resp.Body).Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("Invalid list response: %s", err)
+	}
+	ev, err := mapNodes(payload, s.conf.List.Items, &s.conf.Fields, func(interface{}) pipe.NodeStatus { return pipe.NodeUp })
+	if err != nil {
+		return fmt.Errorf("Invalid list response: %s", err)
+	}
+	return s.send(ctx, s.fullCh, ev)
+}
+
+// apply maps a message to an event using the configured mappings of its type.
+func (s *session) apply(ctx context.Context, msg Message) error {
+	evConf, found := s.conf.Events[msg.Event]
+	if !found {
+		return nil
+	}
+	if evConf.Action == "resync" {
+		return s.list(ctx)
+	}
+
+	var payload interface{}
+	err := json.Unmarshal([]byte(msg.Data), &payload)
+	if err != nil {
+		log.Printf("Ignoring event %s with invalid payload: %s", msg.Event, err)
+		return nil
+	}
+	for path, expected := range evConf.Filter {
+		if val, ok := Lookup(payload, path); !ok || toString(val) != expected {
+			return nil
+		}
+	}
+	fields := &s.conf.Fields
+	if evConf.Fields != nil {
+		fields = evConf.Fields
+	}
+
+	outCh := s.incCh
+	var status func(item interface{}) pipe.NodeStatus
+	switch evConf.Action {
+	case "up", "full":
+		status = func(interface{}) pipe.NodeStatus { return pipe.NodeUp }
+		if evConf.Action == "full" {
+			outCh = s.fullCh
+		}
+	case "down":
+		status = func(interface{}) pipe.NodeStatus { return pipe.NodeDown }
+	case "status":
+		status = func(item interface{}) pipe.NodeStatus {
+			val, _ := Lookup(item, evConf.Status)
+			for _, up := range evConf.Up {
+				if toString(val) == up {
+					return pipe.NodeUp
+				}
+			}
+			return pipe.NodeDown
+		}
+	}
+	ev, err := mapNodes(payload, evConf.Items, fields, status)
+	if err != nil {
+		log.Printf("Ignoring event %s: %s", msg.Event, err)
+		return nil
+	}
+	return s.send(ctx, outCh, ev)
+}
+
+func (s *session) send(ctx context.Context, ch chan pipe.Event, ev pipe.Event) error {
+	select {
+	case ch <- ev:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *session) get(ctx context.Context, r Request, stream bool) (*http.Response, error) {
+	req, err := http.NewRequest("GET", r.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, val := range r.Headers {
+		req.Header.Set(key, val)
+	}
+	if stream {
+		req.Header.Set("Accept", "text/event-stream")
+		if s.lastEventID != "" {
+			req.Header.Set("Last-Event-ID", s.lastEventID)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Request %s returned status %d", r.URL, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// readMessages parses the event stream and calls fn for every dispatched message.
+// retry is the reconnection time sent by the server or zero.
+func readMessages(resp *http.Response, fn func(msg Message, retry time.Duration) error) error {
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var msg Message
+	var data []string
+	var retry time.Duration
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" { // Dispatch
+			msg.Data = strings.Join(data, "\n")
+			if msg.Event == "" {
+				msg.Event = "message"
+			}
+			err := fn(msg, retry)
+			if err != nil {
+				return err
+			}
+			msg, data, retry = Message{}, nil, 0
+			continue
+		}
+		if strings.HasPrefix(line, ":") { // Comment
+			continue
+		}
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			msg.Event = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			msg.ID = value
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil {
+				retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("Stream closed")
+}
+
+// mapNodes maps the items found at path inside the payload to nodes.
+// The items may be a list or a single object.
+func mapNodes(payload interface{}, path string, fields *Fields, status func(item interface{}) pipe.NodeStatus) (pipe.Event, error) {
+	items, ok := Lookup(payload, path)
+	if !ok {
+		return nil, fmt.Errorf("Path %q not found", path)
+	}
+	list, isList := items.([]interface{})
+	if !isList {
+		list = []interface{}{items}
+	}
+	ev := pipe.NewEvent()
+	for _, item := range list {
+		nameVal, ok := Lookup(item, fields.Name)
+		name := toString(nameVal)
+		if !ok || name == "" {
+			return nil, errors.New("Node without name")
+		}
+		node := pipe.NewNodeInfo(name, status(item), "", 0)
+		if val, ok := Lookup(item, fields.Host); ok && fields.Host != "" {
+			node.Host = toString(val)
+		}
+		if val, ok := Lookup(item, fields.Port); ok && fields.Port != "" {
+			port, err := strconv.ParseUint(toString(val), 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("Node %s has invalid port: %s", name, err)
+			}
+			node.Port = uint16(port)
+		}
+		for key, path := range fields.Meta {
+			if val, ok := Lookup(item, path); ok {
+				if node.Meta == nil {
+					node.Meta = make(map[string]string)
+				}
+				node.Meta[key] = toString(val)
+			}
+		}
+		ev.AddNode(node)
+	}
+	return ev, nil
+}
+
+// Lookup returns the value at the path inside a decoded json value.
+// Paths are JSONPath-like: "$.tasks[0].host", the leading "$" is optional
+// and list indices may be written as "tasks.0.host". An empty path returns v.
+func Lookup(v interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	path = strings.Replace(path, "[", ".", -1)
+	path = strings.Replace(path, "]", "", -1)
+	if path == "" {
+		return v, true
+	}
+	for _, part := range strings.Split(path, ".") {
+		switch val := v.(type) {
+		case map[string]interface{}:
+			var found bool
+			v, found = val[part]
+			if !found {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(val) {
+				return nil, false
+			}
+			v = val[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// toString formats json scalars, numbers without exponent.
+func toString(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	default:
+		b, _ := json.Marshal(val)
+		return string(b)
+	}
+}
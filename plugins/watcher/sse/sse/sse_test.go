@@ -0,0 +1,159 @@
+package sse
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeMarathon serves a task list and an event stream like marathon.
+type fakeMarathon struct {
+	mutex        sync.Mutex
+	tasks        string
+	lists        int
+	lastEventIDs []string
+	eventsCh     chan string // Raw event stream chunks, empty string closes the stream
+}
+
+func (m *fakeMarathon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v2/apps/web/tasks":
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		m.lists++
+		fmt.Fprint(w, m.tasks)
+	case "/v2/events":
+		if r.Header.Get("Accept") != "text/event-stream" {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		m.mutex.Lock()
+		m.lastEventIDs = append(m.lastEventIDs, r.Header.Get("Last-Event-ID"))
+		m.mutex.Unlock()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case chunk := <-m.eventsCh:
+				if chunk == "" {
+					return
+				}
+				fmt.Fprint(w, chunk)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestFunc(t *testing.T) {
+	fake := &fakeMarathon{
+		tasks:    `{"tasks":[{"id":"web.1","appId":"/web","host":"10.0.0.1","ports":[31000],"version":"v1"}]}`,
+		eventsCh: make(chan string),
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	cfg := fmt.Sprintf(`{
+  "list": {"url": "%[1]s/v2/apps/web/tasks", "items": "$.tasks"},
+  "stream": {"url": "%[1]s/v2/events"},
+  "fields": {"name": "id", "host": "host", "port": "ports[0]", "meta": {"version": "version"}},
+  "events": {
+    "status_update_event": {
+      "action": "status",
+      "fields": {"name": "taskId", "host": "host", "port": "ports.0"},
+      "status": "taskStatus",
+      "up": ["TASK_RUNNING"],
+      "filter": {"appId": "/web"}
+    },
+    "deployment_success": {"action": "resync"}
+  },
+  "reconnect": "10ms"
+}`, server.URL)
+	watcher := &SSEWatcher{}
+	manHandle, eventCh := plugintest.StartWatcher(t, watcher, cfg)
+
+	ev := plugintest.ReceiveEvent(t, eventCh)
+	if node, found := ev["web.1"]; len(ev) != 1 || !found {
+		t.Fatalf("Expected web.1, got %s", ev)
+	} else if node.Host != "10.0.0.1" || node.Port != 31000 || node.Meta["version"] != "v1" {
+		t.Errorf("Invalid node: %s", node)
+	}
+
+	// Other app is filtered, unknown events are ignored
+	fake.eventsCh <- "event: status_update_event\ndata: {\"appId\":\"/other\",\"taskId\":\"other.1\",\"taskStatus\":\"TASK_RUNNING\"}\n\n"
+	fake.eventsCh <- ": keepalive\nevent: unknown_event\ndata: {}\n\n"
+	fake.eventsCh <- "id: 42\nevent: status_update_event\ndata: {\"appId\":\"/web\",\"taskId\":\"web.2\",\n" +
+		"data: \"taskStatus\":\"TASK_RUNNING\",\"host\":\"10.0.0.2\",\"ports\":[31001]}\n\n"
+	ev = plugintest.ReceiveEvent(t, eventCh)
+	if node, found := ev["web.2"]; len(ev) != 1 || !found || node.Status != pipe.NodeUp || node.Port != 31001 {
+		t.Fatalf("Expected web.2 up, got %s", ev)
+	}
+
+	fake.eventsCh <- "event: status_update_event\ndata: {\"appId\":\"/web\",\"taskId\":\"web.1\",\"taskStatus\":\"TASK_KILLED\",\"host\":\"10.0.0.1\",\"ports\":[31000]}\n\n"
+	ev = plugintest.ReceiveEvent(t, eventCh)
+	if node, found := ev["web.1"]; len(ev) != 1 || !found || node.Status != pipe.NodeDown {
+		t.Fatalf("Expected web.1 down, got %s", ev)
+	}
+
+	// Reconnect sends last event id and lists again
+	fake.mutex.Lock()
+	fake.tasks = `{"tasks":[{"id":"web.3","host":"10.0.0.3","ports":[31002]}]}`
+	fake.mutex.Unlock()
+	fake.eventsCh <- ""
+	ev = plugintest.ReceiveEvent(t, eventCh)
+	if len(ev) != 2 || ev["web.2"].Status != pipe.NodeDown || ev["web.3"].Status != pipe.NodeUp {
+		t.Fatalf("Expected web.2 down and web.3 up, got %s", ev)
+	}
+
+	// Resync lists again
+	fake.mutex.Lock()
+	fake.tasks = `{"tasks":[]}`
+	fake.mutex.Unlock()
+	fake.eventsCh <- "event: deployment_success\ndata: {}\n\n"
+	ev = plugintest.ReceiveEvent(t, eventCh)
+	if len(ev) != 1 || ev["web.3"].Status != pipe.NodeDown {
+		t.Fatalf("Expected web.3 down, got %s", ev)
+	}
+
+	plugintest.Stop(t, manHandle)
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if len(fake.lastEventIDs) != 2 || fake.lastEventIDs[0] != "" || fake.lastEventIDs[1] != "42" {
+		t.Errorf("Expected Last-Event-ID 42 on reconnect, got %q", fake.lastEventIDs)
+	}
+	if fake.lists != 3 {
+		t.Errorf("Expected 3 lists, got %d", fake.lists)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	var v interface{}
+	json.Unmarshal([]byte(`{"a":{"b":[{"c":1.5},{"c":"x"}]},"n":31000}`), &v)
+	tests := []struct {
+		path     string
+		expected string
+		found    bool
+	}{
+		{"$.a.b[0].c", "1.5", true},
+		{"a.b.1.c", "x", true},
+		{"n", "31000", true},
+		{"a.b[2].c", "", false},
+		{"a.x", "", false},
+	}
+	for _, test := range tests {
+		val, found := Lookup(v, test.path)
+		if found != test.found || toString(val) != test.expected {
+			t.Errorf("Lookup %s: expected %q (%t), got %q (%t)", test.path, test.expected, test.found, toString(val), found)
+		}
+	}
+}
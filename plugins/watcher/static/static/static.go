@@ -0,0 +1,149 @@
+package static
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+type StaticWatcher struct {
+}
+
+type ServiceConfig struct {
+	Nodes    []Node `json:"nodes"`
+	File     string `json:"file"`     // Json file containing a list of nodes, reloaded on change
+	Interval string `json:"interval"` // Interval to check the file for changes
+}
+
+// Node is a single node always up.
+type Node struct {
+	Name string            `json:"name"`
+	Host string            `json:"host"`
+	Port uint16            `json:"port"`
+	Meta map[string]string `json:"meta"`
+}
+
+func (w *StaticWatcher) Setup(_ json.RawMessage) error {
+	return nil
+}
+
+func (w *StaticWatcher) Accept(cfgData json.RawMessage) (pipe.Endpoint, error) {
+	cfg := ServiceConfig{
+		Interval: "5s",
+	}
+	err := json.Unmarshal(cfgData, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Nodes) == 0 && cfg.File == "" {
+		return nil, errors.New("No nodes or file configured")
+	}
+	interval, err := time.ParseDuration(cfg.Interval)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid interval: %s", err)
+	}
+	if interval <= 0 {
+		return nil, errors.New("Invalid interval: Must be positive")
+	}
+	// Invalid inline nodes are configuration errors, the file is only logged like on reloads
+	inline := cfg
+	inline.File = ""
+	ev, err := loadNodes(&inline)
+	if err != nil {
+		return nil, err
+	}
+	var lastMod time.Time
+	if cfg.File != "" {
+		ev, lastMod = reload(&cfg, ev, lastMod)
+	}
+
+	return pipe.EndpointFunc(func(eventCh chan pipe.Event, closeCh chan struct{}) {
+		_, fullCh := pipe.Bookkeeper(eventCh)
+		defer close(fullCh)
+
+		for {
+			// Bookkeeper drops unchanged lists and sends only the difference
+			select {
+			case fullCh <- ev:
+			case <-closeCh:
+				return
+			}
+			if cfg.File == "" {
+				<-closeCh
+				return
+			}
+			select {
+			case <-time.After(interval):
+			case <-closeCh:
+				return
+			}
+			ev, lastMod = reload(&cfg, ev, lastMod)
+		}
+	}), nil
+}
+
+// reload reads the file if it was modified since lastMod and returns the nodes and modification time.
+// If the file can't be read, the error is logged and the previous nodes are kept.
+func reload(cfg *ServiceConfig, ev pipe.Event, lastMod time.Time) (pipe.Event, time.Time) {
+	mod, err := modTime(cfg.File)
+	if err != nil {
+		log.Printf("Could not check file %s: %s", cfg.File, err)
+		return ev, lastMod
+	}
+	if mod.Equal(lastMod) {
+		return ev, lastMod
+	}
+	fileEv, err := loadNodes(cfg)
+	if err != nil {
+		log.Printf("Could not load file %s, keeping previous nodes: %s", cfg.File, err)
+		return ev, mod
+	}
+	return fileEv, mod
+}
+
+// modTime returns the modification time of the file.
+func modTime(filename string) (time.Time, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// loadNodes creates a full update of the inline nodes and the nodes listed in the file.
+func loadNodes(cfg *ServiceConfig) (pipe.Event, error) {
+	nodes := cfg.Nodes
+	if cfg.File != "" {
+		b, err := ioutil.ReadFile(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		var fileNodes []Node
+		err = json.Unmarshal(b, &fileNodes)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid file %s: %s", cfg.File, err)
+		}
+		nodes = append(fileNodes, nodes...)
+	}
+
+	ev := pipe.NewEvent()
+	for _, node := range nodes {
+		if node.Name == "" {
+			return nil, errors.New("Node without name")
+		}
+		if _, found := ev[node.Name]; found {
+			return nil, fmt.Errorf("Duplicate node %q", node.Name)
+		}
+		info := pipe.NewNodeInfo(node.Name, pipe.NodeUp, node.Host, node.Port)
+		if len(node.Meta) > 0 {
+			info.Meta = node.Meta
+		}
+		ev.AddNode(info)
+	}
+	return ev, nil
+}
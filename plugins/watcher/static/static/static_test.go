@@ -0,0 +1,128 @@
+package static
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/blang/receptor/pipe"
+	"github.com/blang/receptor/plugin/plugintest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFunc(t *testing.T) {
+	watcher := &StaticWatcher{}
+	manHandle, eventCh := plugintest.StartWatcher(t, watcher, `{"nodes":[
+  {"name":"Node1","host":"127.0.0.1","port":80,"meta":{"zone":"a"}},
+  {"name":"Node2","host":"127.0.0.2","port":81}
+]}`)
+
+	ev := plugintest.ReceiveEvent(t, eventCh)
+	if len(ev) != 2 || ev["Node1"].Status != pipe.NodeUp || ev["Node2"].Port != 81 {
+		t.Fatalf("Expected Node1 and Node2 up, got %s", ev)
+	}
+	if ev["Node1"].Meta["zone"] != "a" {
+		t.Errorf("Expected metadata of Node1, got %s", ev["Node1"])
+	}
+
+	select {
+	case ev := <-eventCh:
+		t.Fatalf("Unexpected event: %s", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	plugintest.Stop(t, manHandle)
+}
+
+func TestReload(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	filename := filepath.Join(tmpDir, "nodes.json")
+	writeNodes := func(data string, mod time.Time) {
+		if err := ioutil.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Set distinct modification times, writes may happen within the resolution of the filesystem
+		if err := os.Chtimes(filename, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	writeNodes(`[{"name":"Node1","host":"127.0.0.1","port":80},{"name":"Node2","host":"127.0.0.2","port":81}]`, start)
+
+	watcher := &StaticWatcher{}
+	manHandle, eventCh := plugintest.StartWatcher(t, watcher, fmt.Sprintf(`{"file":%q,"interval":"10ms","nodes":[{"name":"Inline","host":"127.0.0.9","port":90}]}`, filename))
+
+	if ev := plugintest.ReceiveEvent(t, eventCh); len(ev) != 3 {
+		t.Fatalf("Expected 3 nodes, got %s", ev)
+	}
+
+	// Node1 removed, Node2 changed port, Node3 added
+	writeNodes(`[{"name":"Node2","host":"127.0.0.2","port":82},{"name":"Node3","host":"127.0.0.3","port":83}]`, start.Add(time.Minute))
+	ev := plugintest.ReceiveEvent(t, eventCh)
+	if len(ev) != 3 || ev["Node1"].Status != pipe.NodeDown || ev["Node2"].Port != 82 || ev["Node3"].Status != pipe.NodeUp {
+		t.Fatalf("Expected minimal diff, got %s", ev)
+	}
+
+	// Invalid file keeps previous nodes
+	writeNodes(`[{"name":"Node2"`, start.Add(2*time.Minute))
+	select {
+	case ev := <-eventCh:
+		t.Fatalf("Unexpected event: %s", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	writeNodes(`[{"name":"Node3","host":"127.0.0.3","port":83}]`, start.Add(3*time.Minute))
+	ev = plugintest.ReceiveEvent(t, eventCh)
+	if node, found := ev["Node2"]; len(ev) != 1 || !found || node.Status != pipe.NodeDown {
+		t.Fatalf("Expected Node2 down, got %s", ev)
+	}
+
+	plugintest.Stop(t, manHandle)
+}
+
+func TestAcceptInvalid(t *testing.T) {
+	watcher := &StaticWatcher{}
+	for _, cfg := range []string{
+		`{}`,
+		`{"nodes":[{"host":"127.0.0.1"}]}`,
+		`{"nodes":[{"name":"Node1"},{"name":"Node1"}]}`,
+		`{"file":"/etc/nodes.json","interval":"0s"}`,
+	} {
+		if _, err := watcher.Accept(json.RawMessage(cfg)); err == nil {
+			t.Errorf("Expected error for config %s", cfg)
+		}
+	}
+}
+
+func TestMissingFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	filename := filepath.Join(tmpDir, "nodes.json")
+
+	// Starts with the inline nodes, the file is loaded once it exists
+	watcher := &StaticWatcher{}
+	manHandle, eventCh := plugintest.StartWatcher(t, watcher, fmt.Sprintf(`{"file":%q,"interval":"10ms","nodes":[{"name":"Inline","host":"127.0.0.9","port":90}]}`, filename))
+
+	ev := plugintest.ReceiveEvent(t, eventCh)
+	if _, found := ev["Inline"]; len(ev) != 1 || !found {
+		t.Fatalf("Expected inline node, got %s", ev)
+	}
+	if err := ioutil.WriteFile(filename, []byte(`[{"name":"Node1","host":"127.0.0.1","port":80}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ev = plugintest.ReceiveEvent(t, eventCh)
+	if node, found := ev["Node1"]; len(ev) != 1 || !found || node.Status != pipe.NodeUp {
+		t.Fatalf("Expected Node1 up, got %s", ev)
+	}
+
+	plugintest.Stop(t, manHandle)
+}